@@ -0,0 +1,305 @@
+// Package analytics computes fermentation statistics from a series of
+// gravity readings. It has no storage dependencies; callers convert
+// their readings to Reading first.
+package analytics
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+type Reading struct {
+	Date    time.Time
+	Gravity float64
+	// Only used for downsampling
+	Temperature float64
+}
+
+type ABVFormula int
+
+const (
+	// ABVStandard is the common homebrew approximation, (OG - CG) * 131.25.
+	ABVStandard ABVFormula = iota
+	// ABVAlternate is more accurate for high-gravity beers.
+	ABVAlternate
+	// ABVBalling derives alcohol by weight from original and real extract.
+	ABVBalling
+)
+
+var abvFormulaNames = map[ABVFormula]string{
+	ABVStandard:  "standard",
+	ABVAlternate: "alternate",
+	ABVBalling:   "balling",
+}
+
+func (f ABVFormula) String() string {
+	return abvFormulaNames[f]
+}
+
+// ParseABVFormula converts a formula name, as returned by String,
+// back into an ABVFormula.
+func ParseABVFormula(name string) (ABVFormula, error) {
+	for formula, formulaName := range abvFormulaNames {
+		if formulaName == name {
+			return formula, nil
+		}
+	}
+	return ABVStandard, errors.New("unknown ABV formula " + name)
+}
+
+type Options struct {
+	// OGSamples is how many of the earliest readings are considered
+	// when finding original gravity; their median is used, so a few
+	// noisy readings at the start of a batch don't skew the result.
+	OGSamples int
+	// CurrentSamples is how many of the latest readings are considered
+	// when finding current gravity. Analyze uses at most half the
+	// readings for each.
+	CurrentSamples int
+	ABVFormula     ABVFormula
+	// RateWindows are the periods, ending at the latest reading, over
+	// which to calculate the rate of gravity change.
+	RateWindows []time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		OGSamples:      5,
+		CurrentSamples: 3,
+		ABVFormula:     ABVAlternate,
+		RateWindows:    []time.Duration{6 * time.Hour, 24 * time.Hour},
+	}
+}
+
+type Rate struct {
+	Window time.Duration
+	// GravityPerDay is the slope of the readings in the window; it is
+	// negative while a batch ferments.
+	GravityPerDay float64
+}
+
+type Summary struct {
+	OriginalGravity     float64
+	CurrentGravity      float64
+	ApparentAttenuation float64
+	RealAttenuation     float64
+	ABV                 float64
+	Rates               []Rate
+}
+
+// Analyze computes a Summary for the given readings, which need not be
+// sorted. With no readings, everything in the summary is zero.
+func Analyze(readings []Reading, opts Options) Summary {
+	summary := Summary{Rates: []Rate{}}
+
+	if len(readings) == 0 {
+		return summary
+	}
+
+	sorted := sortedReadings(readings)
+
+	summary.OriginalGravity = OriginalGravity(sorted, sampleWindow(opts.OGSamples, len(sorted)))
+	summary.CurrentGravity = CurrentGravity(sorted, sampleWindow(opts.CurrentSamples, len(sorted)))
+	summary.ApparentAttenuation = ApparentAttenuation(summary.OriginalGravity, summary.CurrentGravity)
+	summary.RealAttenuation = RealAttenuation(summary.OriginalGravity, summary.CurrentGravity)
+	summary.ABV = ABV(summary.OriginalGravity, summary.CurrentGravity, opts.ABVFormula)
+
+	for _, window := range opts.RateWindows {
+		summary.Rates = append(summary.Rates, Rate{
+			Window:        window,
+			GravityPerDay: GravityRate(sorted, window),
+		})
+	}
+
+	return summary
+}
+
+// OriginalGravity returns the median of the first samples readings.
+// Readings must be sorted oldest first.
+func OriginalGravity(readings []Reading, samples int) float64 {
+	if samples < 1 || samples > len(readings) {
+		samples = len(readings)
+	}
+	return medianGravity(readings[:samples])
+}
+
+// CurrentGravity returns the median of the last samples readings.
+// Readings must be sorted oldest first.
+func CurrentGravity(readings []Reading, samples int) float64 {
+	if samples < 1 || samples > len(readings) {
+		samples = len(readings)
+	}
+	return medianGravity(readings[len(readings)-samples:])
+}
+
+// sampleWindow caps a sample count at half of n readings, but at least
+// one, so that in short series the OG and current gravity windows
+// don't overlap and cancel out.
+func sampleWindow(samples int, n int) int {
+	limit := n / 2
+	if limit < 1 {
+		limit = 1
+	}
+	if samples < 1 || samples > limit {
+		return limit
+	}
+	return samples
+}
+
+// ApparentAttenuation returns the fraction of original gravity
+// points consumed, uncorrected for the density of alcohol.
+func ApparentAttenuation(og, cg float64) float64 {
+	if og <= 1.0 {
+		return 0
+	}
+	return (og - cg) / (og - 1.0)
+}
+
+// RealAttenuation returns the fraction of original extract consumed,
+// estimating real extract from apparent extract.
+func RealAttenuation(og, cg float64) float64 {
+	oe := SGToPlato(og)
+	if oe <= 0 {
+		return 0
+	}
+	return (oe - realExtract(og, cg)) / oe
+}
+
+// ABV returns alcohol by volume, in percent.
+func ABV(og, cg float64, formula ABVFormula) float64 {
+	if og <= 1.0 {
+		return 0
+	}
+
+	switch formula {
+	case ABVAlternate:
+		return (76.08 * (og - cg) / (1.775 - og)) * (cg / 0.794)
+	case ABVBalling:
+		oe := SGToPlato(og)
+		abw := (oe - realExtract(og, cg)) / (2.0665 - 0.010665*oe)
+		return abw * cg / 0.794
+	default:
+		return (og - cg) * 131.25
+	}
+}
+
+// GravityRate returns the least-squares slope, in gravity per day, of
+// the readings in the window ending at the latest reading. Readings
+// must be sorted oldest first. With fewer than two readings in the
+// window, the rate is zero.
+func GravityRate(readings []Reading, window time.Duration) float64 {
+	if len(readings) < 2 {
+		return 0
+	}
+
+	start := readings[len(readings)-1].Date.Add(-window)
+	windowed := []Reading{}
+	for _, r := range readings {
+		if !r.Date.Before(start) {
+			windowed = append(windowed, r)
+		}
+	}
+
+	if len(windowed) < 2 {
+		return 0
+	}
+
+	// x is days since the start of the window
+	n := float64(len(windowed))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, r := range windowed {
+		x := r.Date.Sub(start).Hours() / 24
+		sumX += x
+		sumY += r.Gravity
+		sumXY += x * r.Gravity
+		sumXX += x * x
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// TerminalGravity reports whether gravity has stopped changing: the
+// readings in the window ending at the latest reading must all lie
+// within threshold of each other, and must cover the whole window. If
+// so, it returns their median as the final gravity. Readings must be
+// sorted oldest first.
+func TerminalGravity(readings []Reading, threshold float64, window time.Duration) (float64, bool) {
+	if len(readings) < 2 || window <= 0 {
+		return 0, false
+	}
+
+	start := readings[len(readings)-1].Date.Add(-window)
+	if readings[0].Date.After(start) {
+		// Not enough history to tell
+		return 0, false
+	}
+
+	windowed := []Reading{}
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, r := range readings {
+		if r.Date.Before(start) {
+			continue
+		}
+		windowed = append(windowed, r)
+		min = math.Min(min, r.Gravity)
+		max = math.Max(max, r.Gravity)
+	}
+
+	if len(windowed) < 2 || max-min >= threshold {
+		return 0, false
+	}
+	return medianGravity(windowed), true
+}
+
+// CorrectGravity adjusts a gravity measured at sampleTemperature for
+// a hydrometer calibrated at calibrationTemperature, both in °F.
+func CorrectGravity(sg, sampleTemperature, calibrationTemperature float64) float64 {
+	return sg * waterDensityFactor(sampleTemperature) / waterDensityFactor(calibrationTemperature)
+}
+
+// waterDensityFactor is the polynomial from the usual homebrew
+// hydrometer correction formula, in °F.
+func waterDensityFactor(f float64) float64 {
+	return 1.00130346 - 0.000134722124*f + 0.00000204052596*f*f - 0.00000000232820948*f*f*f
+}
+
+// SGToPlato converts specific gravity to degrees Plato.
+func SGToPlato(sg float64) float64 {
+	return -616.868 + 1111.14*sg - 630.272*sg*sg + 135.997*sg*sg*sg
+}
+
+func realExtract(og, cg float64) float64 {
+	return 0.1808*SGToPlato(og) + 0.8192*SGToPlato(cg)
+}
+
+func medianGravity(readings []Reading) float64 {
+	if len(readings) == 0 {
+		return 0
+	}
+
+	gravities := make([]float64, len(readings))
+	for i, r := range readings {
+		gravities[i] = r.Gravity
+	}
+	sort.Float64s(gravities)
+
+	middle := len(gravities) / 2
+	if len(gravities)%2 == 0 {
+		return (gravities[middle-1] + gravities[middle]) / 2
+	}
+	return gravities[middle]
+}
+
+func sortedReadings(readings []Reading) []Reading {
+	sorted := append([]Reading{}, readings...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.Before(sorted[j].Date)
+	})
+	return sorted
+}
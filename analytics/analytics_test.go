@@ -0,0 +1,259 @@
+package analytics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func closeTo(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func testReadings(start time.Time, gravities ...float64) []Reading {
+	readings := []Reading{}
+	for i, g := range gravities {
+		readings = append(readings, Reading{
+			Date:    start.Add(time.Duration(i) * time.Hour),
+			Gravity: g,
+		})
+	}
+	return readings
+}
+
+func TestOriginalGravityIgnoresNoise(t *testing.T) {
+	start := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	// A spike and a dip in the first few readings, as when a
+	// hydrometer is still settling in the fermenter
+	readings := testReadings(start, 1.090, 1.050, 1.060, 1.060, 1.059, 1.055, 1.050)
+
+	og := OriginalGravity(readings, 5)
+	if og != 1.060 {
+		t.Errorf("Wrong OG: %v", og)
+	}
+
+	og = OriginalGravity(readings[:2], 5)
+	if !closeTo(og, 1.070, 0.00001) {
+		t.Errorf("Wrong OG for short series: %v", og)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	start := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	readings := testReadings(start, 1.050, 1.050, 1.050, 1.040, 1.030, 1.020, 1.010, 1.010, 1.010)
+
+	// Out of order on purpose
+	readings[0], readings[8] = readings[8], readings[0]
+
+	opts := DefaultOptions()
+	opts.ABVFormula = ABVStandard
+	summary := Analyze(readings, opts)
+
+	if summary.OriginalGravity != 1.050 || summary.CurrentGravity != 1.010 {
+		t.Errorf("Wrong gravities: %v", summary)
+	}
+
+	if !closeTo(summary.ApparentAttenuation, 0.8, 0.00001) {
+		t.Errorf("Wrong apparent attenuation: %v", summary.ApparentAttenuation)
+	}
+
+	if summary.RealAttenuation >= summary.ApparentAttenuation || summary.RealAttenuation < 0.6 {
+		t.Errorf("Implausible real attenuation: %v", summary.RealAttenuation)
+	}
+
+	if !closeTo(summary.ABV, 5.25, 0.00001) {
+		t.Errorf("Wrong ABV: %v", summary.ABV)
+	}
+
+	if len(summary.Rates) != 2 || summary.Rates[0].GravityPerDay >= 0 {
+		t.Errorf("Wrong rates: %v", summary.Rates)
+	}
+}
+
+func TestAnalyzeShortSeries(t *testing.T) {
+	start := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	summary := Analyze(testReadings(start, 1.050, 1.040), DefaultOptions())
+	if summary.OriginalGravity != 1.050 || summary.CurrentGravity != 1.040 {
+		t.Errorf("Wrong gravities for 2 readings: %v", summary)
+	}
+
+	summary = Analyze(testReadings(start, 1.050, 1.048, 1.030, 1.020), DefaultOptions())
+	if !closeTo(summary.OriginalGravity, 1.049, 0.00001) || !closeTo(summary.CurrentGravity, 1.025, 0.00001) {
+		t.Errorf("Wrong gravities for 4 readings: %v", summary)
+	}
+	if summary.ApparentAttenuation <= 0 {
+		t.Errorf("No attenuation for 4 readings: %v", summary.ApparentAttenuation)
+	}
+}
+
+func TestABVFormulas(t *testing.T) {
+	og := 1.050
+	cg := 1.010
+
+	standard := ABV(og, cg, ABVStandard)
+	alternate := ABV(og, cg, ABVAlternate)
+	balling := ABV(og, cg, ABVBalling)
+
+	for _, abv := range []float64{standard, alternate, balling} {
+		if !closeTo(abv, 5.25, 0.3) {
+			t.Errorf("ABV formulas disagree: %v %v %v", standard, alternate, balling)
+			break
+		}
+	}
+
+	if ABV(1.0, 1.0, ABVAlternate) != 0 {
+		t.Errorf("Nonzero ABV with no original gravity")
+	}
+
+	formula, err := ParseABVFormula(ABVBalling.String())
+	if err != nil || formula != ABVBalling {
+		t.Errorf("Unable to parse formula name")
+	}
+}
+
+func TestGravityRate(t *testing.T) {
+	start := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	// Dropping 0.001 per hour is 0.024 per day
+	readings := testReadings(start, 1.060, 1.059, 1.058, 1.057, 1.056)
+
+	rate := GravityRate(readings, 6*time.Hour)
+	if !closeTo(rate, -0.024, 0.00001) {
+		t.Errorf("Wrong rate: %v", rate)
+	}
+
+	// Only the last reading falls in the window
+	rate = GravityRate(readings, 30*time.Minute)
+	if rate != 0 {
+		t.Errorf("Rate from a single reading: %v", rate)
+	}
+}
+
+func TestFitPolynomial(t *testing.T) {
+	// Points on 0.9 + 0.002x + 0.00001x², as a tilt calibration might be
+	expected := []float64{0.9, 0.002, 0.00001}
+	angles := []float64{25, 35, 45, 55, 65, 75}
+	gravities := []float64{}
+	for _, angle := range angles {
+		gravities = append(gravities, EvaluatePolynomial(expected, angle))
+	}
+
+	coefficients, err := FitPolynomial(angles, gravities, 2)
+	if err != nil {
+		t.Fatalf("Fit failed: %v", err)
+	}
+
+	for i := range expected {
+		if !closeTo(coefficients[i], expected[i], 0.0000001) {
+			t.Errorf("Wrong coefficients: %v", coefficients)
+			break
+		}
+	}
+
+	_, err = FitPolynomial(angles[:2], gravities[:2], 2)
+	if err == nil {
+		t.Errorf("Fit allowed too few points")
+	}
+
+	_, err = FitPolynomial([]float64{30, 30, 30}, []float64{1.0, 1.01, 1.02}, 2)
+	if err == nil {
+		t.Errorf("Fit allowed repeated angles")
+	}
+}
+
+func TestTerminalGravity(t *testing.T) {
+	start := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	readings := testReadings(start, 1.020, 1.014, 1.012, 1.0115, 1.012, 1.0118)
+
+	gravity, stable := TerminalGravity(readings, 0.001, 3*time.Hour)
+	if !stable || !closeTo(gravity, 1.0119, 0.00001) {
+		t.Errorf("Expected stable at 1.0119, got %v at %v", stable, gravity)
+	}
+
+	// Still dropping over a longer window
+	_, stable = TerminalGravity(readings, 0.001, 4*time.Hour)
+	if stable {
+		t.Errorf("Stable while gravity is still dropping")
+	}
+
+	// Longer than the readings cover
+	_, stable = TerminalGravity(readings, 0.1, 6*time.Hour)
+	if stable {
+		t.Errorf("Stable without a full window of readings")
+	}
+}
+
+func TestCorrectGravity(t *testing.T) {
+	if CorrectGravity(1.050, 60, 60) != 1.050 {
+		t.Errorf("Correction at calibration temperature changed gravity")
+	}
+
+	// Warm samples read low
+	corrected := CorrectGravity(1.050, 80, 60)
+	if !closeTo(corrected, 1.052, 0.0005) {
+		t.Errorf("Wrong correction for warm sample: %v", corrected)
+	}
+
+	corrected = CorrectGravity(1.050, 50, 60)
+	if corrected >= 1.050 {
+		t.Errorf("Wrong correction for cold sample: %v", corrected)
+	}
+}
+
+func TestBucketReadings(t *testing.T) {
+	start := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	readings := testReadings(start, 1.050, 1.048, 1.046, 1.044, 1.042)
+
+	// Hourly readings in 2h buckets: 0-1, 2-3, 4
+	buckets := BucketReadings(readings, 2*time.Hour)
+
+	if len(buckets) != 3 || buckets[0].Count != 2 || buckets[2].Count != 1 {
+		t.Fatalf("Wrong buckets: %v", buckets)
+	}
+
+	if buckets[0].MinGravity != 1.048 || buckets[0].MaxGravity != 1.050 || !closeTo(buckets[0].MeanGravity, 1.049, 0.00001) {
+		t.Errorf("Wrong bucket summary: %v", buckets[0])
+	}
+
+	if !buckets[1].Start.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("Bucket misaligned: %v", buckets[1].Start)
+	}
+}
+
+func TestLTTB(t *testing.T) {
+	start := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	gravities := []float64{}
+	for i := 0; i < 100; i++ {
+		gravities = append(gravities, 1.050)
+	}
+	// One spike that any shape-preserving downsample must keep
+	gravities[37] = 1.070
+	readings := testReadings(start, gravities...)
+
+	indices := LTTB(readings, 10)
+
+	if len(indices) != 10 || indices[0] != 0 || indices[9] != 99 {
+		t.Fatalf("Wrong indices: %v", indices)
+	}
+
+	keptSpike := false
+	for i, index := range indices {
+		if index == 37 {
+			keptSpike = true
+		}
+		if i > 0 && index <= indices[i-1] {
+			t.Errorf("Indices out of order: %v", indices)
+		}
+	}
+
+	if !keptSpike {
+		t.Errorf("Spike dropped: %v", indices)
+	}
+
+	if len(LTTB(readings[:5], 10)) != 5 {
+		t.Errorf("Short series downsampled")
+	}
+}
@@ -0,0 +1,93 @@
+package analytics
+
+import (
+	"errors"
+	"math"
+)
+
+// FitPolynomial finds the least-squares polynomial of the given degree
+// through the points (xs[i], ys[i]). Coefficients are returned constant
+// term first, so a quadratic is c[0] + c[1]x + c[2]x².
+func FitPolynomial(xs, ys []float64, degree int) ([]float64, error) {
+	if degree < 1 {
+		return nil, errors.New("polynomial degree must be at least 1")
+	}
+	if len(xs) != len(ys) {
+		return nil, errors.New("mismatched point coordinates")
+	}
+	if len(xs) <= degree {
+		return nil, errors.New("not enough points for polynomial degree")
+	}
+
+	// Normal equations: (XᵀX)c = Xᵀy, as an augmented matrix
+	n := degree + 1
+	matrix := make([][]float64, n)
+	for row := range matrix {
+		matrix[row] = make([]float64, n+1)
+	}
+
+	for i, x := range xs {
+		powers := make([]float64, 2*n-1)
+		powers[0] = 1
+		for p := 1; p < len(powers); p++ {
+			powers[p] = powers[p-1] * x
+		}
+
+		for row := 0; row < n; row++ {
+			for col := 0; col < n; col++ {
+				matrix[row][col] += powers[row+col]
+			}
+			matrix[row][n] += powers[row] * ys[i]
+		}
+	}
+
+	return solve(matrix)
+}
+
+// EvaluatePolynomial evaluates a polynomial with coefficients in the
+// order FitPolynomial returns them.
+func EvaluatePolynomial(coefficients []float64, x float64) float64 {
+	y := 0.0
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = y*x + coefficients[i]
+	}
+	return y
+}
+
+// solve solves an augmented matrix by Gaussian elimination with
+// partial pivoting.
+func solve(matrix [][]float64) ([]float64, error) {
+	n := len(matrix)
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(matrix[row][col]) > math.Abs(matrix[pivot][col]) {
+				pivot = row
+			}
+		}
+
+		if math.Abs(matrix[pivot][col]) < 1e-12 {
+			return nil, errors.New("points don't determine a polynomial; are the x values distinct?")
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+
+		for row := col + 1; row < n; row++ {
+			factor := matrix[row][col] / matrix[col][col]
+			for k := col; k <= n; k++ {
+				matrix[row][k] -= factor * matrix[col][k]
+			}
+		}
+	}
+
+	result := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := matrix[row][n]
+		for k := row + 1; k < n; k++ {
+			sum -= matrix[row][k] * result[k]
+		}
+		result[row] = sum / matrix[row][row]
+	}
+
+	return result, nil
+}
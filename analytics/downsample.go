@@ -0,0 +1,112 @@
+package analytics
+
+import (
+	"math"
+	"time"
+)
+
+// Bucket summarizes the readings in one interval of a series.
+type Bucket struct {
+	Start           time.Time
+	Count           int
+	MinGravity      float64
+	MaxGravity      float64
+	MeanGravity     float64
+	MinTemperature  float64
+	MaxTemperature  float64
+	MeanTemperature float64
+}
+
+// BucketReadings groups readings into intervals of the given width,
+// aligned to the zero time so that buckets don't move when the range
+// does. Readings must be sorted oldest first. Empty intervals get no
+// bucket.
+func BucketReadings(readings []Reading, width time.Duration) []Bucket {
+	buckets := []Bucket{}
+
+	for _, r := range readings {
+		start := r.Date.Truncate(width)
+
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Start.Equal(start) {
+			buckets = append(buckets, Bucket{
+				Start:          start,
+				MinGravity:     r.Gravity,
+				MaxGravity:     r.Gravity,
+				MinTemperature: r.Temperature,
+				MaxTemperature: r.Temperature,
+			})
+		}
+
+		b := &buckets[len(buckets)-1]
+		b.Count++
+		b.MinGravity = math.Min(b.MinGravity, r.Gravity)
+		b.MaxGravity = math.Max(b.MaxGravity, r.Gravity)
+		b.MinTemperature = math.Min(b.MinTemperature, r.Temperature)
+		b.MaxTemperature = math.Max(b.MaxTemperature, r.Temperature)
+
+		// Running means, so there's nothing to finish up afterwards
+		b.MeanGravity += (r.Gravity - b.MeanGravity) / float64(b.Count)
+		b.MeanTemperature += (r.Temperature - b.MeanTemperature) / float64(b.Count)
+	}
+
+	return buckets
+}
+
+// LTTB picks threshold readings that preserve the visual shape of the
+// series, using the largest-triangle-three-buckets algorithm, and
+// returns their indices. Readings must be sorted oldest first. The
+// first and last readings are always kept.
+func LTTB(readings []Reading, threshold int) []int {
+	n := len(readings)
+
+	if threshold >= n || threshold < 3 {
+		indices := make([]int, n)
+		for i := range indices {
+			indices[i] = i
+		}
+		return indices
+	}
+
+	x := func(i int) float64 {
+		return float64(readings[i].Date.Sub(readings[0].Date)) / float64(time.Hour)
+	}
+	y := func(i int) float64 {
+		return readings[i].Gravity
+	}
+
+	indices := []int{0}
+	bucketSize := float64(n-2) / float64(threshold-2)
+	previous := 0
+
+	for bucket := 0; bucket < threshold-2; bucket++ {
+		start := int(float64(bucket)*bucketSize) + 1
+		end := int(float64(bucket+1)*bucketSize) + 1
+
+		// The third point of the triangle is the mean of the next bucket
+		nextStart, nextEnd := end, int(float64(bucket+2)*bucketSize)+1
+		if nextEnd > n {
+			nextEnd = n
+		}
+		var meanX, meanY float64
+		for i := nextStart; i < nextEnd; i++ {
+			meanX += x(i)
+			meanY += y(i)
+		}
+		count := float64(nextEnd - nextStart)
+		meanX /= count
+		meanY /= count
+
+		best, bestArea := start, -1.0
+		for i := start; i < end; i++ {
+			area := math.Abs((x(previous)-meanX)*(y(i)-y(previous)) - (x(previous)-x(i))*(meanY-y(previous)))
+			if area > bestArea {
+				best, bestArea = i, area
+			}
+		}
+
+		indices = append(indices, best)
+		previous = best
+	}
+
+	return append(indices, n-1)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/auth"
+	"github.com/jslater89/graviton/data"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// QueryAlerts lists alerts, newest first. Query parameters:
+//
+//	batch, hydrometer  IDs to filter by
+//	kind               temperature, battery, silent or stalled
+//	state              comma-separated states; open and acknowledged
+//	                   if unset, or 'all'
+func QueryAlerts(c echo.Context) error {
+	query := data.AlertQuery{States: data.UnresolvedAlertStates}
+
+	for param, id := range map[string]*bson.ObjectId{"batch": &query.BatchID, "hydrometer": &query.HydrometerID} {
+		value := c.QueryParam(param)
+		if value == "" {
+			continue
+		}
+		if !bson.IsObjectIdHex(value) {
+			return c.JSON(400, bson.M{"error": "bad object id"})
+		}
+		*id = bson.ObjectIdHex(value)
+	}
+
+	if c.QueryParam("kind") != "" {
+		kind, err := data.ParseAlertKind(c.QueryParam("kind"))
+		if err != nil {
+			return c.JSON(400, bson.M{"error": err.Error()})
+		}
+		query.Kind = kind
+	}
+
+	if c.QueryParam("state") == "all" {
+		query.States = nil
+	} else if c.QueryParam("state") != "" {
+		query.States = []data.AlertState{}
+		for _, name := range strings.Split(c.QueryParam("state"), ",") {
+			state, err := data.ParseAlertState(strings.TrimSpace(name))
+			if err != nil {
+				return c.JSON(400, bson.M{"error": err.Error()})
+			}
+			query.States = append(query.States, state)
+		}
+	}
+
+	alerts, err := data.QueryAlerts(query)
+
+	if err != nil {
+		graviton.Logger.Warn("Alert query failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	return c.JSON(200, alerts)
+}
+
+// AcknowledgeAlert marks an open alert as seen. It stays unresolved
+// until its condition clears.
+func AcknowledgeAlert(c echo.Context) error {
+	return changeAlert(c, (*data.Alert).Acknowledge)
+}
+
+// ResolveAlert closes an alert by hand.
+func ResolveAlert(c echo.Context) error {
+	return changeAlert(c, (*data.Alert).Resolve)
+}
+
+func changeAlert(c echo.Context, change func(a *data.Alert, user string) error) error {
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		return c.JSON(400, bson.M{"error": "bad object id"})
+	}
+
+	alert, err := data.SingleAlert(data.AlertQuery{ID: bson.ObjectIdHex(id)})
+
+	if err == data.ErrNotFound {
+		return c.JSON(404, bson.M{"error": "alert not found"})
+	} else if err != nil {
+		graviton.Logger.Warn("Alert query failed", zap.String("ID", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	err = change(alert, auth.RequestUser(c))
+
+	if err == data.ErrAlertResolved {
+		return c.JSON(409, bson.M{"error": err.Error()})
+	} else if err != nil {
+		graviton.Logger.Warn("Alert update failed", zap.String("ID", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database update failed"})
+	}
+
+	return c.JSON(200, alert)
+}
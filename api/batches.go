@@ -1,77 +1,160 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/analytics"
 	"github.com/jslater89/graviton/auth"
+	"github.com/jslater89/graviton/config"
 	"github.com/jslater89/graviton/data"
+	"github.com/jslater89/graviton/units"
 	"github.com/labstack/echo"
 	"go.uber.org/zap"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// QueryBatches lists batches, filtered by the parameters in
+// parseBatchQuery and paged by those in parsePageParams. Batches sort by
+// startDate, lastUpdate, recipe or stringId.
 func QueryBatches(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/batches") {
-		return nil
+	query := data.BatchQuery{
+		Archived: data.Bool(false),
 	}
 
-	query := bson.M{
-		"archived": false,
+	err := parseBatchQuery(c, &query)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
 	}
 
-	err := parseBatchQuery(c, query)
+	responseUnits, err := responseUnits(c)
 
 	if err != nil {
 		return c.JSON(400, bson.M{"error": err.Error()})
 	}
 
-	batches, err := data.QueryBatches(query)
+	page, err := parsePageParams(c)
 
 	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	query.Sort = page.sort
+	query.After = page.after
+	query.Limit = page.queryLimit()
+
+	summaries, err := data.QueryBatchSummaries(query)
+
+	if err == data.ErrBadSort {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	} else if err != nil {
+		graviton.Logger.Warn("Batch query failed", zap.Error(err))
 		return c.JSON(502, bson.M{"error": "database query failed"})
 	}
-	responseBatches, err := convertDatabaseBatches(batches, true)
+
+	total, err := data.CountBatches(query)
 
 	if err != nil {
-		return c.JSON(502, bson.M{"error": "database conversion failed"})
+		graviton.Logger.Warn("Batch count failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	var next *data.Cursor
+	if page.hasMore(len(summaries)) {
+		summaries = summaries[:page.limit]
+		next = summaries[page.limit-1].Cursor(query.Sort)
+	}
+	setPageHeaders(c, total, next)
+
+	responseBatches := convertBatchSummaries(summaries)
+
+	for _, batch := range responseBatches {
+		convertLightweightBatchUnits(batch, responseUnits)
 	}
 
 	return c.JSON(200, responseBatches)
 }
 
 func GetBatch(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/batches") {
-		return nil
-	}
-
 	id := c.Param("id")
 
 	if !bson.IsObjectIdHex(id) {
 		return c.JSON(400, bson.M{"error": "bad object id"})
 	}
 
-	batch, err := data.SingleBatch(bson.M{"_id": bson.ObjectIdHex(id)})
+	responseUnits, err := responseUnits(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	batch, err := data.SingleBatch(data.BatchQuery{ID: bson.ObjectIdHex(id)})
 
 	if err != nil {
 		graviton.Logger.Error("Failed to query single batch", zap.String("id", id), zap.Error(err))
 		return c.JSON(502, bson.M{"error": "database query failed"})
 	}
-	responseBatch, err := convertDatabaseBatch(batch, false)
+	responseBatch, err := convertDatabaseBatch(batch)
 
 	if err != nil {
 		graviton.Logger.Error("Failed to convert single batch", zap.String("id", id), zap.Error(err))
 		return c.JSON(502, bson.M{"error": "database conversion failed"})
 	}
 
+	convertBatchUnits(responseBatch, responseUnits)
 	return c.JSON(200, responseBatch)
 }
 
-func NewBatch(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/batches") {
-		return nil
+// GetBatchAnalytics computes fermentation statistics for a batch.
+// The ABV formula and rate windows can be chosen with the 'abv' and
+// 'windows' query parameters, e.g. ?abv=balling&windows=12h,72h, and
+// the units with 'units'.
+func GetBatchAnalytics(c echo.Context) error {
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		return c.JSON(400, bson.M{"error": "bad object id"})
+	}
+
+	opts, err := parseAnalyticsOptions(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
 	}
 
+	responseUnits, err := responseUnits(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	batch, err := data.SingleBatch(data.BatchQuery{ID: bson.ObjectIdHex(id)})
+
+	if err != nil {
+		graviton.Logger.Error("Failed to query single batch", zap.String("id", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	summary, err := batch.Analyze(opts)
+
+	if err != nil {
+		graviton.Logger.Error("Failed to analyze batch", zap.String("id", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	responseAnalytics := convertAnalyticsSummary(summary, opts)
+	convertAnalyticsUnits(responseAnalytics, responseUnits)
+	return c.JSON(200, responseAnalytics)
+}
+
+func NewBatch(c echo.Context) error {
 	batchParam := &BatchParam{}
 	err := c.Bind(batchParam)
 	if err != nil {
@@ -79,7 +162,13 @@ func NewBatch(c echo.Context) error {
 		return c.JSON(400, bson.M{"error": "invalid input"})
 	}
 
-	batch, err := convertBatchParam(batchParam)
+	responseUnits, err := responseUnits(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	batch, err := convertBatchParam(batchParam, responseUnits)
 
 	if err != nil {
 		graviton.Logger.Error("Invalid batch object", zap.Any("Batch", batch))
@@ -87,6 +176,7 @@ func NewBatch(c echo.Context) error {
 	}
 
 	batch.ID = bson.NewObjectId()
+	batch.OwnerID = auth.RequestUserID(c)
 
 	savedBatch, err := data.AddBatch(batch)
 
@@ -95,21 +185,18 @@ func NewBatch(c echo.Context) error {
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
 
-	apiBatch, err := convertDatabaseBatch(savedBatch, false)
+	apiBatch, err := convertDatabaseBatch(savedBatch)
 
 	if err != nil {
 		graviton.Logger.Warn("Batch conversion failed", zap.Error(err))
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
 
+	convertBatchUnits(apiBatch, responseUnits)
 	return c.JSON(200, apiBatch)
 }
 
 func EditBatch(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/batches") {
-		return nil
-	}
-
 	id := c.Param("id")
 
 	if !bson.IsObjectIdHex(id) {
@@ -125,7 +212,19 @@ func EditBatch(c echo.Context) error {
 		return c.JSON(400, bson.M{"error": "invalid input"})
 	}
 
-	batch, err := data.SingleBatch(bson.M{"_id": bsonID})
+	responseUnits, err := responseUnits(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	if batchParam.AlertRules != nil {
+		if _, err := convertAlertRulesParam(batchParam.AlertRules, responseUnits); err != nil {
+			return c.JSON(400, bson.M{"error": err.Error()})
+		}
+	}
+
+	batch, err := data.SingleBatch(data.BatchQuery{ID: bsonID})
 
 	if err != nil {
 		graviton.Logger.Warn("Batch not found", zap.String("ID", bsonID.Hex()))
@@ -133,29 +232,146 @@ func EditBatch(c echo.Context) error {
 	}
 
 	// mergeBatchParam saves the batch and hydrometer
-	err = mergeBatchParam(batchParam, batch)
+	err = mergeBatchParam(batchParam, batch, responseUnits)
 
-	if err != nil {
+	if err == data.ErrConflict {
+		return c.JSON(409, bson.M{"error": err.Error()})
+	} else if err != nil {
 		graviton.Logger.Warn("Batch merge failed", zap.Error(err))
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
 
-	apiBatch, err := convertDatabaseBatch(batch, false)
+	apiBatch, err := convertDatabaseBatch(batch)
 
 	if err != nil {
 		graviton.Logger.Warn("Batch conversion failed", zap.Error(err))
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
 
+	convertBatchUnits(apiBatch, responseUnits)
 	return c.JSON(200, apiBatch)
 }
 
 func AddReading(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/reading") {
+	received := time.Now()
+	readingParam := &HydrometerReading{}
+	err := c.Bind(readingParam)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	date, err := readingDate(readingParam, readingParam.SentAt, received)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid reading date", zap.String("Hydrometer", readingParam.HydrometerName), zap.Time("Date", date))
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	reading, err := convertHydrometerReading(readingParam, date)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	hydrometer, batch := activeHydrometerBatch(c, readingParam.DeviceID, readingParam.HydrometerName)
+	if batch == nil {
 		return nil
 	}
 
-	readingParam := &HydrometerReading{}
+	return addBatchReading(c, hydrometer, batch, reading)
+}
+
+// AddReadings accepts a hydrometer's buffered readings in one request.
+// Duplicates of readings already stored are skipped, and readings with
+// bad dates are rejected individually; the response counts each.
+func AddReadings(c echo.Context) error {
+	received := time.Now()
+	readingsParam := &BulkHydrometerReadings{}
+	err := c.Bind(readingsParam)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	hydrometer, batch := activeHydrometerBatch(c, readingsParam.DeviceID, readingsParam.HydrometerName)
+	if batch == nil {
+		return nil
+	}
+
+	result := &BulkReadingResult{
+		Rejected: []RejectedReading{},
+	}
+
+	for i := range readingsParam.Readings {
+		readingParam := &readingsParam.Readings[i]
+		date, err := readingDate(readingParam, readingsParam.SentAt, received)
+
+		if err != nil {
+			result.Rejected = append(result.Rejected, RejectedReading{Index: i, Error: err.Error()})
+			continue
+		}
+
+		if readingParam.GravityUnits == "" {
+			readingParam.GravityUnits = readingsParam.GravityUnits
+		}
+		if readingParam.TemperatureUnits == "" {
+			readingParam.TemperatureUnits = readingsParam.TemperatureUnits
+		}
+
+		reading, err := convertHydrometerReading(readingParam, date)
+
+		if err == nil {
+			reading.DeviceID = hydrometer.DeviceID
+			err = hydrometer.ConvertReading(&reading)
+		}
+		if err != nil {
+			result.Rejected = append(result.Rejected, RejectedReading{Index: i, Error: err.Error()})
+			continue
+		}
+
+		err = batch.AddReading(reading)
+
+		if err == data.ErrDuplicateReading {
+			result.Duplicates++
+		} else if err != nil {
+			graviton.Logger.Warn("Error adding reading to batch", zap.Error(err))
+			result.Rejected = append(result.Rejected, RejectedReading{Index: i, Error: err.Error()})
+		} else {
+			result.Accepted++
+		}
+	}
+
+	if result.Accepted > 0 {
+		data.CheckBatchAlerts(batch, data.DefaultAlertRules(), time.Now())
+	}
+
+	return c.JSON(200, result)
+}
+
+// ISpindelBearer finds a device token in an iSpindel payload's token
+// field, since iSpindel can't set an Authorization header. The body is
+// left for AddISpindelReading to bind.
+func ISpindelBearer(c echo.Context) string {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return ""
+	}
+	c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	payload := &ISpindelReading{}
+	json.Unmarshal(body, payload)
+	return payload.Token
+}
+
+// AddISpindelReading accepts the JSON payload sent by iSpindel's
+// generic HTTP service. Route it with ISpindelBearer, so a device
+// token may be sent in the payload.
+func AddISpindelReading(c echo.Context) error {
+	readingParam := &ISpindelReading{}
 	err := c.Bind(readingParam)
 
 	if err != nil {
@@ -163,50 +379,154 @@ func AddReading(c echo.Context) error {
 		return c.JSON(400, bson.M{"error": "invalid input"})
 	}
 
-	hydrometer, err := data.SingleHydrometer(bson.M{"name": readingParam.HydrometerName})
+	// iSpindel defaults to Celsius
+	if readingParam.TemperatureUnits == "" {
+		readingParam.TemperatureUnits = string(units.Celsius)
+	}
+
+	temperatureUnits, err := units.ParseTemperature(readingParam.TemperatureUnits)
 
 	if err != nil {
-		graviton.Logger.Error("Error getting hydrometer for reading",
-			zap.String("ID", readingParam.HydrometerName),
-			zap.Error(err))
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
 		return c.JSON(400, bson.M{"error": err.Error()})
 	}
 
-	batch, err := data.SingleBatch(bson.M{
-		"_id":      hydrometer.CurrentBatchID,
-		"active":   true,
-		"archived": false,
-	})
+	deviceID := ""
+	if readingParam.DeviceID != 0 {
+		deviceID = strconv.Itoa(readingParam.DeviceID)
+	}
 
-	if err != nil {
-		graviton.Logger.Warn("Hydrometer reading received for finished batch",
-			zap.String("BatchID", hydrometer.CurrentBatchID.Hex()),
-			zap.Error(err))
-		return c.JSON(400, bson.M{"error": "reading received for missing or completed batch"})
+	hydrometer, batch := activeHydrometerBatch(c, deviceID, readingParam.Name)
+	if batch == nil {
+		return nil
 	}
 
 	reading := data.GravityReading{
 		Gravity:        readingParam.Gravity,
-		Temperature:    readingParam.Temperature,
+		Temperature:    units.ToFahrenheit(readingParam.Temperature, temperatureUnits),
 		BatteryVoltage: readingParam.Battery,
+		Angle:          readingParam.Angle,
+		RSSI:           readingParam.RSSI,
 		Date:           time.Now(),
 		Hidden:         false,
 		ID:             bson.NewObjectId(),
+		Raw: &data.RawReading{
+			Gravity:          readingParam.Gravity,
+			Temperature:      readingParam.Temperature,
+			TemperatureUnits: string(temperatureUnits),
+			Angle:            readingParam.Angle,
+		},
 	}
-	err = batch.AddReading(reading)
+
+	return addBatchReading(c, hydrometer, batch, reading)
+}
+
+// activeHydrometerBatch finds the reporting hydrometer and the batch
+// it is currently assigned to. If there isn't one, or the request's
+// device token belongs to another hydrometer, it makes an appropriate
+// response with the context and returns a nil batch.
+func activeHydrometerBatch(c echo.Context, deviceID string, hydrometerName string) (*data.Hydrometer, *data.Batch) {
+	hydrometer, registered, err := findReportingHydrometer(deviceID, hydrometerName)
+
+	if err != nil {
+		graviton.Logger.Error("Error getting hydrometer for reading",
+			zap.String("DeviceID", deviceID),
+			zap.String("Name", hydrometerName),
+			zap.Error(err))
+		c.JSON(400, bson.M{"error": err.Error()})
+		return nil, nil
+	}
+
+	if registered {
+		graviton.Logger.Info("Registered new hydrometer", zap.String("DeviceID", deviceID), zap.String("Name", hydrometer.Name))
+		c.JSON(202, bson.M{"status": "registered", "hydrometer": hydrometer.ID})
+		return nil, nil
+	}
+
+	if !auth.CanPostReadings(c, hydrometer.ID) {
+		return nil, nil
+	}
+
+	batch, err := data.SingleBatch(data.BatchQuery{
+		ID:       hydrometer.CurrentBatchID,
+		Active:   data.Bool(true),
+		Archived: data.Bool(false),
+	})
+
+	if err != nil {
+		graviton.Logger.Warn("Hydrometer reading received for finished batch",
+			zap.String("BatchID", hydrometer.CurrentBatchID.Hex()),
+			zap.Error(err))
+		c.JSON(400, bson.M{"error": "reading received for missing or completed batch"})
+		return nil, nil
+	}
+
+	return hydrometer, batch
+}
+
+// findReportingHydrometer finds a hydrometer by device ID, falling
+// back to its name for devices that don't send one. A hydrometer found
+// by name with no device ID yet is claimed by the reporting device. If
+// nothing matches and auto-registration is on, a new hydrometer is
+// registered, and the second return value is true.
+func findReportingHydrometer(deviceID string, name string) (*data.Hydrometer, bool, error) {
+	if deviceID != "" {
+		hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{DeviceID: deviceID})
+		if err != data.ErrNotFound {
+			return hydrometer, false, err
+		}
+	}
+
+	hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{Name: name})
+
+	if err == data.ErrNotFound && deviceID != "" && config.GetConfig().AutoRegisterHydrometers {
+		hydrometer, err = data.RegisterHydrometer(deviceID, name)
+		return hydrometer, err == nil, err
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if deviceID != "" {
+		if hydrometer.DeviceID != "" {
+			return nil, false, errors.New("hydrometer belongs to another device")
+		}
+
+		hydrometer.DeviceID = deviceID
+		err = hydrometer.Save()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return hydrometer, false, nil
+}
+
+// addBatchReading converts a single reading with the hydrometer's
+// calibration, adds it to a batch, and responds to the hydrometer.
+func addBatchReading(c echo.Context, hydrometer *data.Hydrometer, batch *data.Batch, reading data.GravityReading) error {
+	reading.DeviceID = hydrometer.DeviceID
+	err := hydrometer.ConvertReading(&reading)
 
 	if err != nil {
+		graviton.Logger.Warn("Unable to convert reading", zap.String("Hydrometer", hydrometer.Name), zap.Error(err))
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	err = batch.AddReading(reading)
+
+	if err == data.ErrDuplicateReading {
+		return c.JSON(200, bson.M{"status": "duplicate"})
+	} else if err != nil {
 		graviton.Logger.Warn("Error adding reading to batch", zap.Error(err))
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
+
+	// Failing alert checks shouldn't cost a device its reading
+	data.CheckBatchAlerts(batch, data.DefaultAlertRules(), time.Now())
 	return c.JSON(200, bson.M{"status": "ok"})
 }
 
 func FinishBatch(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/batches") {
-		return nil
-	}
-
 	id := c.Param("id")
 
 	if !bson.IsObjectIdHex(id) {
@@ -214,9 +534,9 @@ func FinishBatch(c echo.Context) error {
 		return c.JSON(400, bson.M{"error": "invalid input"})
 	}
 
-	batch, err := data.SingleBatch(bson.M{
-		"_id":    bson.ObjectIdHex(id),
-		"active": true,
+	batch, err := data.SingleBatch(data.BatchQuery{
+		ID:     bson.ObjectIdHex(id),
+		Active: data.Bool(true),
 	})
 
 	if err != nil {
@@ -228,7 +548,9 @@ func FinishBatch(c echo.Context) error {
 
 	err = batch.FinishBatch()
 
-	if err != nil {
+	if err == data.ErrConflict {
+		return c.JSON(409, bson.M{"error": err.Error()})
+	} else if err != nil {
 		graviton.Logger.Warn("Error finishing batch",
 			zap.Error(err))
 		return c.JSON(502, bson.M{"error": "unable to finish batch"})
@@ -238,10 +560,6 @@ func FinishBatch(c echo.Context) error {
 }
 
 func ArchiveBatch(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/batches") {
-		return nil
-	}
-
 	id := c.Param("id")
 
 	if !bson.IsObjectIdHex(id) {
@@ -249,9 +567,9 @@ func ArchiveBatch(c echo.Context) error {
 		return c.JSON(400, bson.M{"error": "invalid input"})
 	}
 
-	batch, err := data.SingleBatch(bson.M{
-		"_id":      bson.ObjectIdHex(id),
-		"archived": false,
+	batch, err := data.SingleBatch(data.BatchQuery{
+		ID:       bson.ObjectIdHex(id),
+		Archived: data.Bool(false),
 	})
 
 	if err != nil {
@@ -263,7 +581,9 @@ func ArchiveBatch(c echo.Context) error {
 
 	err = batch.ArchiveBatch()
 
-	if err != nil {
+	if err == data.ErrConflict {
+		return c.JSON(409, bson.M{"error": err.Error()})
+	} else if err != nil {
 		graviton.Logger.Warn("Error archiving batch",
 			zap.Error(err))
 		return c.JSON(502, bson.M{"error": "unable to finish batch"})
@@ -272,47 +592,76 @@ func ArchiveBatch(c echo.Context) error {
 	return c.JSON(200, batch)
 }
 
-func parseBatchQuery(c echo.Context, query bson.M) error {
+func parseBatchQuery(c echo.Context, query *data.BatchQuery) error {
 	if bson.IsObjectIdHex(c.QueryParam("id")) {
-		query["_id"] = c.QueryParam("id")
+		query.ID = bson.ObjectIdHex(c.QueryParam("id"))
 	}
 
 	if c.QueryParam("recipe") != "" {
-		query["recipe"] = c.QueryParam("recipe")
+		query.RecipeName = c.QueryParam("recipe")
 	}
 
 	if c.QueryParam("stringId") != "" {
-		query["stringId"] = c.QueryParam("stringId")
+		query.UniqueID = c.QueryParam("stringId")
 	}
 
 	if c.QueryParam("hydrometerId") != "" {
-		query["hydrometer"] = c.QueryParam("hydrometerId")
+		if !bson.IsObjectIdHex(c.QueryParam("hydrometerId")) {
+			return errors.New("bad hydrometer id")
+		}
+		query.HydrometerID = bson.ObjectIdHex(c.QueryParam("hydrometerId"))
 	}
 
-	// TODO: implement later
-	// if time, err := time.Parse(time.RFC3339, c.QueryParam("after"); err != nil {
-	// query["startdate"] = bson.M{"$gt": ...}
-	// }
-	// TODO: implement later
-	// if time, err := time.Parse(time.RFC3339, c.QueryParam("before"); err != nil {
-	//
-	// }
+	dateParams := map[string]*time.Time{
+		"after":         &query.StartedAfter,
+		"before":        &query.StartedBefore,
+		"updatedAfter":  &query.UpdatedAfter,
+		"updatedBefore": &query.UpdatedBefore,
+	}
+	for name, bound := range dateParams {
+		if c.QueryParam(name) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, c.QueryParam(name))
+		if err != nil {
+			return errors.New("bad time for " + name)
+		}
+		*bound = t
+	}
 
 	if c.QueryParam("archived") != "" {
-		if c.QueryParam("archived") == "true" {
-			query["archived"] = true
-		} else {
-			query["archived"] = false
-		}
+		query.Archived = data.Bool(c.QueryParam("archived") == "true")
 	}
 
 	if c.QueryParam("active") != "" {
-		if c.QueryParam("active") == "true" {
-			query["active"] = true
-		} else {
-			query["active"] = false
-		}
+		query.Active = data.Bool(c.QueryParam("active") == "true")
 	}
 
 	return nil
 }
+
+func parseAnalyticsOptions(c echo.Context) (analytics.Options, error) {
+	opts := analytics.DefaultOptions()
+
+	if c.QueryParam("abv") != "" {
+		formula, err := analytics.ParseABVFormula(c.QueryParam("abv"))
+		if err != nil {
+			return opts, err
+		}
+		opts.ABVFormula = formula
+	}
+
+	if c.QueryParam("windows") != "" {
+		opts.RateWindows = []time.Duration{}
+
+		for _, windowParam := range strings.Split(c.QueryParam("windows"), ",") {
+			window, err := time.ParseDuration(windowParam)
+			if err != nil || window <= 0 {
+				return opts, errors.New("bad rate window " + windowParam)
+			}
+			opts.RateWindows = append(opts.RateWindows, window)
+		}
+	}
+
+	return opts, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -13,6 +14,7 @@ import (
 	"github.com/jslater89/graviton/auth"
 	"github.com/jslater89/graviton/config"
 	"github.com/jslater89/graviton/data"
+	"github.com/jslater89/graviton/units"
 	"github.com/labstack/echo"
 	"github.com/markbates/goth"
 	"gopkg.in/mgo.v2/bson"
@@ -21,7 +23,7 @@ import (
 func TestBatchAPI(t *testing.T) {
 	graviton.InitTest()
 	auth.InitOauth(config.GetConfig().MongoAddress, config.GetConfig().GetDBName())
-	data.GenerateDemoData()
+	data.GenerateTestData()
 
 	sessionID := generateTestSession()
 
@@ -38,7 +40,7 @@ func TestBatchAPI(t *testing.T) {
 		t.Errorf("Request failed with code %d %v\n", rec.Code, err)
 	}
 
-	batches := []Batch{}
+	batches := []LightweightBatch{}
 	err = json.NewDecoder(rec.Body).Decode(&batches)
 
 	if err != nil {
@@ -49,8 +51,61 @@ func TestBatchAPI(t *testing.T) {
 		t.Errorf("Batch response incorrect %v\n", batches)
 	}
 
+	// The median of the first readings, as in the batch's analytics
+	if batches[0].HydrometerName != "Green Hydrometer" || batches[0].ReadingCount != 4 || math.Abs(batches[0].OriginalGravity-1.076) > 0.00001 {
+		t.Errorf("Batch summary incorrect %v\n", batches[0])
+	}
+
 	flueSeason := batches[0]
 
+	// ---------------- 1b. Test paging batches
+	pageRecipes := []string{}
+	cursor := ""
+	for pages := 0; pages < 3; pages++ {
+		e = echo.New()
+		req = httptest.NewRequest(echo.GET, "/api/v1/batches?sort=-recipe&limit=1&cursor="+cursor, nil)
+		req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+		rec = httptest.NewRecorder()
+		c = e.NewContext(req, rec)
+
+		err = QueryBatches(c)
+
+		if err != nil || rec.Code != 200 {
+			t.Fatalf("Page request failed with code %d %v\n", rec.Code, err)
+		}
+
+		if rec.Header().Get("X-Total-Count") != "2" {
+			t.Errorf("Expected a total count of 2, got %s\n", rec.Header().Get("X-Total-Count"))
+		}
+
+		page := []LightweightBatch{}
+		json.NewDecoder(rec.Body).Decode(&page)
+		for _, b := range page {
+			pageRecipes = append(pageRecipes, b.RecipeName)
+		}
+
+		cursor = rec.Header().Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+	}
+
+	if strings.Join(pageRecipes, ",") != "Hop Forward,Flue Season" {
+		t.Errorf("Paged batches incorrect %v\n", pageRecipes)
+	}
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.GET, "/api/v1/batches?sort=hydrometer", nil)
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+
+	QueryBatches(c)
+
+	if rec.Code != 400 {
+		t.Errorf("Expected 400 for a bad sort field, got %d\n", rec.Code)
+	}
+
 	// ---------------- 2. Test GET batch by ID
 	e = echo.New()
 	req = httptest.NewRequest(echo.GET, "/api/v1/batches/:id", nil)
@@ -77,11 +132,97 @@ func TestBatchAPI(t *testing.T) {
 		t.Errorf("Mismatch result from individual get")
 	}
 
+	// ---------------- 2b. Test GET batch readings, paged and downsampled
+	getReadings := func(query string) *ReadingSeries {
+		e := echo.New()
+		req := httptest.NewRequest(echo.GET, "/api/v1/batches/:id/readings?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(flueSeason.ID.Hex())
+
+		err := GetBatchReadings(c)
+
+		if err != nil || rec.Code != 200 {
+			t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, rec.Body.String())
+		}
+
+		series := &ReadingSeries{}
+		json.NewDecoder(rec.Body).Decode(series)
+		return series
+	}
+
+	// Flue Season has four readings, half an hour apart
+	series := getReadings("limit=3")
+
+	if len(series.Readings) != 3 || series.NextCursor == "" {
+		t.Errorf("First page wrong: %v\n", series)
+	}
+
+	series = getReadings("limit=3&cursor=" + series.NextCursor)
+
+	if len(series.Readings) != 1 || series.NextCursor != "" {
+		t.Errorf("Last page wrong: %v\n", series)
+	}
+
+	series = getReadings("resolution=1h")
+	bucketed := 0
+	for _, bucket := range series.Buckets {
+		bucketed += bucket.Count
+	}
+
+	if series.Resolution != "1h0m0s" || bucketed != 4 || len(series.Buckets) < 2 {
+		t.Errorf("Bucketed series wrong: %v\n", series)
+	}
+
+	series = getReadings("resolution=3")
+
+	if len(series.Readings) != 3 {
+		t.Errorf("Downsampled series wrong: %v\n", series)
+	}
+
+	// With fewer readings allowed than the batch has, bucketed pages end
+	// early and downsampling is refused
+	seriesReadingsAllowed := maxSeriesReadings
+	maxSeriesReadings = 3
+
+	series = getReadings("resolution=30m")
+	bucketed = 0
+	for series.NextCursor != "" {
+		for _, bucket := range series.Buckets {
+			bucketed += bucket.Count
+		}
+		series = getReadings("resolution=30m&cursor=" + series.NextCursor)
+	}
+	for _, bucket := range series.Buckets {
+		bucketed += bucket.Count
+	}
+
+	if bucketed != 4 {
+		t.Errorf("Capped bucket pages wrong: %d readings\n", bucketed)
+	}
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.GET, "/api/v1/batches/:id/readings?resolution=3", nil)
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(flueSeason.ID.Hex())
+
+	err = GetBatchReadings(c)
+
+	if err != nil || rec.Code != 400 {
+		t.Errorf("Oversized downsampling not refused: %d %v\n", rec.Code, err)
+	}
+
+	maxSeriesReadings = seriesReadingsAllowed
+
 	// ---------------- 3. Test PUT existing batch, including setting hydrometer to nil
-	greenHydrometerID := bson.ObjectIdHex(flueSeason.Hydrometer.ID.Hex())
-	flueSeason.Hydrometer.ID = ""
+	greenHydrometerID := bson.ObjectIdHex(receivedBatch.Hydrometer.ID.Hex())
+	receivedBatch.Hydrometer.ID = ""
 
-	body, _ := json.Marshal(flueSeason)
+	body, _ := json.Marshal(receivedBatch)
 
 	e = echo.New()
 	req = httptest.NewRequest(echo.PUT, "/api/v1/batches/:id", bytes.NewBuffer(body))
@@ -210,12 +351,264 @@ func TestBatchAPI(t *testing.T) {
 		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, string(bodyBytes))
 	}
 
-	dataBatch, _ := data.SingleBatch(bson.M{"_id": tisTheSaison.ID})
+	dataBatch, _ := data.SingleBatch(data.BatchQuery{ID: tisTheSaison.ID})
 
-	if len(dataBatch.GravityReadings) != 1 {
+	if readings, _ := dataBatch.Readings(); len(readings) != 1 || dataBatch.ReadingCount != 1 {
 		t.Errorf("Incorrect number of readings")
 	}
 
+	// ---------------- 6b. Test add iSpindel reading, converting from Celsius
+	iSpindelParam := ISpindelReading{
+		Name:             "Green Hydrometer",
+		DeviceID:         6022389,
+		Angle:            61.5,
+		Temperature:      20.0,
+		TemperatureUnits: "C",
+		Battery:          4.1,
+		Gravity:          1.072,
+		Interval:         900,
+		RSSI:             -71,
+	}
+
+	iSpindelBody, _ := json.Marshal(iSpindelParam)
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.POST, "/api/v1/reading/ispindel", bytes.NewBuffer(iSpindelBody))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+
+	err = AddISpindelReading(c)
+
+	if err != nil || rec.Code != 200 {
+		bodyBytes := rec.Body.Bytes()
+		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, string(bodyBytes))
+	}
+
+	dataBatch, _ = data.SingleBatch(data.BatchQuery{ID: tisTheSaison.ID})
+
+	if dataBatch.LatestReading.Temperature != 68.0 || dataBatch.LatestReading.Angle != 61.5 || dataBatch.LatestReading.RSSI != -71 {
+		t.Errorf("iSpindel reading stored incorrectly: %v", dataBatch.LatestReading)
+	}
+
+	// ---------------- 6c. Test bulk readings: backfill with skewed clock, a duplicate, and a future date
+	deviceNow := time.Now().Add(-10 * time.Minute)
+	firstTimestamp := deviceNow.Add(-8 * time.Hour)
+	secondTimestamp := deviceNow.Add(-7 * time.Hour)
+	futureTimestamp := deviceNow.Add(24 * time.Hour)
+
+	bulkParam := BulkHydrometerReadings{
+		HydrometerName: "Green Hydrometer",
+		SentAt:         &deviceNow,
+		Readings: []HydrometerReading{
+			{Gravity: 1.080, Temperature: 67.0, Battery: 3.7, Timestamp: &firstTimestamp},
+			{Gravity: 1.079, Temperature: 67.2, Battery: 3.7, Timestamp: &secondTimestamp},
+			{Gravity: 1.079, Temperature: 67.2, Battery: 3.7, Timestamp: &secondTimestamp},
+			{Gravity: 1.050, Temperature: 67.2, Battery: 3.7, Timestamp: &futureTimestamp},
+		},
+	}
+
+	bulkBody, _ := json.Marshal(bulkParam)
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.POST, "/api/v1/readings", bytes.NewBuffer(bulkBody))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+
+	err = AddReadings(c)
+
+	if err != nil || rec.Code != 200 {
+		bodyBytes := rec.Body.Bytes()
+		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, string(bodyBytes))
+	}
+
+	bulkResult := &BulkReadingResult{}
+	json.NewDecoder(rec.Body).Decode(bulkResult)
+
+	if bulkResult.Accepted != 2 || bulkResult.Duplicates != 1 || len(bulkResult.Rejected) != 1 || bulkResult.Rejected[0].Index != 3 {
+		t.Errorf("Bulk readings handled incorrectly: %v", bulkResult)
+	}
+
+	dataBatch, _ = data.SingleBatch(data.BatchQuery{ID: tisTheSaison.ID})
+
+	// The device clock was ten minutes slow
+	skew := dataBatch.FirstReading.Date.Sub(firstTimestamp)
+	if dataBatch.FirstReading.Gravity != 1.080 || skew < 9*time.Minute || skew > 11*time.Minute {
+		t.Errorf("Backfilled reading not corrected for clock skew: %v", dataBatch.FirstReading)
+	}
+
+	// ---------------- 6d. Test matching by device ID, surviving a rename, and auto-registration
+	postDeviceReading := func(deviceID string, name string) *httptest.ResponseRecorder {
+		readingParam := HydrometerReading{
+			Battery:        3.6,
+			Gravity:        1.070,
+			Temperature:    68.2,
+			HydrometerName: name,
+			DeviceID:       deviceID,
+		}
+		body, _ := json.Marshal(readingParam)
+
+		e := echo.New()
+		req := httptest.NewRequest(echo.POST, "/api/v1/reading", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		AddReading(e.NewContext(req, rec))
+		return rec
+	}
+
+	// The iSpindel reading above claimed the green hydrometer
+	greenHydrometer, _ := data.SingleHydrometer(data.HydrometerQuery{ID: greenHydrometerID})
+
+	if greenHydrometer.DeviceID != "6022389" {
+		t.Errorf("Device ID not claimed by hydrometer: %v", greenHydrometer)
+	}
+
+	rec = postDeviceReading("a4cf12", "Green Hydrometer")
+
+	if rec.Code != 400 {
+		t.Errorf("Second device matched claimed hydrometer by name: %d\n", rec.Code)
+	}
+
+	greenHydrometer.Name = "Renamed Hydrometer"
+	greenHydrometer.Save()
+
+	rec = postDeviceReading("6022389", "Green Hydrometer")
+
+	if rec.Code != 200 {
+		t.Errorf("Renamed hydrometer not matched by device ID: %d %s\n", rec.Code, rec.Body.String())
+	}
+
+	rec = postDeviceReading("ffee01", "Mystery Hydrometer")
+
+	if rec.Code != 400 {
+		t.Errorf("Unknown device accepted without auto-registration: %d\n", rec.Code)
+	}
+
+	config.OverrideAutoRegister(true)
+	rec = postDeviceReading("ffee01", "Mystery Hydrometer")
+	config.OverrideAutoRegister(false)
+
+	registered, err := data.SingleHydrometer(data.HydrometerQuery{DeviceID: "ffee01"})
+
+	if rec.Code != 202 || err != nil || registered.Name != "Mystery Hydrometer" || registered.CurrentBatchID != graviton.EmptyID() {
+		t.Errorf("Unknown device not registered: %d %v\n", rec.Code, registered)
+	}
+
+	// ---------------- 6e. Test declared reading units and metric responses
+	metricParam := HydrometerReading{
+		DeviceID:         "6022389",
+		Gravity:          12.0,
+		GravityUnits:     "plato",
+		Temperature:      20.0,
+		TemperatureUnits: "C",
+		Battery:          3.6,
+	}
+	metricBody, _ := json.Marshal(metricParam)
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.POST, "/api/v1/reading", bytes.NewBuffer(metricBody))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+
+	err = AddReading(e.NewContext(req, rec))
+
+	if err != nil || rec.Code != 200 {
+		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, rec.Body.String())
+	}
+
+	dataBatch, _ = data.SingleBatch(data.BatchQuery{ID: tisTheSaison.ID})
+
+	if math.Abs(dataBatch.LatestReading.Gravity-units.ToSG(12.0, units.Plato)) > 0.00001 || math.Abs(dataBatch.LatestReading.Temperature-68.0) > 0.00001 {
+		t.Errorf("Metric reading not stored in canonical units: %v", dataBatch.LatestReading)
+	}
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.GET, "/api/v1/batches/:id?units=metric", nil)
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(tisTheSaison.ID.Hex())
+
+	err = GetBatch(c)
+
+	if err != nil || rec.Code != 200 {
+		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, rec.Body.String())
+	}
+
+	metricBatch := &Batch{}
+	json.NewDecoder(rec.Body).Decode(metricBatch)
+
+	if metricBatch.Units.Gravity != units.Plato || math.Abs(metricBatch.LatestReading.Gravity-12.0) > 0.00001 || math.Abs(metricBatch.LatestReading.Temperature-20.0) > 0.00001 {
+		t.Errorf("Batch not converted to metric: %v %v", metricBatch.Units, metricBatch.LatestReading)
+	}
+
+	// ---------------- 6f. Test alerts raised by a reading, acknowledged and resolved
+	dataBatch, _ = data.SingleBatch(data.BatchQuery{ID: tisTheSaison.ID})
+	dataBatch.AlertRules = data.AlertRules{MaxTemperature: 60}
+	dataBatch.Save()
+
+	body, _ = json.Marshal(HydrometerReading{Gravity: 1.068, Temperature: 72, DeviceID: "6022389"})
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.POST, "/api/v1/reading", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+
+	err = AddReading(c)
+
+	if err != nil || rec.Code != 200 {
+		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, rec.Body.String())
+	}
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.GET, "/api/v1/alerts?kind=temperature&batch="+tisTheSaison.ID.Hex(), nil)
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+
+	err = QueryAlerts(c)
+
+	alerts := []data.Alert{}
+	json.NewDecoder(rec.Body).Decode(&alerts)
+
+	if err != nil || rec.Code != 200 || len(alerts) != 1 || alerts[0].State != data.AlertOpen {
+		t.Fatalf("Expected an open temperature alert, got %d %v %v\n", rec.Code, err, alerts)
+	}
+
+	changeAlert := func(handler echo.HandlerFunc, path string) *data.Alert {
+		e := echo.New()
+		req := httptest.NewRequest(echo.POST, "/api/v1/alerts/:id/"+path, nil)
+		req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+		rec = httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(alerts[0].ID.Hex())
+
+		handler(c)
+
+		changed := &data.Alert{}
+		json.NewDecoder(rec.Body).Decode(changed)
+		return changed
+	}
+
+	if alert := changeAlert(AcknowledgeAlert, "acknowledge"); alert.State != data.AlertAcknowledged {
+		t.Errorf("Alert not acknowledged %v\n", alert)
+	}
+	if alert := changeAlert(ResolveAlert, "resolve"); alert.State != data.AlertResolved {
+		t.Errorf("Alert not resolved %v\n", alert)
+	}
+	if changeAlert(ResolveAlert, "resolve"); rec.Code != 409 {
+		t.Errorf("Expected 409 resolving a resolved alert, got %d\n", rec.Code)
+	}
+
 	// ---------------- 7. Test finish batch
 	e = echo.New()
 	req = httptest.NewRequest(echo.POST, "/api/v1/batches/:id/finish", bytes.NewBuffer(body))
@@ -233,7 +626,7 @@ func TestBatchAPI(t *testing.T) {
 		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, string(bodyBytes))
 	}
 
-	dataBatch, _ = data.SingleBatch(bson.M{"_id": tisTheSaison.ID})
+	dataBatch, _ = data.SingleBatch(data.BatchQuery{ID: tisTheSaison.ID})
 
 	if dataBatch.Active {
 		t.Errorf("Batch still active")
@@ -256,12 +649,72 @@ func TestBatchAPI(t *testing.T) {
 		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, string(bodyBytes))
 	}
 
-	dataBatch, _ = data.SingleBatch(bson.M{"_id": tisTheSaison.ID})
+	dataBatch, _ = data.SingleBatch(data.BatchQuery{ID: tisTheSaison.ID})
 
 	if !dataBatch.Archived {
 		t.Errorf("Batch not archived")
 	}
 
+	// ---------------- 9. Test finishing and archiving by editing, with
+	// alert rules in metric units
+	dataBatch, _ = data.AddBatch(&data.Batch{RecipeName: "Second Runnings", UniqueID: "20171101-secondrunnings"})
+	dataBatch.Start(&data.Hydrometer{ID: graviton.EmptyID()})
+
+	subscription := data.Subscribe(func(e data.Event) bool { return e.BatchID == dataBatch.ID })
+	defer subscription.Close()
+
+	body, _ = json.Marshal(BatchParam{
+		ID:         dataBatch.ID,
+		RecipeName: dataBatch.RecipeName,
+		UniqueID:   dataBatch.UniqueID,
+		StartDate:  dataBatch.StartDate,
+		Active:     false,
+		Archived:   true,
+		AlertRules: &AlertRules{MaxTemperature: 20, StallThreshold: 0.5},
+		Version:    dataBatch.Version,
+	})
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.PUT, "/api/v1/batches/:id?units=metric", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(dataBatch.ID.Hex())
+
+	err = EditBatch(c)
+
+	if err != nil || rec.Code != 200 {
+		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, rec.Body.String())
+	}
+
+	receivedBatch = &Batch{}
+	json.NewDecoder(rec.Body).Decode(receivedBatch)
+	rules := receivedBatch.AlertRules
+
+	if math.Abs(rules.MaxTemperature-20) > 0.00001 || math.Abs(rules.StallThreshold-0.5) > 0.00001 {
+		t.Errorf("Alert rules not converted to metric: %v\n", rules)
+	}
+
+	dataBatch, _ = data.SingleBatch(data.BatchQuery{ID: dataBatch.ID})
+	if math.Abs(dataBatch.AlertRules.MaxTemperature-68) > 0.00001 || math.Abs(dataBatch.AlertRules.StallThreshold-0.002) > 0.0002 {
+		t.Errorf("Alert rules not stored in °F and SG: %v\n", dataBatch.AlertRules)
+	}
+
+	received := []string{}
+	for len(received) < 2 {
+		select {
+		case event := <-subscription.Events:
+			received = append(received, event.Type)
+		case <-time.After(time.Second):
+			t.Fatalf("Edit events missing; got %v\n", received)
+		}
+	}
+	if strings.Join(received, ",") != "batch.finished,batch.archived" {
+		t.Errorf("Wrong edit events: %v\n", received)
+	}
+
 	data.CleanupTestData()
 }
 
@@ -1,12 +1,14 @@
 package api
 
 import (
+	"errors"
 	"time"
 
-	"gopkg.in/mgo.v2"
-
 	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/analytics"
+	"github.com/jslater89/graviton/config"
 	"github.com/jslater89/graviton/data"
+	"github.com/jslater89/graviton/units"
 	"github.com/labstack/echo"
 	"go.uber.org/zap"
 	"gopkg.in/mgo.v2/bson"
@@ -19,15 +21,83 @@ type Batch struct {
 	Hydrometer      Hydrometer             `json:"hydrometer"`
 	GravityReadings *[]data.GravityReading `json:"readings"`
 	LatestReading   data.GravityReading    `json:"latestReading"`
+	OriginalGravity float64                `json:"originalGravity"`
 	Attenuation     float64                `json:"attenuation"`
+	RealAttenuation float64                `json:"realAttenuation"`
 	ABV             float64                `json:"abv"`
+	Units           units.System           `json:"units"`
 	StartDate       time.Time              `json:"startDate"`
 	LastUpdate      time.Time              `json:"lastUpdate"`
 	Active          bool                   `json:"active"`
 	Archived        bool                   `json:"archived"`
+	Stable          bool                   `json:"stable"`
+	FinalGravity    float64                `json:"finalGravity,omitempty"`
+	StableAt        *time.Time             `json:"stableAt,omitempty"`
+	AlertRules      AlertRules             `json:"alertRules"`
+	Owner           bson.ObjectId          `json:"owner,omitempty"`
+	Version         int                    `json:"version"`
 }
 
+// LightweightBatch is a batch as listed by QueryBatches: no readings,
+// and statistics estimated from the first and latest readings only.
 type LightweightBatch struct {
+	ID              bson.ObjectId       `json:"id"`
+	RecipeName      string              `json:"recipe"`
+	UniqueID        string              `json:"stringId"`
+	HydrometerID    bson.ObjectId       `json:"hydrometer"`
+	HydrometerName  string              `json:"hydrometerName"`
+	ReadingCount    int                 `json:"readingCount"`
+	LatestReading   data.GravityReading `json:"latestReading"`
+	OriginalGravity float64             `json:"originalGravity"`
+	Attenuation     float64             `json:"attenuation"`
+	ABV             float64             `json:"abv"`
+	Units           units.System        `json:"units"`
+	StartDate       time.Time           `json:"startDate"`
+	LastUpdate      time.Time           `json:"lastUpdate"`
+	Active          bool                `json:"active"`
+	Archived        bool                `json:"archived"`
+	Stable          bool                `json:"stable"`
+	FinalGravity    float64             `json:"finalGravity,omitempty"`
+	Version         int                 `json:"version"`
+}
+
+type BatchAnalytics struct {
+	OriginalGravity     float64       `json:"originalGravity"`
+	CurrentGravity      float64       `json:"currentGravity"`
+	ApparentAttenuation float64       `json:"apparentAttenuation"`
+	RealAttenuation     float64       `json:"realAttenuation"`
+	ABV                 float64       `json:"abv"`
+	ABVFormula          string        `json:"abvFormula"`
+	Rates               []GravityRate `json:"rates"`
+	Units               units.System  `json:"units"`
+}
+
+type GravityRate struct {
+	Window        string  `json:"window"`
+	GravityPerDay float64 `json:"gravityPerDay"`
+}
+
+// ReadingSeries is a page of a batch's readings. Depending on the
+// resolution, it holds readings or buckets; the other is null.
+type ReadingSeries struct {
+	Resolution string                `json:"resolution"`
+	Readings   []data.GravityReading `json:"readings"`
+	Buckets    []ReadingBucket       `json:"buckets"`
+	NextCursor string                `json:"nextCursor,omitempty"` // empty on the last page
+	Units      units.System          `json:"units"`
+}
+
+// ReadingBucket summarizes the readings in an interval. Its fields
+// match analytics.Bucket.
+type ReadingBucket struct {
+	Start           time.Time `json:"start"`
+	Count           int       `json:"count"`
+	MinGravity      float64   `json:"minGravity"`
+	MaxGravity      float64   `json:"maxGravity"`
+	MeanGravity     float64   `json:"meanGravity"`
+	MinTemperature  float64   `json:"minTemperature"`
+	MaxTemperature  float64   `json:"maxTemperature"`
+	MeanTemperature float64   `json:"meanTemperature"`
 }
 
 type BatchParam struct {
@@ -38,62 +108,92 @@ type BatchParam struct {
 	StartDate  time.Time     `json:"startDate"`
 	Active     bool          `json:"active"`
 	Archived   bool          `json:"archived"`
+
+	// AlertRules, if set, replaces the batch's alert rules. It's in
+	// the request's units; see responseUnits.
+	AlertRules *AlertRules `json:"alertRules,omitempty"`
+
+	// Version, if set, must match the stored batch's version
+	// for an edit to succeed.
+	Version int `json:"version"`
 }
 
-func convertDatabaseBatches(b []*data.Batch, lightweight bool) ([]*Batch, error) {
-	batches := []*Batch{}
+func convertBatchSummaries(summaries []*data.BatchSummary) []*LightweightBatch {
+	batches := []*LightweightBatch{}
+
+	for _, s := range summaries {
+		converted := &LightweightBatch{
+			ID:             s.ID,
+			RecipeName:     s.RecipeName,
+			UniqueID:       s.UniqueID,
+			HydrometerID:   s.HydrometerID,
+			HydrometerName: s.HydrometerName,
+			ReadingCount:   s.ReadingCount,
+			StartDate:      s.StartDate,
+			LastUpdate:     s.LastUpdate,
+			Active:         s.Active,
+			Archived:       s.Archived,
+			Stable:         s.Stable,
+			FinalGravity:   s.FinalGravity,
+			Version:        s.Version,
+		}
+
+		if s.ReadingCount > 0 {
+			converted.LatestReading = s.LatestReading
 
-	for _, batch := range b {
-		converted, err := convertDatabaseBatch(batch, lightweight)
-		if err != nil {
-			graviton.Logger.Warn("Batch not fully converted", zap.Error(err), zap.Any("Batch", batch))
+			// The stored estimates, to agree with convertDatabaseBatch
+			converted.OriginalGravity = s.OriginalGravity
+			converted.Attenuation = analytics.ApparentAttenuation(s.OriginalGravity, s.CurrentGravity)
+			converted.ABV = analytics.ABV(s.OriginalGravity, s.CurrentGravity, analytics.DefaultOptions().ABVFormula)
 		}
+
 		batches = append(batches, converted)
 	}
 
-	return batches, nil
+	return batches
 }
 
-func convertDatabaseBatch(b *data.Batch, lightweight bool) (*Batch, error) {
+func convertDatabaseBatch(b *data.Batch) (*Batch, error) {
 	converted := &Batch{
-		ID:         b.ID,
-		RecipeName: b.RecipeName,
-		UniqueID:   b.UniqueID,
-		StartDate:  b.StartDate,
-		LastUpdate: b.LastUpdate,
-		Active:     b.Active,
-		Archived:   b.Archived,
-	}
-
-	if len(b.GravityReadings) > 0 {
-		converted.LatestReading = b.GravityReadings[len(b.GravityReadings)-1]
-
-		if !lightweight {
-			converted.GravityReadings = &b.GravityReadings
-		} else {
-			converted.GravityReadings = &[]data.GravityReading{}
-		}
+		ID:           b.ID,
+		RecipeName:   b.RecipeName,
+		UniqueID:     b.UniqueID,
+		StartDate:    b.StartDate,
+		LastUpdate:   b.LastUpdate,
+		Active:       b.Active,
+		Archived:     b.Archived,
+		Stable:       b.Stable,
+		FinalGravity: b.FinalGravity,
+		AlertRules:   convertDatabaseAlertRules(b.AlertRules),
+		Owner:        b.OwnerID,
+		Version:      b.Version,
+	}
 
-		firstReading := b.GravityReadings[0]
-		currentReading := converted.LatestReading
+	if !b.StableAt.IsZero() {
+		converted.StableAt = &b.StableAt
+	}
 
-		og := firstReading.Gravity
-		cg := currentReading.Gravity
+	converted.GravityReadings = &[]data.GravityReading{}
 
-		gravityChange := og - cg
-		gravityBaseline := og - 1.0
+	if b.ReadingCount > 0 {
+		converted.LatestReading = b.LatestReading
 
-		converted.Attenuation = 1 - ((gravityBaseline - gravityChange) / gravityBaseline)
-		converted.ABV = ((76.08 * (og - cg) / (1.775 - og)) * (cg / 0.794))
-	} else {
-		converted.GravityReadings = &[]data.GravityReading{}
-		converted.Attenuation = 0
-		converted.ABV = 0
+		readings, err := b.Readings()
+		if err != nil {
+			return converted, err
+		}
+		converted.GravityReadings = &readings
+
+		summary := analytics.Analyze(data.AnalyticsReadings(readings), analytics.DefaultOptions())
+		converted.OriginalGravity = summary.OriginalGravity
+		converted.Attenuation = summary.ApparentAttenuation
+		converted.RealAttenuation = summary.RealAttenuation
+		converted.ABV = summary.ABV
 	}
 
-	hydrometer, err := data.SingleHydrometer(bson.M{"_id": b.HydrometerID})
+	hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{ID: b.HydrometerID})
 
-	if err != nil && err == mgo.ErrNotFound {
+	if err != nil && err == data.ErrNotFound {
 		converted.Hydrometer = Hydrometer{}
 		err = nil
 	} else if hydrometer != nil {
@@ -104,7 +204,30 @@ func convertDatabaseBatch(b *data.Batch, lightweight bool) (*Batch, error) {
 	return converted, err
 }
 
-func convertBatchParam(b *BatchParam) (*data.Batch, error) {
+func convertAnalyticsSummary(s analytics.Summary, opts analytics.Options) *BatchAnalytics {
+	converted := &BatchAnalytics{
+		OriginalGravity:     s.OriginalGravity,
+		CurrentGravity:      s.CurrentGravity,
+		ApparentAttenuation: s.ApparentAttenuation,
+		RealAttenuation:     s.RealAttenuation,
+		ABV:                 s.ABV,
+		ABVFormula:          opts.ABVFormula.String(),
+		Rates:               []GravityRate{},
+	}
+
+	for _, rate := range s.Rates {
+		converted.Rates = append(converted.Rates, GravityRate{
+			Window:        rate.Window.String(),
+			GravityPerDay: rate.GravityPerDay,
+		})
+	}
+
+	return converted
+}
+
+// convertBatchParam makes a batch from b, whose alert rules are in
+// units u.
+func convertBatchParam(b *BatchParam, u units.System) (*data.Batch, error) {
 	batch := &data.Batch{
 		ID:           b.ID,
 		HydrometerID: b.Hydrometer.ID,
@@ -114,52 +237,204 @@ func convertBatchParam(b *BatchParam) (*data.Batch, error) {
 		Active:       b.Active,
 		Archived:     false,
 	}
+	if b.AlertRules != nil {
+		rules, err := convertAlertRulesParam(b.AlertRules, u)
+		if err != nil {
+			return nil, err
+		}
+		batch.AlertRules = rules
+	}
 	return batch, nil
 }
 
-func mergeBatchParam(param *BatchParam, batch *data.Batch) error {
+// mergeBatchParam applies param, whose alert rules are in units u, to
+// batch and saves it. Batches are started, finished and archived the
+// usual way, so that subscribers hear about it.
+func mergeBatchParam(param *BatchParam, batch *data.Batch, u units.System) error {
+	finish := !param.Active && batch.Active
+	archive := param.Archived && !batch.Archived
+
 	batch.RecipeName = param.RecipeName
 	batch.StartDate = param.StartDate
 	batch.UniqueID = param.UniqueID
-	batch.Active = param.Active
-	batch.Archived = param.Archived
+	if !param.Archived {
+		batch.Archived = false
+	}
+
+	if param.AlertRules != nil {
+		rules, err := convertAlertRulesParam(param.AlertRules, u)
+		if err != nil {
+			return err
+		}
+		batch.AlertRules = rules
+	}
+
+	if param.Version != 0 {
+		batch.Version = param.Version
+	}
+
+	hydrometer := &data.Hydrometer{
+		ID: graviton.EmptyID(),
+	}
 
 	if param.Hydrometer.ID != "" && param.Hydrometer.ID != graviton.EmptyID() {
-		hydrometer, err := data.SingleHydrometer(bson.M{"_id": param.Hydrometer.ID})
+		var err error
+		hydrometer, err = data.SingleHydrometer(data.HydrometerQuery{ID: param.Hydrometer.ID})
 
 		if err != nil {
 			return err
 		}
+	}
 
-		return batch.SetHydrometer(hydrometer)
+	var err error
+	if param.Active && !batch.Active {
+		err = batch.Start(hydrometer)
+	} else {
+		err = batch.SetHydrometer(hydrometer)
 	}
 
-	return batch.SetHydrometer(&data.Hydrometer{
-		ID: graviton.EmptyID(),
-	})
+	if err == nil && finish {
+		err = batch.FinishBatch()
+	}
+	if err == nil && archive {
+		err = batch.ArchiveBatch()
+	}
+	return err
 }
 
-func mergeHydrometerParam(param *HydrometerParam, hydrometer *data.Hydrometer) error {
+// mergeHydrometerParam applies param, whose calibration temperature is
+// in units u, to hydrometer and saves it. A hydrometer is archived with
+// Archive, which refuses hydrometers in use.
+func mergeHydrometerParam(param *HydrometerParam, hydrometer *data.Hydrometer, u units.System) error {
+	archive := param.Archived && !hydrometer.Archived
+
 	hydrometer.Name = param.Name
 	hydrometer.Description = param.Description
-	hydrometer.Archived = param.Archived
+	if !param.Archived {
+		hydrometer.Archived = false
+	}
 
+	if param.DeviceID != nil {
+		hydrometer.DeviceID = *param.DeviceID
+	}
+	if param.CalibrationTemperature != nil {
+		hydrometer.CalibrationTemperature = convertCalibrationTemperature(*param.CalibrationTemperature, u)
+	}
+
+	if archive {
+		return hydrometer.Archive()
+	}
 	return hydrometer.Save()
 }
 
 type HydrometerReading struct {
 	HydrometerName string  `json:"name"`
+	DeviceID       string  `json:"deviceId"`
 	Gravity        float64 `json:"gravity"`
 	Temperature    float64 `json:"temperature"`
 	Battery        float64 `json:"battery"`
+
+	// Optional; the raw tilt angle. If the hydrometer has a calibration,
+	// gravity is calculated from this instead.
+	Angle float64 `json:"angle,omitempty"`
+
+	// Optional; the units of Gravity and Temperature, SG and °F if unset
+	GravityUnits     string `json:"gravityUnits,omitempty"`
+	TemperatureUnits string `json:"temperatureUnits,omitempty"`
+
+	// Optional; when the reading was taken, by the device's clock
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// Optional; how many seconds before sending the reading was taken,
+	// for devices without a real-time clock
+	Age float64 `json:"age,omitempty"`
+	// Optional; the device's clock when it sent the request, used to
+	// correct Timestamp for clock skew
+	SentAt *time.Time `json:"sentAt,omitempty"`
+}
+
+// BulkHydrometerReadings carries readings a hydrometer buffered
+// while it couldn't reach the server. SentAt applies to every reading,
+// and the units to every reading that doesn't declare its own.
+type BulkHydrometerReadings struct {
+	HydrometerName   string              `json:"name"`
+	DeviceID         string              `json:"deviceId"`
+	SentAt           *time.Time          `json:"sentAt,omitempty"`
+	GravityUnits     string              `json:"gravityUnits,omitempty"`
+	TemperatureUnits string              `json:"temperatureUnits,omitempty"`
+	Readings         []HydrometerReading `json:"readings"`
+}
+
+type BulkReadingResult struct {
+	Accepted   int               `json:"accepted"`
+	Duplicates int               `json:"duplicates"`
+	Rejected   []RejectedReading `json:"rejected"`
+}
+
+type RejectedReading struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// readingDate works out when a reading was taken, correcting device
+// timestamps for clock skew if the device said when it sent them.
+// Dates further in the future than the configured tolerance are refused.
+func readingDate(r *HydrometerReading, sentAt *time.Time, received time.Time) (time.Time, error) {
+	date := received
+
+	if r.Timestamp != nil {
+		date = *r.Timestamp
+		if sentAt != nil {
+			date = date.Add(received.Sub(*sentAt))
+		}
+	} else if r.Age > 0 {
+		date = received.Add(-time.Duration(r.Age * float64(time.Second)))
+	}
+
+	if date.After(received.Add(config.GetConfig().MaxReadingFutureSkew)) {
+		return date, errors.New("reading date is in the future")
+	}
+
+	return date, nil
+}
+
+// ISpindelReading is the payload sent by iSpindel's generic HTTP
+// service. Gravity is whatever the iSpindel's own calibration produced,
+// unless the hydrometer has been calibrated here.
+type ISpindelReading struct {
+	Name             string  `json:"name"`
+	DeviceID         int     `json:"ID"`
+	Token            string  `json:"token"`
+	Angle            float64 `json:"angle"`
+	Temperature      float64 `json:"temperature"`
+	TemperatureUnits string  `json:"temp_units"`
+	Battery          float64 `json:"battery"`
+	Gravity          float64 `json:"gravity"`
+	Interval         int     `json:"interval"`
+	RSSI             int     `json:"RSSI"`
 }
 
 type Hydrometer struct {
 	ID             bson.ObjectId `json:"id,omitempty"`
 	Name           string        `json:"name"`
+	DeviceID       string        `json:"deviceId"`
 	Description    string        `json:"description"`
 	Archived       bool          `json:"archived"`
 	CurrentBatchID bson.ObjectId `json:"batch"`
+	Owner          bson.ObjectId `json:"owner,omitempty"`
+
+	// Readings are corrected to this temperature
+	CalibrationTemperature float64 `json:"calibrationTemperature"`
+
+	// Zero if the hydrometer hasn't been calibrated
+	CalibrationVersion int `json:"calibrationVersion"`
+
+	Units units.System `json:"units"`
+}
+
+// OwnerParam gives a batch or hydrometer to a user; an empty or null
+// owner clears it.
+type OwnerParam struct {
+	Owner bson.ObjectId `json:"owner"`
 }
 
 type HydrometerParam struct {
@@ -167,6 +442,11 @@ type HydrometerParam struct {
 	Name        string        `bson:"name" json:"name"`
 	Description string        `bson:"description" json:"description"`
 	Archived    bool          `bson:"archived" json:"archived"`
+
+	// Optional; edits that leave these out keep the hydrometer's
+	DeviceID *string `bson:"deviceId" json:"deviceId"`
+	// In the request's units; zero means the default, 60°F
+	CalibrationTemperature *float64 `bson:"calibrationTemperature" json:"calibrationTemperature"`
 }
 
 func convertDatabaseHydrometers(h []*data.Hydrometer) ([]*Hydrometer, error) {
@@ -187,14 +467,24 @@ func convertDatabaseHydrometer(h *data.Hydrometer) (*Hydrometer, error) {
 	converted := &Hydrometer{
 		ID:             h.ID,
 		Name:           h.Name,
+		DeviceID:       h.DeviceID,
 		Description:    h.Description,
 		CurrentBatchID: h.CurrentBatchID,
 		Archived:       h.Archived,
+		Owner:          h.OwnerID,
+
+		CalibrationTemperature: h.ReferenceTemperature(),
+	}
+
+	if calibration := h.CurrentCalibration(); calibration != nil {
+		converted.CalibrationVersion = calibration.Version
 	}
 	return converted, nil
 }
 
-func convertHydrometerParam(h *HydrometerParam) (*data.Hydrometer, error) {
+// convertHydrometerParam makes a hydrometer from h, whose calibration
+// temperature is in units u.
+func convertHydrometerParam(h *HydrometerParam, u units.System) (*data.Hydrometer, error) {
 	hydrometer := &data.Hydrometer{
 		ID:          h.ID,
 		Name:        h.Name,
@@ -202,12 +492,145 @@ func convertHydrometerParam(h *HydrometerParam) (*data.Hydrometer, error) {
 		Archived:    h.Archived,
 	}
 
+	if h.DeviceID != nil {
+		hydrometer.DeviceID = *h.DeviceID
+	}
+	if h.CalibrationTemperature != nil {
+		hydrometer.CalibrationTemperature = convertCalibrationTemperature(*h.CalibrationTemperature, u)
+	}
+
 	if hydrometer.ID == "" {
 		hydrometer.ID = bson.NewObjectId()
 	}
 	return hydrometer, nil
 }
 
+type CalibrationPoint struct {
+	Angle   float64 `json:"angle"`
+	Gravity float64 `json:"gravity"`
+}
+
+type Calibration struct {
+	Version      int                `json:"version"`
+	Degree       int                `json:"degree"`
+	Points       []CalibrationPoint `json:"points"`
+	Coefficients []float64          `json:"coefficients"` // constant term first
+	CreatedAt    time.Time          `json:"created"`
+}
+
+// CalibrationParam holds known gravities at measured angles. Degree
+// defaults to 2, which suits most tilt hydrometers.
+type CalibrationParam struct {
+	Degree int                `json:"degree"`
+	Points []CalibrationPoint `json:"points"`
+}
+
+func convertDatabaseCalibration(c *data.Calibration) *Calibration {
+	converted := &Calibration{
+		Version:      c.Version,
+		Degree:       c.Degree,
+		Points:       []CalibrationPoint{},
+		Coefficients: c.Coefficients,
+		CreatedAt:    c.CreatedAt,
+	}
+
+	for _, p := range c.Points {
+		converted.Points = append(converted.Points, CalibrationPoint{Angle: p.Angle, Gravity: p.Gravity})
+	}
+	return converted
+}
+
+func convertCalibrationParam(c *CalibrationParam) []data.CalibrationPoint {
+	points := []data.CalibrationPoint{}
+	for _, p := range c.Points {
+		points = append(points, data.CalibrationPoint{Angle: p.Angle, Gravity: p.Gravity})
+	}
+	return points
+}
+
+// ReprocessParam asks for readings to be recomputed from their raw
+// values; see data.ReprocessOptions. Unless Apply is set, nothing is
+// changed, and the response shows what would change.
+type ReprocessParam struct {
+	BatchID            bson.ObjectId `json:"batch,omitempty"`
+	HydrometerID       bson.ObjectId `json:"hydrometer,omitempty"`
+	From               *time.Time    `json:"from,omitempty"`
+	To                 *time.Time    `json:"to,omitempty"`
+	CalibrationVersion int           `json:"calibrationVersion"`
+	GravityOffset      float64       `json:"gravityOffset"`
+	TemperatureOffset  float64       `json:"temperatureOffset"`
+	Apply              bool          `json:"apply"`
+}
+
+func convertReprocessParam(r *ReprocessParam) data.ReprocessOptions {
+	opts := data.ReprocessOptions{
+		BatchID:            r.BatchID,
+		HydrometerID:       r.HydrometerID,
+		CalibrationVersion: r.CalibrationVersion,
+		GravityOffset:      r.GravityOffset,
+		TemperatureOffset:  r.TemperatureOffset,
+	}
+
+	if r.From != nil {
+		opts.From = *r.From
+	}
+	if r.To != nil {
+		opts.To = *r.To
+	}
+	return opts
+}
+
+// AlertRules are a batch's own alert rules. Zero fields use the server
+// defaults; rules whose kinds are in Disabled are off. Temperatures and
+// the stall threshold are in the units of the request or response, like
+// readings.
+type AlertRules struct {
+	MinTemperature    float64 `json:"minTemperature,omitempty"`
+	MaxTemperature    float64 `json:"maxTemperature,omitempty"`
+	MinBatteryVoltage float64 `json:"minBatteryVoltage,omitempty"`
+	SilentMinutes     int     `json:"silentMinutes,omitempty"`
+	StallHours        int     `json:"stallHours,omitempty"`
+	StallThreshold    float64 `json:"stallThreshold,omitempty"`   // a drop in gravity
+	StallAttenuation  float64 `json:"stallAttenuation,omitempty"` // apparent, from 0 to 1
+
+	Disabled []data.AlertKind `json:"disabled,omitempty"` // e.g. ["silent"]
+}
+
+func convertDatabaseAlertRules(r data.AlertRules) AlertRules {
+	return AlertRules{
+		MinTemperature:    r.MinTemperature,
+		MaxTemperature:    r.MaxTemperature,
+		MinBatteryVoltage: r.MinBatteryVoltage,
+		SilentMinutes:     int(r.SilentAfter / time.Minute),
+		StallHours:        int(r.StallWindow / time.Hour),
+		StallThreshold:    r.StallThreshold,
+		StallAttenuation:  r.StallAttenuation,
+		Disabled:          r.Disabled,
+	}
+}
+
+// convertAlertRulesParam converts alert rules given in units u.
+func convertAlertRulesParam(param *AlertRules, u units.System) (data.AlertRules, error) {
+	for _, kind := range param.Disabled {
+		if _, err := data.ParseAlertKind(string(kind)); err != nil {
+			return data.AlertRules{}, err
+		}
+	}
+
+	r := convertAlertRulesParamUnits(*param, u)
+
+	return data.AlertRules{
+		MinTemperature:    r.MinTemperature,
+		MaxTemperature:    r.MaxTemperature,
+		MinBatteryVoltage: r.MinBatteryVoltage,
+		SilentAfter:       time.Duration(r.SilentMinutes) * time.Minute,
+		StallWindow:       time.Duration(r.StallHours) * time.Hour,
+		StallThreshold:    r.StallThreshold,
+		StallAttenuation:  r.StallAttenuation,
+		Disabled:          r.Disabled,
+	}, nil
+}
+
 func defaultErrorResponse(c echo.Context, code int, err error) error {
 	return c.JSON(code, bson.M{"error": err.Error()})
 }
@@ -9,38 +9,73 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+// QueryHydrometers lists hydrometers, paged by the parameters in
+// parsePageParams. Hydrometers sort by name.
 func QueryHydrometers(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/hydrometers") {
-		return nil
+	query := data.HydrometerQuery{
+		Archived: data.Bool(false),
 	}
 
-	query := bson.M{
-		"archived": false,
+	parseHydrometerQuery(c, &query)
+
+	page, err := parsePageParams(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
 	}
 
-	parseHydrometerQuery(c, query)
+	responseUnits, err := responseUnits(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	query.Sort = page.sort
+	query.After = page.after
+	query.Limit = page.queryLimit()
 
 	hydrometers, err := data.QueryHydrometers(query)
 
+	if err == data.ErrBadSort {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	} else if err != nil {
+		c.String(502, "database query failed")
+		return err
+	}
+
+	total, err := data.CountHydrometers(query)
+
 	if err != nil {
 		c.String(502, "database query failed")
 		return err
 	}
 
+	var next *data.Cursor
+	if page.hasMore(len(hydrometers)) {
+		hydrometers = hydrometers[:page.limit]
+		next = hydrometers[page.limit-1].Cursor(query.Sort)
+	}
+	setPageHeaders(c, total, next)
+
 	responseHydrometers, err := convertDatabaseHydrometers(hydrometers)
 	if err != nil {
 		return c.JSON(502, bson.M{"error": "database conversion failed"})
 	}
 
+	for _, hydrometer := range responseHydrometers {
+		convertHydrometerUnits(hydrometer, responseUnits)
+	}
 	return c.JSON(200, responseHydrometers)
 }
 
 func QueryAvailableHydrometers(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/hydrometers") {
-		return nil
+	responseUnits, err := responseUnits(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
 	}
 
-	hydrometers, err := data.QueryHydrometers(bson.M{"batch": graviton.EmptyID(), "archived": false})
+	hydrometers, err := data.QueryHydrometers(data.HydrometerQuery{CurrentBatchID: graviton.EmptyID(), Archived: data.Bool(false)})
 
 	if err != nil {
 		c.String(502, "database query failed")
@@ -52,14 +87,13 @@ func QueryAvailableHydrometers(c echo.Context) error {
 		return c.JSON(502, bson.M{"error": "database conversion failed"})
 	}
 
+	for _, hydrometer := range responseHydrometers {
+		convertHydrometerUnits(hydrometer, responseUnits)
+	}
 	return c.JSON(200, responseHydrometers)
 }
 
 func NewHydrometer(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/hydrometers") {
-		return nil
-	}
-
 	hydrometerParam := &HydrometerParam{}
 	err := c.Bind(hydrometerParam)
 
@@ -67,12 +101,20 @@ func NewHydrometer(c echo.Context) error {
 		return defaultErrorResponse(c, 400, err)
 	}
 
-	databaseHydrometer, err := convertHydrometerParam(hydrometerParam)
+	responseUnits, err := responseUnits(c)
+
+	if err != nil {
+		return defaultErrorResponse(c, 400, err)
+	}
+
+	databaseHydrometer, err := convertHydrometerParam(hydrometerParam, responseUnits)
 
 	if err != nil {
 		return defaultErrorResponse(c, 502, err)
 	}
 
+	databaseHydrometer.OwnerID = auth.RequestUserID(c)
+
 	err = databaseHydrometer.Save()
 
 	if err != nil {
@@ -84,21 +126,25 @@ func NewHydrometer(c echo.Context) error {
 	if err != nil {
 		return defaultErrorResponse(c, 502, err)
 	}
+
+	convertHydrometerUnits(responseHydrometer, responseUnits)
 	return c.JSON(200, responseHydrometer)
 }
 
 func GetHydrometer(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/hydrometers") {
-		return nil
-	}
-
 	id := c.Param("id")
 
 	if !bson.IsObjectIdHex(id) {
 		return c.JSON(400, bson.M{"error": "bad object id"})
 	}
 
-	hydrometer, err := data.SingleHydrometer(bson.M{"_id": bson.ObjectIdHex(id)})
+	responseUnits, err := responseUnits(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{ID: bson.ObjectIdHex(id)})
 
 	if err != nil {
 		graviton.Logger.Error("Failed to query single hydrometer", zap.String("id", id), zap.Error(err))
@@ -112,14 +158,11 @@ func GetHydrometer(c echo.Context) error {
 		return c.JSON(502, bson.M{"error": "database conversion failed"})
 	}
 
+	convertHydrometerUnits(responseHydrometer, responseUnits)
 	return c.JSON(200, responseHydrometer)
 }
 
 func EditHydrometer(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/hydrometers") {
-		return nil
-	}
-
 	id := c.Param("id")
 
 	if !bson.IsObjectIdHex(id) {
@@ -135,16 +178,24 @@ func EditHydrometer(c echo.Context) error {
 		return c.JSON(400, bson.M{"error": "invalid input"})
 	}
 
-	hydrometer, err := data.SingleHydrometer(bson.M{"_id": bsonID})
+	responseUnits, err := responseUnits(c)
 
 	if err != nil {
-		graviton.Logger.Warn("Hydrometer not found", zap.String("ID", bsonID.Hex()))
 		return c.JSON(400, bson.M{"error": err.Error()})
 	}
 
-	err = mergeHydrometerParam(hydrometerParam, hydrometer)
+	hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{ID: bsonID})
 
 	if err != nil {
+		graviton.Logger.Warn("Hydrometer not found", zap.String("ID", bsonID.Hex()))
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	err = mergeHydrometerParam(hydrometerParam, hydrometer, responseUnits)
+
+	if err == data.ErrHydrometerInUse {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	} else if err != nil {
 		graviton.Logger.Warn("Hydrometer merge failed", zap.Error(err))
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
@@ -156,14 +207,11 @@ func EditHydrometer(c echo.Context) error {
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
 
+	convertHydrometerUnits(apiHydrometer, responseUnits)
 	return c.JSON(200, apiHydrometer)
 }
 
 func ArchiveHydrometer(c echo.Context) error {
-	if !auth.IsAuthorized(c, "/hydrometers") {
-		return nil
-	}
-
 	id := c.Param("id")
 
 	if !bson.IsObjectIdHex(id) {
@@ -179,21 +227,24 @@ func ArchiveHydrometer(c echo.Context) error {
 		return c.JSON(400, bson.M{"error": "invalid input"})
 	}
 
-	hydrometer, err := data.SingleHydrometer(bson.M{"_id": bsonID})
+	responseUnits, err := responseUnits(c)
 
 	if err != nil {
-		graviton.Logger.Warn("Hydrometer not found", zap.String("ID", bsonID.Hex()))
 		return c.JSON(400, bson.M{"error": err.Error()})
 	}
 
-	if hydrometer.CurrentBatchID != graviton.EmptyID() {
-		return c.JSON(400, bson.M{"error": "can't archive hydrometer in use"})
+	hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{ID: bsonID})
+
+	if err != nil {
+		graviton.Logger.Warn("Hydrometer not found", zap.String("ID", bsonID.Hex()))
+		return c.JSON(400, bson.M{"error": err.Error()})
 	}
 
-	hydrometer.Archived = true
-	err = hydrometer.Save()
+	err = hydrometer.Archive()
 
-	if err != nil {
+	if err == data.ErrHydrometerInUse {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	} else if err != nil {
 		graviton.Logger.Warn("Unable to save hydrometer", zap.Error(err))
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
@@ -205,20 +256,94 @@ func ArchiveHydrometer(c echo.Context) error {
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
 
+	convertHydrometerUnits(apiHydrometer, responseUnits)
 	return c.JSON(200, apiHydrometer)
 }
 
-func parseHydrometerQuery(c echo.Context, query bson.M) {
+// GetCalibrations lists a hydrometer's calibrations, oldest first.
+func GetCalibrations(c echo.Context) error {
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		return c.JSON(400, bson.M{"error": "bad object id"})
+	}
+
+	hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{ID: bson.ObjectIdHex(id)})
+
+	if err == data.ErrNotFound {
+		return c.JSON(404, bson.M{"error": "hydrometer not found"})
+	} else if err != nil {
+		graviton.Logger.Error("Failed to query single hydrometer", zap.String("id", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	calibrations := []*Calibration{}
+	for i := range hydrometer.Calibrations {
+		calibrations = append(calibrations, convertDatabaseCalibration(&hydrometer.Calibrations[i]))
+	}
+
+	return c.JSON(200, calibrations)
+}
+
+// CalibrateHydrometer fits a new calibration to the posted points and
+// makes it the hydrometer's current calibration. Readings already
+// stored are unchanged.
+func CalibrateHydrometer(c echo.Context) error {
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		return c.JSON(400, bson.M{"error": "bad object id"})
+	}
+
+	calibrationParam := &CalibrationParam{}
+	err := c.Bind(calibrationParam)
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	if calibrationParam.Degree == 0 {
+		calibrationParam.Degree = 2
+	}
+
+	hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{ID: bson.ObjectIdHex(id)})
+
+	if err == data.ErrNotFound {
+		return c.JSON(404, bson.M{"error": "hydrometer not found"})
+	} else if err != nil {
+		graviton.Logger.Error("Failed to query single hydrometer", zap.String("id", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	calibration, err := hydrometer.Calibrate(convertCalibrationParam(calibrationParam), calibrationParam.Degree)
+
+	if err != nil {
+		graviton.Logger.Warn("Calibration fit failed", zap.String("Hydrometer", hydrometer.Name), zap.Error(err))
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	err = hydrometer.Save()
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to save hydrometer", zap.Error(err))
+		return c.JSON(502, bson.M{"error": err.Error()})
+	}
+
+	graviton.Logger.Info("Calibrated hydrometer", zap.String("Hydrometer", hydrometer.Name), zap.Int("Version", calibration.Version))
+	return c.JSON(200, convertDatabaseCalibration(calibration))
+}
+
+func parseHydrometerQuery(c echo.Context, query *data.HydrometerQuery) {
 	nameParam := c.QueryParam("name")
 
 	if nameParam != "" {
-		query["name"] = nameParam
+		query.Name = nameParam
 	}
 
 	archivedParam := c.QueryParam("archived")
 
 	if archivedParam == "true" {
-		query["archived"] = true
+		query.Archived = data.Bool(true)
 	}
 
 	return
@@ -2,12 +2,14 @@ package api
 
 import (
 	"bytes"
+	"math"
 	"net/http/httptest"
 	"testing"
 
 	"gopkg.in/square/go-jose.v1/json"
 
 	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/analytics"
 	"github.com/jslater89/graviton/auth"
 	"github.com/jslater89/graviton/config"
 	"github.com/jslater89/graviton/data"
@@ -17,7 +19,7 @@ import (
 func TestHydrometerAPI(t *testing.T) {
 	graviton.InitTest()
 	auth.InitOauth(config.GetConfig().MongoAddress, config.GetConfig().GetDBName())
-	data.GenerateDemoData()
+	data.GenerateTestData()
 
 	sessionID := generateTestSession()
 
@@ -70,10 +72,15 @@ func TestHydrometerAPI(t *testing.T) {
 	}
 
 	// --------------- 3. Test POST new hydrometer
+	deviceID := "pink-1"
+	calibrationTemperature := 68.0
 	newHydrometer := HydrometerParam{
 		Name:        "Pink Hydrometer",
 		Description: "A pretty pink hydrometer",
 		Archived:    false,
+
+		DeviceID:               &deviceID,
+		CalibrationTemperature: &calibrationTemperature,
 	}
 	marshaledHydrometer, err := json.Marshal(newHydrometer)
 
@@ -125,7 +132,8 @@ func TestHydrometerAPI(t *testing.T) {
 		t.Errorf("New hydrometer is wrong: %v %v\n", newHydrometer, hydrometer)
 	}
 
-	// --------------- 5. Test PUT single hydrometer
+	// --------------- 5. Test PUT single hydrometer, leaving out the
+	// device ID and calibration temperature
 	newHydrometer = HydrometerParam{
 		Name:        "Pink Hydrometer",
 		Description: "A modified description",
@@ -159,6 +167,36 @@ func TestHydrometerAPI(t *testing.T) {
 		t.Errorf("New hydrometer is wrong: %v %v\n", newHydrometer, hydrometer)
 	}
 
+	if hydrometer.DeviceID != deviceID || hydrometer.CalibrationTemperature != calibrationTemperature {
+		t.Errorf("Edit cleared omitted fields: %v\n", hydrometer)
+	}
+
+	// Calibration temperatures are in the request's units
+	metricTemperature := 10.0
+	newHydrometer.CalibrationTemperature = &metricTemperature
+	marshaledHydrometer, err = json.Marshal(newHydrometer)
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.PUT, "/api/v1/hydrometers/:id?units=metric", bytes.NewBuffer(marshaledHydrometer))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(newHydrometerID.Hex())
+
+	err = EditHydrometer(c)
+
+	hydrometer = Hydrometer{}
+	json.NewDecoder(rec.Body).Decode(&hydrometer)
+
+	if err != nil || rec.Code != 200 || math.Abs(hydrometer.CalibrationTemperature-10) > 0.00001 {
+		t.Errorf("Calibration temperature not in metric: %d %v %v\n", rec.Code, err, hydrometer)
+	}
+	if stored, _ := data.SingleHydrometer(data.HydrometerQuery{ID: newHydrometerID}); math.Abs(stored.CalibrationTemperature-50) > 0.00001 {
+		t.Errorf("Calibration temperature not stored in °F: %v\n", stored.CalibrationTemperature)
+	}
+
 	// --------------- 6. Test archive single hydrometer
 	e = echo.New()
 	req = httptest.NewRequest(echo.DELETE, "/api/v1/hydrometers/:id", nil)
@@ -202,5 +240,122 @@ func TestHydrometerAPI(t *testing.T) {
 		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, rec.Body.Bytes())
 	}
 
+	// Editing it archived is refused the same way
+	marshaledHydrometer, err = json.Marshal(HydrometerParam{Name: greenHydrometer.Name, Archived: true})
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.PUT, "/api/v1/hydrometers/:id", bytes.NewBuffer(marshaledHydrometer))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(greenHydrometer.ID.Hex())
+
+	err = EditHydrometer(c)
+
+	if err != nil || rec.Code != 400 {
+		t.Errorf("Archived hydrometer in use: %d %v %s\n", rec.Code, err, rec.Body.Bytes())
+	}
+	if stored, _ := data.SingleHydrometer(data.HydrometerQuery{ID: greenHydrometer.ID}); stored.Archived {
+		t.Errorf("Hydrometer in use archived\n")
+	}
+
+	// --------------- 8. Test calibrating a hydrometer
+	calibrationParam := CalibrationParam{
+		Degree: 1,
+		Points: []CalibrationPoint{
+			{Angle: 25, Gravity: 1.000},
+			{Angle: 45, Gravity: 1.040},
+			{Angle: 65, Gravity: 1.080},
+		},
+	}
+	marshaledCalibration, err := json.Marshal(calibrationParam)
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.POST, "/api/v1/hydrometers/:id/calibrations", bytes.NewBuffer(marshaledCalibration))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(greenHydrometer.ID.Hex())
+
+	err = CalibrateHydrometer(c)
+
+	if err != nil || rec.Code != 200 {
+		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, rec.Body.Bytes())
+	}
+
+	calibration := Calibration{}
+	err = json.NewDecoder(rec.Body).Decode(&calibration)
+
+	if err != nil {
+		t.Errorf("Unable to decode response: %v\n", err)
+	}
+
+	if calibration.Version != 1 || len(calibration.Coefficients) != 2 {
+		t.Errorf("Calibration is wrong: %v\n", calibration)
+	}
+
+	// --------------- 9. Test raw reading converted with calibration
+	rawReading := HydrometerReading{
+		HydrometerName: greenHydrometer.Name,
+		Angle:          55,
+		Temperature:    68,
+	}
+	marshaledReading, err := json.Marshal(rawReading)
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.POST, "/api/v1/reading", bytes.NewBuffer(marshaledReading))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+
+	err = AddReading(c)
+
+	if err != nil || rec.Code != 200 {
+		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, rec.Body.Bytes())
+	}
+
+	batch, _ := data.SingleBatch(data.BatchQuery{ID: greenHydrometer.CurrentBatchID})
+	readings, _ := batch.Readings()
+
+	var rawStored *data.GravityReading
+	for i := range readings {
+		if readings[i].Angle == rawReading.Angle {
+			rawStored = &readings[i]
+		}
+	}
+
+	if rawStored == nil || rawStored.CalibrationVersion != 1 || math.Abs(rawStored.Gravity-1.060) > 0.0001 {
+		t.Errorf("Raw reading converted incorrectly: %v\n", rawStored)
+	}
+
+	// Sampled at 68°F, for a hydrometer calibrated at 60°F
+	if rawStored != nil && math.Abs(rawStored.CorrectedGravity-analytics.CorrectGravity(1.060, 68, 60)) > 0.00001 {
+		t.Errorf("Raw reading not temperature corrected: %v\n", rawStored)
+	}
+
+	// --------------- 10. Test calibration with too few points
+	calibrationParam.Degree = 3
+	marshaledCalibration, err = json.Marshal(calibrationParam)
+
+	e = echo.New()
+	req = httptest.NewRequest(echo.POST, "/api/v1/hydrometers/:id/calibrations", bytes.NewBuffer(marshaledCalibration))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(greenHydrometer.ID.Hex())
+
+	err = CalibrateHydrometer(c)
+
+	if err != nil || rec.Code != 400 {
+		t.Errorf("Request failed with code %d %v %s\n", rec.Code, err, rec.Body.Bytes())
+	}
+
 	data.CleanupTestData()
 }
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/auth"
+	"github.com/jslater89/graviton/data"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SetBatchOwner gives a batch to another user, or with an empty owner,
+// to no one; takes an OwnerParam. Owning a batch doesn't allow giving
+// it away.
+func SetBatchOwner(c echo.Context) error {
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		return c.JSON(400, bson.M{"error": "bad object id"})
+	}
+
+	owner, ok := bindOwnerParam(c)
+	if !ok {
+		return nil
+	}
+
+	batch, err := data.SingleBatch(data.BatchQuery{ID: bson.ObjectIdHex(id)})
+
+	if err == data.ErrNotFound {
+		return c.JSON(404, bson.M{"error": "batch not found"})
+	} else if err != nil {
+		graviton.Logger.Warn("Batch query failed", zap.String("ID", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	batch.OwnerID = owner
+	err = batch.Save()
+
+	if err == data.ErrConflict {
+		return c.JSON(409, bson.M{"error": err.Error()})
+	} else if err != nil {
+		graviton.Logger.Warn("Unable to save batch", zap.Error(err))
+		return c.JSON(502, bson.M{"error": err.Error()})
+	}
+
+	return c.JSON(200, bson.M{"status": "ok"})
+}
+
+// SetHydrometerOwner gives a hydrometer to another user, like
+// SetBatchOwner.
+func SetHydrometerOwner(c echo.Context) error {
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		return c.JSON(400, bson.M{"error": "bad object id"})
+	}
+
+	owner, ok := bindOwnerParam(c)
+	if !ok {
+		return nil
+	}
+
+	hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{ID: bson.ObjectIdHex(id)})
+
+	if err == data.ErrNotFound {
+		return c.JSON(404, bson.M{"error": "hydrometer not found"})
+	} else if err != nil {
+		graviton.Logger.Warn("Hydrometer query failed", zap.String("ID", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	hydrometer.OwnerID = owner
+	err = hydrometer.Save()
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to save hydrometer", zap.Error(err))
+		return c.JSON(502, bson.M{"error": err.Error()})
+	}
+
+	return c.JSON(200, bson.M{"status": "ok"})
+}
+
+// bindOwnerParam reads an OwnerParam naming an existing user, or no
+// one. If it doesn't, it makes an appropriate response with the
+// context, and the second return value is false.
+func bindOwnerParam(c echo.Context) (bson.ObjectId, bool) {
+	param := &OwnerParam{}
+	err := c.Bind(param)
+
+	if err != nil || (param.Owner != "" && !param.Owner.Valid()) {
+		c.JSON(400, bson.M{"error": "invalid input"})
+		return "", false
+	}
+
+	if param.Owner == "" {
+		return "", true
+	}
+
+	exists, err := auth.UserExists(param.Owner)
+
+	if err != nil {
+		graviton.Logger.Warn("User query failed", zap.Error(err))
+		c.JSON(502, bson.M{"error": "database query failed"})
+		return "", false
+	} else if !exists {
+		c.JSON(400, bson.M{"error": "no such user"})
+		return "", false
+	}
+
+	return param.Owner, true
+}
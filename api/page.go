@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jslater89/graviton/data"
+	"github.com/labstack/echo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const maxPageSize = 1000
+
+// Paged list endpoints return a page of results as usual, with these
+// headers describing the rest.
+const (
+	totalCountHeader = "X-Total-Count"
+	nextCursorHeader = "X-Next-Cursor"
+)
+
+// pageParams are the query parameters shared by paged list endpoints:
+//
+//	sort    a field to sort by, with a leading '-' for descending
+//	limit   page size; everything if unset
+//	cursor  the X-Next-Cursor header from the previous page
+type pageParams struct {
+	sort  string
+	limit int
+	after *data.Cursor
+}
+
+func parsePageParams(c echo.Context) (*pageParams, error) {
+	params := &pageParams{sort: c.QueryParam("sort")}
+
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return nil, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		params.limit = limit
+	}
+
+	if c.QueryParam("cursor") != "" {
+		cursor, err := decodeCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return nil, err
+		}
+		params.after = cursor
+	}
+
+	return params, nil
+}
+
+// queryLimit is the limit to query with: one more than the page size,
+// to tell whether there's another page.
+func (p *pageParams) queryLimit() int {
+	if p.limit == 0 {
+		return 0
+	}
+	return p.limit + 1
+}
+
+// hasMore reports whether a query returned more than a page of results.
+func (p *pageParams) hasMore(results int) bool {
+	return p.limit > 0 && results > p.limit
+}
+
+func setPageHeaders(c echo.Context, total int, next *data.Cursor) {
+	c.Response().Header().Set(totalCountHeader, strconv.Itoa(total))
+	if next != nil {
+		c.Response().Header().Set(nextCursorHeader, encodeCursor(next))
+	}
+}
+
+// Cursors are opaque to clients: an ID and a sort value, tagged with
+// its type.
+func encodeCursor(cursor *data.Cursor) string {
+	value := ""
+	switch v := cursor.Value.(type) {
+	case time.Time:
+		value = "t" + strconv.FormatInt(v.UnixNano(), 10)
+	case string:
+		value = "s" + v
+	}
+
+	encoded := cursor.ID.Hex() + "," + value
+	return base64.RawURLEncoding.EncodeToString([]byte(encoded))
+}
+
+func decodeCursor(encoded string) (*data.Cursor, error) {
+	badCursor := errors.New("bad cursor")
+
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, badCursor
+	}
+
+	parts := strings.SplitN(string(decoded), ",", 2)
+	if len(parts) != 2 {
+		return nil, badCursor
+	}
+
+	cursor := &data.Cursor{}
+	if parts[0] != "" {
+		if !bson.IsObjectIdHex(parts[0]) {
+			return nil, badCursor
+		}
+		cursor.ID = bson.ObjectIdHex(parts[0])
+	}
+
+	value := parts[1]
+	switch {
+	case strings.HasPrefix(value, "t"):
+		nanos, err := strconv.ParseInt(value[1:], 10, 64)
+		if err != nil {
+			return nil, badCursor
+		}
+		cursor.Value = time.Unix(0, nanos)
+	case strings.HasPrefix(value, "s"):
+		cursor.Value = value[1:]
+	case value != "":
+		return nil, badCursor
+	}
+
+	return cursor, nil
+}
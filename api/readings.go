@@ -0,0 +1,256 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/analytics"
+	"github.com/jslater89/graviton/data"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultReadingLimit = 500
+	maxReadingLimit     = 5000
+)
+
+// The most readings loaded for one bucketed page or downsampled series;
+// a var for tests.
+var maxSeriesReadings = 50000
+
+var errSeriesTooLarge = errors.New("too many readings in range; narrow it with from and to")
+
+// readingSeriesParams are the query parameters of GetBatchReadings.
+type readingSeriesParams struct {
+	query  data.ReadingQuery
+	limit  int
+	cursor time.Time
+	// Exactly one of these is set for downsampled series
+	bucketWidth time.Duration
+	points      int
+}
+
+// GetBatchReadings returns a page of a batch's readings, oldest first.
+// Query parameters:
+//
+//	from, to    RFC 3339 time bounds, inclusive and exclusive
+//	hidden      'true' to include hidden readings
+//	limit       page size, default 500
+//	cursor      nextCursor from the previous page
+//	resolution  'raw' (the default); a duration like '1h', for
+//	            min/max/mean buckets of that width; or a number of
+//	            points to downsample to with LTTB, which isn't paged
+//	units       see responseUnits
+//
+// Bucketed pages and downsampled series are computed from at most
+// maxSeriesReadings readings. A bucketed page ends early rather than
+// exceed that; a downsampled series is refused.
+func GetBatchReadings(c echo.Context) error {
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		return c.JSON(400, bson.M{"error": "bad object id"})
+	}
+
+	params, err := parseReadingSeriesParams(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	responseUnits, err := responseUnits(c)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	batch, err := data.SingleBatch(data.BatchQuery{ID: bson.ObjectIdHex(id)})
+
+	if err == data.ErrNotFound {
+		return c.JSON(404, bson.M{"error": "batch not found"})
+	} else if err != nil {
+		graviton.Logger.Error("Failed to query single batch", zap.String("id", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	var series *ReadingSeries
+	if params.bucketWidth > 0 {
+		series, err = bucketedReadingSeries(batch, params)
+	} else if params.points > 0 {
+		series, err = downsampledReadingSeries(batch, params)
+	} else {
+		series, err = rawReadingSeries(batch, params)
+	}
+
+	if err == errSeriesTooLarge {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	} else if err != nil {
+		graviton.Logger.Error("Failed to query batch readings", zap.String("id", id), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	convertReadingSeriesUnits(series, responseUnits)
+	return c.JSON(200, series)
+}
+
+func rawReadingSeries(batch *data.Batch, params *readingSeriesParams) (*ReadingSeries, error) {
+	query := params.query
+	query.Limit = params.limit + 1
+
+	readings, err := batch.QueryReadings(query)
+	if err != nil {
+		return nil, err
+	}
+
+	series := &ReadingSeries{Resolution: "raw"}
+	if len(readings) > params.limit {
+		readings = readings[:params.limit]
+		last := readings[params.limit-1]
+		series.NextCursor = encodeCursor(&data.Cursor{Value: last.Date, ID: last.ID})
+	}
+	series.Readings = readings
+
+	return series, nil
+}
+
+func bucketedReadingSeries(batch *data.Batch, params *readingSeriesParams) (*ReadingSeries, error) {
+	query := params.query
+	if params.cursor.After(query.From) {
+		query.From = params.cursor
+	}
+	query.Limit = maxSeriesReadings + 1
+
+	readings, err := batch.QueryReadings(query)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := analytics.BucketReadings(seriesReadings(readings), params.bucketWidth)
+
+	// The bucket after the page starts the next one. If readings were
+	// left unloaded, the last bucket may be missing some, so it does.
+	next := len(buckets)
+	if len(buckets) > params.limit {
+		next = params.limit
+	} else if len(readings) > maxSeriesReadings {
+		if len(buckets) < 2 {
+			return nil, errSeriesTooLarge
+		}
+		next = len(buckets) - 1
+	}
+
+	series := &ReadingSeries{Resolution: params.bucketWidth.String()}
+	if next < len(buckets) {
+		series.NextCursor = encodeCursor(&data.Cursor{Value: buckets[next].Start})
+		buckets = buckets[:next]
+	}
+
+	series.Buckets = []ReadingBucket{}
+	for _, b := range buckets {
+		series.Buckets = append(series.Buckets, ReadingBucket(b))
+	}
+
+	return series, nil
+}
+
+func downsampledReadingSeries(batch *data.Batch, params *readingSeriesParams) (*ReadingSeries, error) {
+	query := params.query
+	query.Limit = maxSeriesReadings + 1
+
+	readings, err := batch.QueryReadings(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(readings) > maxSeriesReadings {
+		return nil, errSeriesTooLarge
+	}
+
+	series := &ReadingSeries{
+		Resolution: strconv.Itoa(params.points),
+		Readings:   []data.GravityReading{},
+	}
+	for _, i := range analytics.LTTB(seriesReadings(readings), params.points) {
+		series.Readings = append(series.Readings, readings[i])
+	}
+
+	return series, nil
+}
+
+// seriesReadings converts readings for downsampling, keeping hidden
+// readings if the query did.
+func seriesReadings(readings []data.GravityReading) []analytics.Reading {
+	converted := []analytics.Reading{}
+	for _, r := range readings {
+		converted = append(converted, analytics.Reading{
+			Date:        r.Date,
+			Gravity:     r.EffectiveGravity(),
+			Temperature: r.Temperature,
+		})
+	}
+	return converted
+}
+
+func parseReadingSeriesParams(c echo.Context) (*readingSeriesParams, error) {
+	params := &readingSeriesParams{limit: defaultReadingLimit}
+
+	for name, bound := range map[string]*time.Time{"from": &params.query.From, "to": &params.query.To} {
+		if c.QueryParam(name) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, c.QueryParam(name))
+		if err != nil {
+			return nil, errors.New("bad time for " + name)
+		}
+		*bound = t
+	}
+
+	if c.QueryParam("hidden") != "true" {
+		params.query.Hidden = data.Bool(false)
+	}
+
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 || limit > maxReadingLimit {
+			return nil, errors.New("limit must be between 1 and " + strconv.Itoa(maxReadingLimit))
+		}
+		params.limit = limit
+	}
+
+	resolution := c.QueryParam("resolution")
+	if points, err := strconv.Atoi(resolution); err == nil {
+		if points < 3 || points > maxReadingLimit {
+			return nil, errors.New("resolution must be between 3 and " + strconv.Itoa(maxReadingLimit) + " points")
+		}
+		params.points = points
+	} else if resolution != "" && resolution != "raw" {
+		width, err := time.ParseDuration(resolution)
+		if err != nil || width <= 0 {
+			return nil, errors.New("bad resolution " + resolution)
+		}
+		params.bucketWidth = width
+	}
+
+	if c.QueryParam("cursor") != "" {
+		cursor, err := decodeCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return nil, err
+		}
+		date, ok := cursor.Value.(time.Time)
+		if !ok {
+			return nil, errors.New("bad cursor")
+		}
+		params.cursor = date
+		params.query.After = &data.GravityReading{Date: date, ID: cursor.ID}
+
+		// Bucket cursors are the start of the next bucket
+		if params.bucketWidth > 0 {
+			params.query.After = nil
+		}
+	}
+
+	return params, nil
+}
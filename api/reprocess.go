@@ -0,0 +1,76 @@
+package api
+
+import (
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/auth"
+	"github.com/jslater89/graviton/data"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ReprocessReadings recomputes a batch's or hydrometer's readings from
+// their raw values, with a given calibration and offsets. By default
+// it only reports what would change; with apply set, it makes the
+// changes and records who made them.
+func ReprocessReadings(c echo.Context) error {
+	reprocessParam := &ReprocessParam{}
+	err := c.Bind(reprocessParam)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	plan, err := data.PlanReprocessing(convertReprocessParam(reprocessParam))
+
+	if err == data.ErrNotFound {
+		return c.JSON(404, bson.M{"error": "batch not found"})
+	} else if err != nil {
+		graviton.Logger.Warn("Unable to plan reprocessing", zap.Error(err))
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	if !reprocessParam.Apply {
+		return c.JSON(200, plan)
+	}
+
+	err = plan.Apply(auth.RequestUser(c))
+
+	if err != nil {
+		graviton.Logger.Error("Reprocessing failed", zap.String("ReprocessingID", plan.ID.Hex()), zap.Error(err))
+		return c.JSON(502, bson.M{"error": err.Error()})
+	}
+
+	graviton.Logger.Info("Reprocessed readings",
+		zap.String("ReprocessingID", plan.ID.Hex()),
+		zap.String("User", plan.AppliedBy),
+		zap.Int("Changed", len(plan.Changes)))
+	return c.JSON(200, plan)
+}
+
+// QueryReprocessings lists applied reprocessings, optionally for one
+// batch or hydrometer, oldest first.
+func QueryReprocessings(c echo.Context) error {
+	query := data.ReprocessingQuery{}
+
+	for param, id := range map[string]*bson.ObjectId{"batch": &query.BatchID, "hydrometer": &query.HydrometerID} {
+		value := c.QueryParam(param)
+		if value == "" {
+			continue
+		}
+		if !bson.IsObjectIdHex(value) {
+			return c.JSON(400, bson.M{"error": "bad object id"})
+		}
+		*id = bson.ObjectIdHex(value)
+	}
+
+	reprocessings, err := data.QueryReprocessings(query)
+
+	if err != nil {
+		graviton.Logger.Warn("Reprocessing query failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	return c.JSON(200, reprocessings)
+}
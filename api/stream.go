@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jslater89/graviton/auth"
+	"github.com/jslater89/graviton/data"
+	"github.com/jslater89/graviton/units"
+	"github.com/labstack/echo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Comments sent to idle streams, so proxies don't time them out
+const streamKeepAlive = 30 * time.Second
+
+// StreamEvents sends live events as Server-Sent Events, each named for
+// its event type: reading.added, the batch.* and hydrometer.* lifecycle
+// events, and the alert events. Query parameters:
+//
+//	batch       a batch ID, or 'active' for every active batch; the
+//	            default if hydrometer is unset
+//	hydrometer  a hydrometer ID, or 'all' for every hydrometer
+//	units       as for GetBatch, for readings
+//
+// Events matching either filter are sent.
+func StreamEvents(c echo.Context) error {
+	batchParam := c.QueryParam("batch")
+	hydrometerParam := c.QueryParam("hydrometer")
+	if batchParam == "" && hydrometerParam == "" {
+		batchParam = "active"
+	}
+
+	// The route only requires a login; what's streamed depends on the
+	// query
+	if batchParam != "" && !auth.Allowed(c, auth.ActionRead, streamPath("/batches", batchParam, "active")) ||
+		hydrometerParam != "" && !auth.Allowed(c, auth.ActionRead, streamPath("/hydrometers", hydrometerParam, "all")) {
+		return c.JSON(403, bson.M{"error": "not authorized for resource"})
+	}
+
+	matchBatch, ok := streamFilter(batchParam, "active", func(e data.Event) bson.ObjectId { return e.BatchID })
+	if !ok {
+		return c.JSON(400, bson.M{"error": "bad batch id"})
+	}
+	matchHydrometer, ok := streamFilter(hydrometerParam, "all", func(e data.Event) bson.ObjectId { return e.HydrometerID })
+	if !ok {
+		return c.JSON(400, bson.M{"error": "bad hydrometer id"})
+	}
+
+	responseUnits, err := responseUnits(c)
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	subscription := data.Subscribe(func(e data.Event) bool {
+		return matchBatch(e) || matchHydrometer(e)
+	})
+	defer subscription.Close()
+
+	response := c.Response()
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(200)
+	response.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-subscription.Events:
+			err = writeStreamEvent(response, event, responseUnits)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(response, ": keep-alive\n\n")
+		case <-c.Request().Context().Done():
+			return nil
+		}
+
+		if err != nil {
+			return nil
+		}
+		response.Flush()
+	}
+}
+
+// streamPath is the path to authorize a stream subscription for: the
+// collection for a wildcard, or the one resource.
+func streamPath(collection string, param string, wildcard string) string {
+	if param == wildcard {
+		return collection
+	}
+	return collection + "/" + param
+}
+
+// streamFilter matches events whose ID, per id, is the one in param,
+// or any ID if param is wildcard. An empty param matches nothing. The
+// second return value is false if param is a bad ID.
+func streamFilter(param string, wildcard string, id func(data.Event) bson.ObjectId) (func(data.Event) bool, bool) {
+	switch {
+	case param == "":
+		return func(data.Event) bool { return false }, true
+	case param == wildcard:
+		return func(e data.Event) bool { return id(e) != "" }, true
+	case bson.IsObjectIdHex(param):
+		want := bson.ObjectIdHex(param)
+		return func(e data.Event) bool { return id(e) == want }, true
+	default:
+		return nil, false
+	}
+}
+
+func writeStreamEvent(response *echo.Response, event data.Event, u units.System) error {
+	if event.Reading != nil {
+		converted := convertReadingUnits(*event.Reading, u)
+		event.Reading = &converted
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(response, "event: %s\ndata: %s\n\n", event.Type, body)
+	return err
+}
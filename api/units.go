@@ -0,0 +1,199 @@
+package api
+
+import (
+	"time"
+
+	"github.com/jslater89/graviton/auth"
+	"github.com/jslater89/graviton/data"
+	"github.com/jslater89/graviton/units"
+	"github.com/labstack/echo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// responseUnits picks the units for a response: the units query
+// parameter (e.g. ?units=metric or ?units=brix,c), then the user's
+// preference, then the units readings are stored in.
+func responseUnits(c echo.Context) (units.System, error) {
+	spec := c.QueryParam("units")
+	if spec == "" {
+		spec = auth.RequestUnits(c)
+	}
+	return units.ParseSystem(spec)
+}
+
+// convertHydrometerReading converts a reading from a hydrometer to
+// the stored units, keeping what it reported as the raw reading.
+func convertHydrometerReading(r *HydrometerReading, date time.Time) (data.GravityReading, error) {
+	gravityUnits, err := units.ParseGravity(r.GravityUnits)
+	if err != nil {
+		return data.GravityReading{}, err
+	}
+
+	temperatureUnits, err := units.ParseTemperature(r.TemperatureUnits)
+	if err != nil {
+		return data.GravityReading{}, err
+	}
+
+	reading := data.GravityReading{
+		Temperature:    units.ToFahrenheit(r.Temperature, temperatureUnits),
+		BatteryVoltage: r.Battery,
+		Angle:          r.Angle,
+		Date:           date,
+		Hidden:         false,
+		ID:             bson.NewObjectId(),
+		Raw: &data.RawReading{
+			Gravity:          r.Gravity,
+			GravityUnits:     string(gravityUnits),
+			Temperature:      r.Temperature,
+			TemperatureUnits: string(temperatureUnits),
+			Angle:            r.Angle,
+		},
+	}
+
+	// Zero means no gravity, for readings with only an angle
+	if r.Gravity != 0 {
+		reading.Gravity = units.ToSG(r.Gravity, gravityUnits)
+	}
+
+	return reading, nil
+}
+
+func convertReadingUnits(r data.GravityReading, u units.System) data.GravityReading {
+	r.Gravity = units.FromSG(r.Gravity, u.Gravity)
+	if r.CorrectedGravity != 0 {
+		r.CorrectedGravity = units.FromSG(r.CorrectedGravity, u.Gravity)
+	}
+	r.Temperature = units.FromFahrenheit(r.Temperature, u.Temperature)
+	return r
+}
+
+// convertBatchUnits converts a batch's gravities and temperatures
+// from the stored units.
+func convertBatchUnits(b *Batch, u units.System) {
+	b.Units = u
+	convertHydrometerUnits(&b.Hydrometer, u)
+
+	if u == units.Canonical {
+		return
+	}
+
+	readings := []data.GravityReading{}
+	for _, r := range *b.GravityReadings {
+		readings = append(readings, convertReadingUnits(r, u))
+	}
+	b.GravityReadings = &readings
+
+	if b.LatestReading.ID != "" {
+		b.LatestReading = convertReadingUnits(b.LatestReading, u)
+	}
+	if b.OriginalGravity != 0 {
+		b.OriginalGravity = units.FromSG(b.OriginalGravity, u.Gravity)
+	}
+	if b.FinalGravity != 0 {
+		b.FinalGravity = units.FromSG(b.FinalGravity, u.Gravity)
+	}
+
+	b.AlertRules = convertAlertRulesUnits(b.AlertRules, u)
+}
+
+// Plato and Brix aren't linear in SG, so the stall threshold, a drop in
+// gravity, is converted at a gravity near the end of fermentation,
+// where stalls matter.
+const stallThresholdGravity = 1.010
+
+// convertAlertRulesUnits converts alert rules from the stored units.
+// Zero fields stay zero, since they mean the server default.
+func convertAlertRulesUnits(r AlertRules, u units.System) AlertRules {
+	if r.MinTemperature != 0 {
+		r.MinTemperature = units.FromFahrenheit(r.MinTemperature, u.Temperature)
+	}
+	if r.MaxTemperature != 0 {
+		r.MaxTemperature = units.FromFahrenheit(r.MaxTemperature, u.Temperature)
+	}
+	if r.StallThreshold != 0 {
+		r.StallThreshold = units.FromSG(stallThresholdGravity, u.Gravity) - units.FromSG(stallThresholdGravity-r.StallThreshold, u.Gravity)
+	}
+	return r
+}
+
+// convertAlertRulesParamUnits converts alert rules to the stored units;
+// see convertAlertRulesUnits.
+func convertAlertRulesParamUnits(r AlertRules, u units.System) AlertRules {
+	if r.MinTemperature != 0 {
+		r.MinTemperature = units.ToFahrenheit(r.MinTemperature, u.Temperature)
+	}
+	if r.MaxTemperature != 0 {
+		r.MaxTemperature = units.ToFahrenheit(r.MaxTemperature, u.Temperature)
+	}
+	if r.StallThreshold != 0 {
+		r.StallThreshold = stallThresholdGravity - units.ToSG(units.FromSG(stallThresholdGravity, u.Gravity)-r.StallThreshold, u.Gravity)
+	}
+	return r
+}
+
+// convertHydrometerUnits converts a hydrometer's calibration
+// temperature from the stored units.
+func convertHydrometerUnits(h *Hydrometer, u units.System) {
+	h.Units = u
+	h.CalibrationTemperature = units.FromFahrenheit(h.CalibrationTemperature, u.Temperature)
+}
+
+// convertCalibrationTemperature converts a calibration temperature
+// from a request to the stored units. Zero stays zero, since it means
+// the default.
+func convertCalibrationTemperature(t float64, u units.System) float64 {
+	if t == 0 {
+		return 0
+	}
+	return units.ToFahrenheit(t, u.Temperature)
+}
+
+func convertLightweightBatchUnits(b *LightweightBatch, u units.System) {
+	b.Units = u
+
+	if b.LatestReading.ID != "" {
+		b.LatestReading = convertReadingUnits(b.LatestReading, u)
+	}
+	if b.OriginalGravity != 0 {
+		b.OriginalGravity = units.FromSG(b.OriginalGravity, u.Gravity)
+	}
+	if b.FinalGravity != 0 {
+		b.FinalGravity = units.FromSG(b.FinalGravity, u.Gravity)
+	}
+}
+
+func convertReadingSeriesUnits(s *ReadingSeries, u units.System) {
+	s.Units = u
+
+	for i, r := range s.Readings {
+		s.Readings[i] = convertReadingUnits(r, u)
+	}
+
+	for i := range s.Buckets {
+		b := &s.Buckets[i]
+		b.MinGravity = units.FromSG(b.MinGravity, u.Gravity)
+		b.MaxGravity = units.FromSG(b.MaxGravity, u.Gravity)
+		b.MeanGravity = units.FromSG(b.MeanGravity, u.Gravity)
+		b.MinTemperature = units.FromFahrenheit(b.MinTemperature, u.Temperature)
+		b.MaxTemperature = units.FromFahrenheit(b.MaxTemperature, u.Temperature)
+		b.MeanTemperature = units.FromFahrenheit(b.MeanTemperature, u.Temperature)
+	}
+}
+
+func convertAnalyticsUnits(a *BatchAnalytics, u units.System) {
+	a.Units = u
+
+	if u.Gravity == units.SG || a.OriginalGravity == 0 {
+		return
+	}
+
+	// Plato and Brix aren't linear in SG, so rates are converted at
+	// the current gravity
+	for i := range a.Rates {
+		sgRate := a.Rates[i].GravityPerDay
+		a.Rates[i].GravityPerDay = units.FromSG(a.CurrentGravity+sgRate, u.Gravity) - units.FromSG(a.CurrentGravity, u.Gravity)
+	}
+
+	a.OriginalGravity = units.FromSG(a.OriginalGravity, u.Gravity)
+	a.CurrentGravity = units.FromSG(a.CurrentGravity, u.Gravity)
+}
@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/jslater89/graviton"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Built-in roles, made by verifyBaseRoles
+const (
+	viewerRole        = "Viewer"
+	editorRole        = "Editor"
+	administratorRole = "Administrator"
+)
+
+// adminPath authorizes user and role administration. Only the
+// Administrator role has it; other built-in roles deny it explicitly,
+// since they're granted "/".
+const adminPath = "/admin"
+
+type RoleParam struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// ListUsers lists every user with their roles.
+func ListUsers(c echo.Context) error {
+	users := []*User{}
+	err := db.userCollection.Find(nil).Sort("email").All(&users)
+
+	if err != nil {
+		graviton.Logger.Warn("User query failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	apiUsers := []*APIUser{}
+	for _, user := range users {
+		apiUser, err := convertDatabaseUser(user)
+		if err != nil {
+			graviton.Logger.Warn("Could not look up roles for user", zap.String("Email", user.Email), zap.Error(err))
+			return c.JSON(502, bson.M{"error": "database lookup error"})
+		}
+		apiUsers = append(apiUsers, apiUser)
+	}
+
+	return c.JSON(200, apiUsers)
+}
+
+// GrantRole gives the user :id the role :roleId.
+func GrantRole(c echo.Context) error {
+	return changeUserRole(c, true)
+}
+
+// RevokeRole takes the role :roleId from the user :id. The last
+// administrator can't be demoted.
+func RevokeRole(c echo.Context) error {
+	return changeUserRole(c, false)
+}
+
+func changeUserRole(c echo.Context, grant bool) error {
+	user := paramUser(c)
+	if user == nil {
+		return nil
+	}
+
+	role := paramRole(c, "roleId")
+	if role == nil {
+		return nil
+	}
+
+	if !grant && role.Name == administratorRole && hasRole(user, role.ID) {
+		n, err := db.userCollection.Find(bson.M{"roles": role.ID}).Count()
+
+		if err != nil {
+			graviton.Logger.Warn("User query failed", zap.Error(err))
+			return c.JSON(502, bson.M{"error": "database query failed"})
+		}
+		if n <= 1 {
+			return c.JSON(409, bson.M{"error": "can't revoke the last administrator"})
+		}
+	}
+
+	roles := []bson.ObjectId{}
+	for _, id := range user.Roles {
+		if id != role.ID {
+			roles = append(roles, id)
+		}
+	}
+	if grant {
+		roles = append(roles, role.ID)
+	}
+	user.Roles = roles
+
+	err := saveUserRoles(user)
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to save user roles", zap.String("Email", user.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to save roles"})
+	}
+
+	graviton.Logger.Info("Changed user roles",
+		zap.String("Email", user.Email),
+		zap.String("Role", role.Name),
+		zap.Bool("Granted", grant),
+		zap.String("By", RequestUser(c)))
+
+	apiUser, err := convertDatabaseUser(user)
+
+	if err != nil {
+		graviton.Logger.Warn("Could not look up roles for user", zap.String("Email", user.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database lookup error"})
+	}
+
+	return c.JSON(200, apiUser)
+}
+
+func ListRoles(c echo.Context) error {
+	roles := []*Role{}
+	err := db.roleCollection.Find(nil).Sort("name").All(&roles)
+
+	if err != nil {
+		graviton.Logger.Warn("Role query failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	return c.JSON(200, roles)
+}
+
+// NewRole creates a custom role; takes a RoleParam.
+func NewRole(c echo.Context) error {
+	param := bindRoleParam(c)
+	if param == nil {
+		return nil
+	}
+
+	role := &Role{
+		ID:          bson.NewObjectId(),
+		Name:        param.Name,
+		Permissions: param.Permissions,
+	}
+
+	err := db.roleCollection.Insert(role)
+
+	if mgo.IsDup(err) {
+		return c.JSON(409, bson.M{"error": "role name already in use"})
+	} else if err != nil {
+		graviton.Logger.Warn("Unable to save role", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to save role"})
+	}
+
+	return c.JSON(200, role)
+}
+
+// EditRole replaces a role's name and permissions; takes a RoleParam.
+// Built-in roles can't be renamed, and Administrator can't be changed.
+func EditRole(c echo.Context) error {
+	role := paramRole(c, "id")
+	if role == nil {
+		return nil
+	}
+
+	param := bindRoleParam(c)
+	if param == nil {
+		return nil
+	}
+
+	if role.Name == administratorRole || isBaseRole(role.Name) && param.Name != role.Name {
+		return c.JSON(400, bson.M{"error": "can't change built-in role " + role.Name})
+	}
+
+	role.Name = param.Name
+	role.Permissions = param.Permissions
+
+	err := db.roleCollection.UpdateId(role.ID, role)
+
+	if mgo.IsDup(err) {
+		return c.JSON(409, bson.M{"error": "role name already in use"})
+	} else if err != nil {
+		graviton.Logger.Warn("Unable to save role", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to save role"})
+	}
+
+	return c.JSON(200, role)
+}
+
+// DeleteRole deletes a custom role, taking it from every user who has
+// it.
+func DeleteRole(c echo.Context) error {
+	role := paramRole(c, "id")
+	if role == nil {
+		return nil
+	}
+
+	if isBaseRole(role.Name) {
+		return c.JSON(400, bson.M{"error": "can't delete built-in role " + role.Name})
+	}
+
+	_, err := db.userCollection.UpdateAll(bson.M{"roles": role.ID}, bson.M{"$pull": bson.M{"roles": role.ID}})
+
+	if err == nil {
+		_, err = db.sessionCollection.UpdateAll(bson.M{"user.roles": role.ID}, bson.M{"$pull": bson.M{"user.roles": role.ID}})
+	}
+	if err == nil {
+		err = db.roleCollection.RemoveId(role.ID)
+	}
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to delete role", zap.String("Role", role.Name), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to delete role"})
+	}
+
+	return c.JSON(200, bson.M{"status": "ok"})
+}
+
+// bindRoleParam reads and checks a RoleParam. If it's bad, it makes an
+// appropriate response with the context and returns nil.
+func bindRoleParam(c echo.Context) *RoleParam {
+	param := &RoleParam{}
+	err := c.Bind(param)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		c.JSON(400, bson.M{"error": "invalid input"})
+		return nil
+	}
+
+	param.Name = strings.TrimSpace(param.Name)
+	if param.Name == "" {
+		c.JSON(400, bson.M{"error": "role needs a name"})
+		return nil
+	}
+
+	if param.Permissions == nil {
+		param.Permissions = []Permission{}
+	}
+	for _, permission := range param.Permissions {
+		if !strings.HasPrefix(permission.Path, "/") {
+			c.JSON(400, bson.M{"error": "permission paths must start with /"})
+			return nil
+		}
+
+		for _, action := range permission.Actions {
+			if _, err := ParseAction(string(action)); err != nil {
+				c.JSON(400, bson.M{"error": err.Error()})
+				return nil
+			}
+		}
+	}
+
+	return param
+}
+
+// paramUser loads the user named by the :id route parameter. If there
+// isn't one, it makes an appropriate response with the context and
+// returns nil.
+func paramUser(c echo.Context) *User {
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		c.JSON(400, bson.M{"error": "bad object id"})
+		return nil
+	}
+
+	user, err := getUser(bson.ObjectIdHex(id))
+
+	if err == mgo.ErrNotFound {
+		c.JSON(404, bson.M{"error": "user not found"})
+		return nil
+	} else if err != nil {
+		graviton.Logger.Error("Failed to query user", zap.String("id", id), zap.Error(err))
+		c.JSON(502, bson.M{"error": "database query failed"})
+		return nil
+	}
+
+	return user
+}
+
+// paramRole loads the role named by the given route parameter, like
+// paramUser.
+func paramRole(c echo.Context, name string) *Role {
+	id := c.Param(name)
+
+	if !bson.IsObjectIdHex(id) {
+		c.JSON(400, bson.M{"error": "bad object id"})
+		return nil
+	}
+
+	role := &Role{}
+	err := db.roleCollection.FindId(bson.ObjectIdHex(id)).One(role)
+
+	if err == mgo.ErrNotFound {
+		c.JSON(404, bson.M{"error": "role not found"})
+		return nil
+	} else if err != nil {
+		graviton.Logger.Error("Failed to query role", zap.String("id", id), zap.Error(err))
+		c.JSON(502, bson.M{"error": "database query failed"})
+		return nil
+	}
+
+	return role
+}
+
+func isBaseRole(name string) bool {
+	return name == viewerRole || name == editorRole || name == administratorRole
+}
+
+func hasRole(user *User, roleID bson.ObjectId) bool {
+	for _, id := range user.Roles {
+		if id == roleID {
+			return true
+		}
+	}
+	return false
+}
+
+// saveUserRoles stores user's roles, in the users collection and the
+// copies sessions carry.
+func saveUserRoles(user *User) error {
+	err := db.userCollection.UpdateId(user.ID, bson.M{"$set": bson.M{"roles": user.Roles}})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.sessionCollection.UpdateAll(bson.M{"user._id": user.ID}, bson.M{"$set": bson.M{"user.roles": user.Roles}})
+	return err
+}
@@ -6,14 +6,22 @@ import (
 
 	"github.com/jslater89/graviton"
 	"github.com/jslater89/graviton/config"
+	"github.com/jslater89/graviton/units"
 	"go.uber.org/zap"
 
 	"github.com/labstack/echo"
+	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 	"gopkg.in/mgo.v2/bson"
 )
 
-func GoogleAuthLogin(c echo.Context) error {
+// OAuthLogin sends the user to log in at :provider, unless they're
+// already logged in.
+func OAuthLogin(c echo.Context) error {
+	if !paramProvider(c) {
+		return nil
+	}
+
 	// try to get the user without re-authenticating
 	if token := extractBearer(c); token != "" {
 		session, err := getSession(token)
@@ -25,16 +33,43 @@ func GoogleAuthLogin(c echo.Context) error {
 
 	gothic.BeginAuthHandler(c.Response(), c.Request())
 
-	return c.JSON(200, bson.M{"status": "ok"})
+	return nil
+}
+
+// OAuthLink sends the logged-in user to log in at :provider, to link
+// that identity to them.
+func OAuthLink(c echo.Context) error {
+	if !paramProvider(c) {
+		return nil
+	}
+
+	c.SetCookie(getLinkCookie(c.Param("provider"), 10*time.Minute))
+	gothic.BeginAuthHandler(c.Response(), c.Request())
+
+	return nil
 }
 
-func GoogleAuthCallback(c echo.Context) error {
+// OAuthCallback finishes a login or link at :provider.
+func OAuthCallback(c echo.Context) error {
+	if !paramProvider(c) {
+		return nil
+	}
+
 	user, err := gothic.CompleteUserAuth(c.Response(), c.Request())
 	if err != nil {
 		graviton.Logger.Error("OAuth callback returned error", zap.Error(err))
 		return c.JSON(502, bson.M{"error": err.Error()})
 	}
 
+	if cookie, err := c.Cookie(linkCookieName); err == nil && cookie.Value == c.Param("provider") {
+		c.SetCookie(getLinkCookie("", -time.Second))
+		return finishLink(c, user)
+	}
+
+	if err := checkProviderLogin(user); err == errEmailUnverified {
+		return c.JSON(403, bson.M{"error": err.Error()})
+	}
+
 	sessionID := HandleUser(c, user)
 
 	if sessionID == graviton.EmptyID() {
@@ -44,24 +79,84 @@ func GoogleAuthCallback(c echo.Context) error {
 	return c.Redirect(307, config.GetConfig().RedirectAddress+"?bearer="+sessionID.Hex())
 }
 
+// finishLink links a provider login to the user whose session the
+// request carries.
+func finishLink(c echo.Context, user goth.User) error {
+	session, err := getSession(extractBearer(c))
+
+	if err != nil || !checkSessionExpiration(session) {
+		return c.JSON(401, bson.M{"error": "not logged in"})
+	}
+
+	err = linkIdentity(&session.User, user)
+
+	if err == errIdentityLinked {
+		return c.JSON(409, bson.M{"error": err.Error()})
+	} else if err != nil {
+		graviton.Logger.Warn("Unable to link identity", zap.String("Email", session.User.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to link identity"})
+	}
+
+	return c.Redirect(307, config.GetConfig().RedirectAddress+"?bearer="+session.Token)
+}
+
 func GetSelf(c echo.Context) error {
-	token := extractBearer(c)
+	session := RequestPrincipal(c).Session
 
-	if token == "" || !bson.IsObjectIdHex(token) {
-		graviton.Logger.Warn("Invalid auth token", zap.String("Token", token), zap.Bool("IsObjectId", bson.IsObjectIdHex(token)))
-		return c.JSON(400, bson.M{"error": "invalid token"})
+	if session == nil {
+		return c.JSON(400, bson.M{"error": "not a user session"})
 	}
 
-	session, err := getSession(token)
+	user, err := convertDatabaseUser(&session.User)
 
 	if err != nil {
-		return c.JSON(400, bson.M{"error": "invalid session"})
+		graviton.Logger.Warn("Could not look up roles for user", zap.String("Email", user.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database lookup error"})
 	}
 
+	return c.JSON(200, user)
+}
+
+// SetUnits sets the units the logged-in user's API responses use
+// when a request doesn't ask for particular units.
+func SetUnits(c echo.Context) error {
+	session := RequestPrincipal(c).Session
+
+	if session == nil {
+		return c.JSON(400, bson.M{"error": "not a user session"})
+	}
+
+	param := &UnitsParam{}
+	err := c.Bind(param)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	_, err = units.ParseSystem(param.Units)
+
+	if err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	err = db.userCollection.UpdateId(session.User.ID, bson.M{"$set": bson.M{"units": param.Units}})
+
+	if err == nil {
+		// Sessions carry a copy of the user
+		_, err = db.sessionCollection.UpdateAll(bson.M{"user._id": session.User.ID}, bson.M{"$set": bson.M{"user.units": param.Units}})
+	}
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to save unit preference", zap.String("Email", session.User.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to save preference"})
+	}
+
+	session.User.Units = param.Units
 	user, err := convertDatabaseUser(&session.User)
 
 	if err != nil {
-		graviton.Logger.Warn("Could not look up roles for user", zap.String("Email", user.Email), zap.Error(err))
+		graviton.Logger.Warn("Could not look up roles for user", zap.String("Email", session.User.Email), zap.Error(err))
 		return c.JSON(502, bson.M{"error": "database lookup error"})
 	}
 
@@ -69,7 +164,13 @@ func GetSelf(c echo.Context) error {
 }
 
 func Logout(c echo.Context) error {
-	token := extractBearer(c)
+	session := RequestPrincipal(c).Session
+
+	if session == nil {
+		return c.JSON(400, bson.M{"error": "not a user session"})
+	}
+
+	token := session.Token
 	err := deleteSession(token)
 
 	if err != nil {
@@ -81,6 +182,20 @@ func Logout(c echo.Context) error {
 	return c.JSON(200, bson.M{"status": "ok"})
 }
 
+// The cookie marking a provider login as a link, with the provider's
+// name
+const linkCookieName = "graviton_link"
+
+func getLinkCookie(provider string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     linkCookieName,
+		Value:    provider,
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Path:     "/api/v1/auth/",
+	}
+}
+
 func getCookie(token string) *http.Cookie {
 	return &http.Cookie{
 		Name:    "graviton_bearer",
@@ -1,7 +1,11 @@
 package auth
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -71,7 +75,7 @@ func TestHandleUser(t *testing.T) {
 
 	t.Logf("Session: %v", sess)
 
-	if !IsAuthorized(c, "/") {
+	if !authorize(c, Allow("/")) {
 		t.Errorf("User can't write")
 	}
 
@@ -79,7 +83,7 @@ func TestHandleUser(t *testing.T) {
 	req.AddCookie(getCookie("abcdefabcdefabcdefabcdef"))
 	c = e.NewContext(req, rec)
 
-	if !IsAuthorized(c, "/") {
+	if !authorize(c, Allow("/")) {
 		t.Errorf("User can't read")
 	}
 
@@ -95,16 +99,710 @@ func TestAuthorizeAPIKey(t *testing.T) {
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
 
-	if !IsAuthorized(c, "/arbitrary/path") {
+	if !authorize(c, Devices("/reading")) {
 		t.Errorf("API key auth not successful")
 	}
 
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer "+getOrCreateAPIKey(false))
+	c = e.NewContext(req, httptest.NewRecorder())
+
+	if authorize(c, Allow("/arbitrary/path")) {
+		t.Errorf("API key authorized outside reading ingestion")
+	}
+
 	db.mongoDB.DropDatabase()
 }
 
+func TestDeviceTokens(t *testing.T) {
+	generateTestData()
+
+	blueHydrometer, greenHydrometer, _, _ := data.GetTestObjects()
+
+	e := echo.New()
+	req := httptest.NewRequest(echo.POST, "/", strings.NewReader("{}"))
+	c := e.NewContext(req, httptest.NewRecorder())
+	sessionID := HandleUser(c, goth.User{
+		Email:     "testuser@mail.com",
+		ExpiresAt: time.Now().Add(30 * time.Second),
+	})
+
+	// Issue a token for the blue hydrometer
+	req = httptest.NewRequest(echo.POST, "/api/v1/hydrometers/:id/tokens", strings.NewReader(`{"name": "blue"}`))
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(blueHydrometer.ID.Hex())
+
+	err := authorized(Allow("/hydrometers/:id/tokens"), IssueDeviceToken)(c)
+
+	if err != nil || rec.Code != 200 {
+		t.Errorf("Request failed with code %d %v\n", rec.Code, err)
+	}
+
+	issued := &APIDeviceToken{}
+	json.NewDecoder(rec.Body).Decode(issued)
+
+	if issued.Token == "" || issued.HydrometerID != blueHydrometer.ID {
+		t.Errorf("Token not issued correctly: %v", issued)
+	}
+
+	stored := &DeviceToken{}
+	db.deviceTokenCollection.FindId(issued.ID).One(stored)
+
+	if stored.Hash == "" || stored.Hash == issued.Token {
+		t.Errorf("Token not stored hashed")
+	}
+
+	// The token can post readings for its own hydrometer only
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer "+issued.Token)
+	c = e.NewContext(req, httptest.NewRecorder())
+
+	if !authorize(c, Devices("/reading")) || !CanPostReadings(c, blueHydrometer.ID) {
+		t.Errorf("Device token not authorized for its hydrometer")
+	}
+
+	if CanPostReadings(c, greenHydrometer.ID) {
+		t.Errorf("Device token authorized for another hydrometer")
+	}
+
+	db.deviceTokenCollection.FindId(issued.ID).One(stored)
+
+	if stored.LastUsed.IsZero() {
+		t.Errorf("Token use not recorded")
+	}
+
+	req = httptest.NewRequest(echo.GET, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+issued.Token)
+	c = e.NewContext(req, httptest.NewRecorder())
+
+	if authorize(c, Allow("/batches")) {
+		t.Errorf("Device token authorized outside reading ingestion")
+	}
+
+	// Revoked tokens stop working
+	req = httptest.NewRequest(echo.DELETE, "/api/v1/hydrometers/:id/tokens/:tokenId", nil)
+	req.Header.Set("Authorization", "Bearer "+sessionID.Hex())
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id", "tokenId")
+	c.SetParamValues(blueHydrometer.ID.Hex(), issued.ID.Hex())
+
+	err = authorized(Allow("/hydrometers/:id/tokens"), RevokeDeviceToken)(c)
+
+	if err != nil || rec.Code != 200 {
+		t.Errorf("Request failed with code %d %v\n", rec.Code, err)
+	}
+
+	req = httptest.NewRequest(echo.POST, "/", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer "+issued.Token)
+	c = e.NewContext(req, httptest.NewRecorder())
+
+	if authorize(c, Devices("/reading")) {
+		t.Errorf("Revoked token still authorized")
+	}
+
+	cleanupTestData()
+}
+
+func TestRoleAdministration(t *testing.T) {
+	generateTestData()
+
+	e := echo.New()
+	login := func(email string) string {
+		c := e.NewContext(httptest.NewRequest(echo.POST, "/", nil), httptest.NewRecorder())
+		return HandleUser(c, goth.User{Email: email, ExpiresAt: time.Now().Add(30 * time.Second)}).Hex()
+	}
+	request := func(handler echo.HandlerFunc, method string, session string, body string, params ...string) *httptest.ResponseRecorder {
+		handler = authorized(Allow(adminPath), handler)
+		req := httptest.NewRequest(method, "/", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+session)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		names, values := []string{}, []string{}
+		for i := 0; i < len(params); i += 2 {
+			names = append(names, params[i])
+			values = append(values, params[i+1])
+		}
+		c.SetParamNames(names...)
+		c.SetParamValues(values...)
+		handler(c)
+		return rec
+	}
+
+	// The first user is an administrator
+	admin := login("admin@mail.com")
+	brewer := login("brewer@mail.com")
+
+	rec := request(ListUsers, echo.GET, admin, "")
+	users := []*APIUser{}
+	json.NewDecoder(rec.Body).Decode(&users)
+
+	if rec.Code != 200 || len(users) != 2 {
+		t.Fatalf("Administrator couldn't list users: %d %v", rec.Code, users)
+	}
+
+	if rec = request(ListUsers, echo.GET, brewer, ""); rec.Code != 403 {
+		t.Errorf("Non-administrator listed users: %d", rec.Code)
+	}
+
+	var brewerID, adminID bson.ObjectId
+	for _, user := range users {
+		if user.Email == "brewer@mail.com" {
+			brewerID = user.ID
+		} else {
+			adminID = user.ID
+		}
+	}
+
+	rec = request(NewRole, echo.POST, admin, `{"name": "Cellar", "permissions": [{"path": "/batches", "canRead": true, "canWrite": true}]}`)
+	cellar := &Role{}
+	json.NewDecoder(rec.Body).Decode(cellar)
+
+	if rec.Code != 200 || cellar.Name != "Cellar" {
+		t.Fatalf("Unable to create role: %d", rec.Code)
+	}
+
+	canEditBatches := func() bool {
+		req := httptest.NewRequest(echo.PUT, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+brewer)
+		return authorize(e.NewContext(req, httptest.NewRecorder()), Allow("/batches"))
+	}
+
+	if canEditBatches() {
+		t.Errorf("Viewer can edit batches")
+	}
+
+	rec = request(GrantRole, echo.PUT, admin, "", "id", brewerID.Hex(), "roleId", cellar.ID.Hex())
+	if rec.Code != 200 || !canEditBatches() {
+		t.Errorf("Granted role not in effect: %d", rec.Code)
+	}
+
+	administrator, _ := getRole(administratorRole)
+	rec = request(RevokeRole, echo.DELETE, admin, "", "id", adminID.Hex(), "roleId", administrator.ID.Hex())
+	if rec.Code != 409 {
+		t.Errorf("Demoted the last administrator: %d", rec.Code)
+	}
+
+	rec = request(DeleteRole, echo.DELETE, admin, "", "id", administrator.ID.Hex())
+	if rec.Code != 400 {
+		t.Errorf("Deleted a built-in role: %d", rec.Code)
+	}
+
+	rec = request(DeleteRole, echo.DELETE, admin, "", "id", cellar.ID.Hex())
+	if rec.Code != 200 || canEditBatches() {
+		t.Errorf("Deleted role still in effect: %d", rec.Code)
+	}
+
+	cleanupTestData()
+}
+
+func TestRouterFailsClosed(t *testing.T) {
+	graviton.InitTest()
+
+	e := echo.New()
+	router := NewRouter(e)
+	e.Use(router.Authorize)
+
+	ok := func(c echo.Context) error {
+		return c.JSON(200, bson.M{"status": "ok"})
+	}
+	router.GET("/public", ok, Public())
+	e.GET("/undeclared", ok)
+
+	cases := []struct {
+		path string
+		code int
+	}{
+		{"/public", 200},
+		{"/undeclared", 403},
+		{"/nonexistent", 404},
+	}
+
+	for _, test := range cases {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(echo.GET, test.path, nil))
+
+		if rec.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.path, test.code, rec.Code)
+		}
+	}
+}
+
+func TestLocalAccounts(t *testing.T) {
+	generateTestData()
+
+	e := echo.New()
+	request := func(handler echo.HandlerFunc, policy Policy, session string, body string, params ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.POST, "/", strings.NewReader(body))
+		if session != "" {
+			req.Header.Set("Authorization", "Bearer "+session)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if len(params) > 0 {
+			c.SetParamNames(params[0])
+			c.SetParamValues(params[1])
+		}
+		if !policy.Public {
+			handler = authorized(policy, handler)
+		}
+		handler(c)
+		return rec
+	}
+	login := func(email string, password string) string {
+		rec := request(LocalLogin, Public(), "", `{"email": "`+email+`", "password": "`+password+`"}`)
+		response := map[string]string{}
+		json.NewDecoder(rec.Body).Decode(&response)
+		return response["bearer"]
+	}
+
+	// With OAuth off, the configured administrator gets a reset token
+	// at startup; they're the first user
+	config.OverrideAdminEmail("admin@mail.com")
+	config.OverrideOAuthEnabled(false)
+	defer config.OverrideAdminEmail("")
+	defer config.OverrideOAuthEnabled(true)
+
+	err := bootstrapLocalAdmin()
+	if err != nil {
+		t.Fatalf("Unable to bootstrap administrator: %v", err)
+	}
+
+	adminUser := &User{}
+	db.userCollection.Find(bson.M{"email": "admin@mail.com"}).One(adminUser)
+	token, _, _ := newResetToken(adminUser.ID)
+
+	if rec := request(ResetPassword, Public(), "", `{"token": "`+token+`", "password": "short"}`); rec.Code != 400 {
+		t.Errorf("Short password accepted: %d", rec.Code)
+	}
+	if rec := request(ResetPassword, Public(), "", `{"token": "`+token+`", "password": "hunter2hunter2"}`); rec.Code != 200 {
+		t.Fatalf("Unable to reset password: %d", rec.Code)
+	}
+	if rec := request(ResetPassword, Public(), "", `{"token": "`+token+`", "password": "hunter3hunter3"}`); rec.Code != 403 {
+		t.Errorf("Reset token used twice: %d", rec.Code)
+	}
+
+	credential, _ := getCredential(adminUser.ID)
+	if credential == nil || credential.Hash == "" || credential.Hash == "hunter2hunter2" {
+		t.Errorf("Password not stored hashed: %v", credential)
+	}
+
+	if login("admin@mail.com", "wrongpassword") != "" || login("nobody@mail.com", "hunter2hunter2") != "" {
+		t.Errorf("Logged in with bad credentials")
+	}
+
+	admin := login("admin@mail.com", "hunter2hunter2")
+	if admin == "" {
+		t.Fatalf("Administrator couldn't log in")
+	}
+
+	// Administrators create users, who set their passwords with the
+	// reset token they're given
+	rec := request(NewLocalUser, Allow(adminPath), admin, `{"email": "brewer@mail.com"}`)
+	reset := &APIPasswordReset{}
+	json.NewDecoder(rec.Body).Decode(reset)
+
+	if rec.Code != 200 || reset.Token == "" || reset.User.Email != "brewer@mail.com" {
+		t.Fatalf("Unable to create user: %d %v", rec.Code, reset)
+	}
+
+	if rec = request(NewLocalUser, Allow(adminPath), admin, `{"email": "brewer@mail.com"}`); rec.Code != 409 {
+		t.Errorf("Created a duplicate user: %d", rec.Code)
+	}
+
+	request(ResetPassword, Public(), "", `{"token": "`+reset.Token+`", "password": "mashtun123"}`)
+	brewer := login("brewer@mail.com", "mashtun123")
+
+	if brewer == "" {
+		t.Fatalf("New user couldn't log in")
+	}
+
+	if rec = request(IssuePasswordReset, Allow(adminPath), brewer, "", "id", reset.User.ID.Hex()); rec.Code != 403 {
+		t.Errorf("Non-administrator issued a reset: %d", rec.Code)
+	}
+
+	// Changing a password needs the current one, and ends other sessions
+	otherSession := login("brewer@mail.com", "mashtun123")
+
+	if rec = request(ChangePassword, LoggedIn(), brewer, `{"current": "wrong", "password": "lautertun123"}`); rec.Code != 403 {
+		t.Errorf("Changed password without the current one: %d", rec.Code)
+	}
+	if rec = request(ChangePassword, LoggedIn(), brewer, `{"current": "mashtun123", "password": "lautertun123"}`); rec.Code != 200 {
+		t.Errorf("Unable to change password: %d", rec.Code)
+	}
+
+	if _, err := getSession(otherSession); err == nil {
+		t.Errorf("Other session survived a password change")
+	}
+	if _, err := getSession(brewer); err != nil {
+		t.Errorf("Current session ended by a password change")
+	}
+	if login("brewer@mail.com", "mashtun123") != "" || login("brewer@mail.com", "lautertun123") == "" {
+		t.Errorf("Password change not in effect")
+	}
+
+	// A first password needs a fresh provider login, not just a session
+	oauthUser, _ := getOrCreateUser("oauth@mail.com")
+	providerSession := Session{
+		User:      *oauthUser,
+		UserInfo:  goth.User{Provider: "github", Email: oauthUser.Email},
+		Token:     bson.NewObjectId().Hex(),
+		CreatedAt: time.Now().Add(-time.Hour),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	saveSession(providerSession)
+
+	if rec = request(ChangePassword, LoggedIn(), providerSession.Token, `{"password": "fermenter123"}`); rec.Code != 403 {
+		t.Errorf("Set a first password from an old session: %d", rec.Code)
+	}
+
+	providerSession.Token = bson.NewObjectId().Hex()
+	providerSession.CreatedAt = time.Now()
+	saveSession(providerSession)
+
+	if rec = request(ChangePassword, LoggedIn(), providerSession.Token, `{"password": "fermenter123"}`); rec.Code != 200 {
+		t.Errorf("Unable to set a first password after logging in: %d", rec.Code)
+	}
+
+	cleanupTestData()
+}
+
+func TestProviderRegistry(t *testing.T) {
+	graviton.InitTest()
+
+	issuer := newFakeIssuer("graviton")
+	defer issuer.Close()
+
+	oidc := config.OAuthProvider{Name: "brewery", Type: "oidc", ClientID: "graviton", DiscoveryURL: issuer.URL + "/.well-known/openid-configuration"}
+	github := config.OAuthProvider{Type: "github", ClientID: "id"}
+
+	// The deprecated Google settings make a provider named google,
+	// unless one is configured
+	configured := configuredProviders(config.Config{GoogleClientID: "id", OAuthProviders: []config.OAuthProvider{oidc, github}})
+
+	if len(configured) != 3 || configured[1].Name != "github" || configured[2].Name != "google" {
+		t.Errorf("Wrong providers configured: %v", configured)
+	}
+
+	err := registerProviders(configured)
+	if err != nil {
+		t.Fatalf("Unable to register providers: %v", err)
+	}
+
+	provider, err := goth.GetProvider("brewery")
+	if err != nil {
+		t.Fatalf("OIDC provider not registered: %v", err)
+	}
+
+	session, _ := provider.BeginAuth("state")
+	authURL, _ := session.GetAuthURL()
+
+	if !strings.HasPrefix(authURL, issuer.URL+"/authorize") || !strings.Contains(authURL, "brewery%2Fcallback") {
+		t.Errorf("Auth URL not from discovery: %s", authURL)
+	}
+
+	if len(providers) != 3 {
+		t.Errorf("Wrong providers listed: %v", providers)
+	}
+
+	req := httptest.NewRequest(echo.GET, "/api/v1/auth/github/callback", nil)
+	if name, err := providerName(req); name != "github" || err != nil {
+		t.Errorf("Wrong provider for path: %s %v", name, err)
+	}
+
+	// Bad configuration is an error; unreachable issuers are left out
+	bad := []config.OAuthProvider{
+		{Name: "local", Type: "github", ClientID: "id"},
+		{Name: "mastodon", Type: "mastodon", ClientID: "id"},
+		{Name: "oidc", Type: "oidc", ClientID: "id"},
+		{Name: "Brewery", Type: "github", ClientID: "id"},
+	}
+
+	for _, provider := range bad {
+		if err := registerProviders([]config.OAuthProvider{provider}); err == nil {
+			t.Errorf("Bad provider %v registered", provider)
+		}
+	}
+
+	if err := registerProviders([]config.OAuthProvider{github, github}); err == nil {
+		t.Errorf("Duplicate providers registered")
+	}
+
+	unreachable := oidc
+	unreachable.DiscoveryURL = "http://127.0.0.1:1/.well-known/openid-configuration"
+	err = registerProviders([]config.OAuthProvider{unreachable, github})
+
+	if err != nil || len(providers) != 1 || providers[0].Name != "github" {
+		t.Errorf("Unreachable issuer not left out: %v %v", err, providers)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	brewery := newFakeIssuer("graviton")
+	defer brewery.Close()
+	other := newFakeIssuer("graviton")
+	defer other.Close()
+
+	graviton.InitTest()
+	config.OverrideOAuthProviders([]config.OAuthProvider{
+		{Name: "brewery", Type: "oidc", ClientID: "graviton", DiscoveryURL: brewery.URL + "/.well-known/openid-configuration"},
+		{Name: "other", Type: "oidc", ClientID: "graviton", DiscoveryURL: other.URL + "/.well-known/openid-configuration"},
+	})
+	defer config.OverrideOAuthProviders(nil)
+	generateTestData()
+
+	e := echo.New()
+	serve := func(handler echo.HandlerFunc, target string, provider string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.GET, target, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("provider")
+		c.SetParamValues(provider)
+		handler(c)
+		return rec
+	}
+	// login goes through start, the issuer and the callback, returning
+	// the bearer token and the callback's response
+	login := func(start echo.HandlerFunc, provider string, cookies ...*http.Cookie) (string, *httptest.ResponseRecorder) {
+		rec := serve(start, "/api/v1/auth/"+provider+"/login", provider, cookies)
+		if rec.Code != 307 {
+			t.Fatalf("Login not redirected: %d %s", rec.Code, rec.Body.String())
+		}
+
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		response, err := client.Get(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("Issuer request failed: %v", err)
+		}
+		response.Body.Close()
+
+		callback, _ := url.Parse(response.Header.Get("Location"))
+		rec = serve(OAuthCallback, callback.RequestURI(), provider, append(cookies, rec.Result().Cookies()...))
+
+		location, _ := url.Parse(rec.Header().Get("Location"))
+		return location.Query().Get("bearer"), rec
+	}
+	identities := func(bearer string) []*Identity {
+		rec := serve(authorized(LoggedIn(), ListIdentities), "/", "", []*http.Cookie{getCookie(bearer)})
+		list := []*Identity{}
+		json.NewDecoder(rec.Body).Decode(&list)
+		return list
+	}
+
+	// The first login makes a user, with the identity linked
+	brewery.subject, brewery.email = "brewer-1", "brewer@mail.com"
+	bearer, rec := login(OAuthLogin, "brewery")
+
+	if bearer == "" {
+		t.Fatalf("OIDC login failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	session, _ := getSession(bearer)
+	if session.User.Email != "brewer@mail.com" || len(identities(bearer)) != 1 {
+		t.Errorf("User or identity not made: %v", session.User)
+	}
+
+	// Later logins find the user by identity, whatever the email
+	brewery.email = "brewer@example.com"
+	bearer, _ = login(OAuthLogin, "brewery")
+	again, _ := getSession(bearer)
+
+	if again.User.ID != session.User.ID {
+		t.Errorf("Identity login found a different user")
+	}
+
+	// Logged-in users can link identities at other providers
+	other.subject, other.email = "brewer-2", "someone-else@mail.com"
+	_, rec = login(authorized(LoggedIn(), OAuthLink), "other", getCookie(bearer))
+
+	if rec.Code != 307 || len(identities(bearer)) != 2 {
+		t.Errorf("Identity not linked: %d %s", rec.Code, rec.Body.String())
+	}
+
+	if n, _ := db.userCollection.Find(bson.M{"email": "someone-else@mail.com"}).Count(); n != 0 {
+		t.Errorf("Linking made a user")
+	}
+
+	// Identities linked to one user can't be linked to another
+	other.subject, other.email = "stranger", "stranger@mail.com"
+	stranger, _ := login(OAuthLogin, "other")
+	brewery.subject = "brewer-1"
+	_, rec = login(authorized(LoggedIn(), OAuthLink), "brewery", getCookie(stranger))
+
+	if rec.Code != 409 {
+		t.Errorf("Linked another user's identity: %d", rec.Code)
+	}
+
+	// Logins whose email isn't verified aren't matched to its user; it
+	// has to be linked from a logged-in session
+	other.subject, other.email, other.unverified = "impostor", "brewer@mail.com", true
+	impostor, rec := login(OAuthLogin, "other")
+
+	if impostor != "" || rec.Code != 403 {
+		t.Errorf("Unverified email matched its user: %d %s", rec.Code, rec.Body.String())
+	}
+	if n, _ := db.identityCollection.Find(bson.M{"subject": "impostor"}).Count(); n != 0 {
+		t.Errorf("Unverified identity linked")
+	}
+	other.unverified = false
+
+	// Unlinking leaves at least one way to log in
+	linked := identities(bearer)
+	unlink := func(bearer string, identity *Identity) int {
+		req := httptest.NewRequest(echo.DELETE, "/", nil)
+		req.AddCookie(getCookie(bearer))
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(identity.ID.Hex())
+		authorized(LoggedIn(), UnlinkIdentity)(c)
+		return rec.Code
+	}
+
+	if code := unlink(bearer, linked[1]); code != 200 {
+		t.Errorf("Unable to unlink identity: %d", code)
+	}
+	if code := unlink(bearer, linked[0]); code != 409 {
+		t.Errorf("Unlinked the only way to log in: %d", code)
+	}
+
+	cleanupTestData()
+}
+
+func TestPermissions(t *testing.T) {
+	editor := &Role{Name: "Editor", Permissions: []Permission{
+		{Path: "/", CanRead: true, CanWrite: true},
+		{Path: "/batches/{id}", Actions: []Action{ActionArchive}, Deny: true},
+	}}
+	cellar := &Role{Name: "Cellar", Permissions: []Permission{
+		{Path: "/", CanRead: true},
+		{Path: "/batches/{id}/readings", Actions: []Action{ActionRead, ActionDelete}},
+		{Path: "/hydrometers/5a0000000000000000000001", CanRead: true, CanWrite: true},
+	}}
+
+	cases := []struct {
+		roles   []*Role
+		action  Action
+		path    string
+		allowed bool
+	}{
+		{[]*Role{editor}, ActionUpdate, "/batches/5a0000000000000000000002", true},
+		{[]*Role{editor}, ActionArchive, "/batches/5a0000000000000000000002", false},
+		{[]*Role{editor}, ActionArchive, "/hydrometers/5a0000000000000000000001", true},
+		{[]*Role{cellar}, ActionUpdate, "/batches/5a0000000000000000000002", false},
+		{[]*Role{cellar}, ActionDelete, "/batches/5a0000000000000000000002/readings", true},
+		{[]*Role{cellar}, ActionUpdate, "/batches/5a0000000000000000000002/readings", false},
+		{[]*Role{cellar}, ActionUpdate, "/hydrometers/5a0000000000000000000001/calibrations", true},
+		{[]*Role{cellar}, ActionUpdate, "/hydrometers/5a0000000000000000000003", false},
+		// Denies win over other roles
+		{[]*Role{cellar, editor}, ActionArchive, "/batches/5a0000000000000000000002", false},
+		{[]*Role{cellar, editor}, ActionUpdate, "/batches/5a0000000000000000000002", true},
+	}
+
+	for _, test := range cases {
+		allowed, _ := rolesAllow(test.roles, test.action, test.path)
+		if allowed != test.allowed {
+			t.Errorf("%s %s: expected %v, got %v", test.action, test.path, test.allowed, allowed)
+		}
+	}
+
+	// Owners may do anything but give their resources away
+	graviton.InitTest()
+	data.GenerateTestData()
+	_, _, flueSeason, _ := data.GetTestObjects()
+	brewer := &User{ID: bson.NewObjectId()}
+
+	if ownsResource(brewer, "/batches/"+flueSeason.ID.Hex()) {
+		t.Errorf("Unowned batch owned")
+	}
+
+	flueSeason.OwnerID = brewer.ID
+	flueSeason.Save()
+
+	if !ownsResource(brewer, "/batches/"+flueSeason.ID.Hex()+"/readings") {
+		t.Errorf("Owner doesn't own their batch")
+	}
+	if ownsResource(brewer, "/batches/"+flueSeason.ID.Hex()+"/owner") {
+		t.Errorf("Owner can give their batch away")
+	}
+}
+
+// authorized runs handler if the request meets policy, as Router does.
+func authorized(policy Policy, handler echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !authorize(c, policy) {
+			return nil
+		}
+		return handler(c)
+	}
+}
+
+// fakeIssuer is a local OpenID Connect issuer. It logs in whoever its
+// subject and email say without asking, and doesn't sign its tokens,
+// which goth doesn't check.
+type fakeIssuer struct {
+	*httptest.Server
+	clientID   string
+	subject    string
+	email      string
+	unverified bool // leaves out the email_verified claim
+}
+
+func newFakeIssuer(clientID string) *fakeIssuer {
+	issuer := &fakeIssuer{clientID: clientID}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code=fake-code&state="+url.QueryEscape(query.Get("state")), 302)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		claims := map[string]interface{}{
+			"iss":            issuer.URL,
+			"aud":            issuer.clientID,
+			"sub":            issuer.subject,
+			"email":          issuer.email,
+			"email_verified": true,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+		if issuer.unverified {
+			delete(claims, "email_verified")
+		}
+		encoded, _ := json.Marshal(claims)
+		idToken := "e30." + strings.TrimRight(base64.StdEncoding.EncodeToString(encoded), "=") + ".unsigned"
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "fake-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
 func generateTestData() {
 	graviton.InitTest()
-	data.GenerateDemoData()
+	data.GenerateTestData()
 	InitOauth(config.GetConfig().MongoAddress, config.GetConfig().GetDBName())
 }
 
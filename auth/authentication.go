@@ -2,7 +2,6 @@ package auth
 
 import (
 	"crypto/rand"
-	"net/http"
 	"time"
 
 	"github.com/jslater89/graviton"
@@ -17,18 +16,20 @@ import (
 	"github.com/kidstuff/mongostore"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
-	"github.com/markbates/goth/providers/gplus"
 )
 
 type database struct {
-	session           *mgo.Session
-	mongoDB           *mgo.Database
-	gothicCollection  *mgo.Collection
-	sessionCollection *mgo.Collection
-	userCollection    *mgo.Collection
-	roleCollection    *mgo.Collection
-	apiKeyCollection  *mgo.Collection
-	mongoStore        *mongostore.MongoStore // Only for gothic
+	session               *mgo.Session
+	mongoDB               *mgo.Database
+	gothicCollection      *mgo.Collection
+	sessionCollection     *mgo.Collection
+	userCollection        *mgo.Collection
+	roleCollection        *mgo.Collection
+	apiKeyCollection      *mgo.Collection
+	deviceTokenCollection *mgo.Collection
+	credentialCollection  *mgo.Collection
+	identityCollection    *mgo.Collection
+	mongoStore            *mongostore.MongoStore // Only for gothic
 }
 
 var db database
@@ -40,14 +41,15 @@ func GetStore() *mongostore.MongoStore {
 func InitOauth(dbAddress string, dbName string) {
 	config := config.GetConfig()
 
-	url := config.ServerRedirect + "/api/v1/auth/google/callback"
-
-	goth.UseProviders(gplus.New(config.GoogleClientID, config.GoogleSecret, url))
-	gothic.GetProviderName = func(*http.Request) (string, error) {
-		return "gplus", nil
+	var err error
+	if config.OAuthEnabled {
+		err = registerProviders(configuredProviders(config))
+		if err != nil {
+			panic(err)
+		}
 	}
+	gothic.GetProviderName = providerName
 
-	var err error
 	db.session, err = mgo.Dial(dbAddress)
 	if err != nil {
 		panic(err)
@@ -59,9 +61,26 @@ func InitOauth(dbAddress string, dbName string) {
 	db.userCollection = db.mongoDB.C("users")
 	db.roleCollection = db.mongoDB.C("roles")
 	db.apiKeyCollection = db.mongoDB.C("apikey")
+	db.deviceTokenCollection = db.mongoDB.C("device_tokens")
+	db.credentialCollection = db.mongoDB.C("credentials")
+	db.identityCollection = db.mongoDB.C("identities")
 
 	initLocalSessionStore(3600)
-	verifyBaseRoles()
+	initDeviceTokenStore()
+	initCredentialStore()
+	initIdentityStore()
+
+	err = verifyBaseRoles()
+	if err != nil {
+		panic(err)
+	}
+
+	if !config.OAuthEnabled {
+		err = bootstrapLocalAdmin()
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	store := mongostore.NewMongoStore(db.gothicCollection, 300, true, []byte("secret-key"))
 
@@ -88,7 +107,7 @@ func HandleUser(c echo.Context, user goth.User) bson.ObjectId {
 		graviton.Logger.Info("Created new session for user", zap.String("Email", user.Email), zap.String("Session ID", sessionID.Hex()))
 	}
 
-	localUser, err := getOrCreateUser(user.Email)
+	localUser, err := identityUser(user)
 
 	if err != nil {
 		graviton.Logger.Error("Unable to get user", zap.Error(err))
@@ -2,7 +2,6 @@ package auth
 
 import (
 	"encoding/hex"
-	"net/http"
 	"strings"
 	"time"
 
@@ -35,16 +34,80 @@ func checkSessionExpiration(session *Session) bool {
 	return true
 }
 
-// IsAuthorized checks the session included in the request. If
-// the user is not authorized for the given request, returns false and
-// makes an appropriate response with the context. Otherwise, returns
-// true and defers responses to the caller. If the user is authorized
-// for a given endpoint, IsAuthorized extends the session's expiration.
-func IsAuthorized(c echo.Context, path string) bool {
-	bearer := extractBearer(c)
+const principalContextKey = "graviton.principal"
 
+// Principal is who a request comes from: a logged-in user, or a
+// device with a device token or the legacy API key.
+type Principal struct {
+	User        *User        // nil for devices
+	Session     *Session     // nil for devices
+	DeviceToken *DeviceToken // nil for users and the API key
+}
+
+// RequestPrincipal returns who the request was authorized for, or nil
+// on public routes.
+func RequestPrincipal(c echo.Context) *Principal {
+	principal, _ := c.Get(principalContextKey).(*Principal)
+	return principal
+}
+
+func requestUser(c echo.Context) *User {
+	principal := RequestPrincipal(c)
+	if principal == nil {
+		return nil
+	}
+	return principal.User
+}
+
+// RequestUser returns the email of the user the request was authorized
+// for, or an empty string if it was authorized some other way.
+func RequestUser(c echo.Context) string {
+	user := requestUser(c)
+	if user == nil {
+		return ""
+	}
+	return user.Email
+}
+
+// RequestUserID returns the ID of the user the request was authorized
+// for, or an empty ID if it was authorized some other way.
+func RequestUserID(c echo.Context) bson.ObjectId {
+	user := requestUser(c)
+	if user == nil {
+		return ""
+	}
+	return user.ID
+}
+
+// RequestUnits returns the preferred units of the user the request was
+// authorized for, or an empty string if they have none.
+func RequestUnits(c echo.Context) string {
+	user := requestUser(c)
+	if user == nil {
+		return ""
+	}
+	return user.Units
+}
+
+// Allowed reports whether the request's user may take action on path.
+// Routes are authorized by their Policy; Allowed is for handlers whose
+// resources depend on more than the route, like query parameters.
+// Users are allowed by their roles' permissions, or by owning the
+// batch or hydrometer at path, like /batches/<id>.
+func Allowed(c echo.Context, action Action, path string) bool {
+	user := requestUser(c)
+	return user != nil && checkUserPermissions(user, action, path)
+}
+
+// authenticate finds who the bearer token belongs to. If nobody, it
+// makes an appropriate response with the context and returns nil.
+func authenticate(c echo.Context, bearer string) *Principal {
 	if bearer == getOrCreateAPIKey(false) {
-		return true
+		return &Principal{}
+	}
+
+	if token := findDeviceToken(bearer); token != nil {
+		return &Principal{DeviceToken: token}
 	}
 
 	sess, err := getSession(bearer)
@@ -52,45 +115,24 @@ func IsAuthorized(c echo.Context, path string) bool {
 	if err != nil {
 		graviton.Logger.Info("Error getting session", zap.String("Bearer", bearer), zap.Error(err))
 		c.JSON(401, bson.M{"error": "not logged in"})
-		return false
+		return nil
 	}
 
 	if !checkSessionExpiration(sess) {
 		graviton.Logger.Info("Session expired for user", zap.String("Email", sess.User.Email))
 		deleteSession(bearer)
 		c.JSON(401, bson.M{"error": "login expired"})
-		return false
-	}
-
-	user := &sess.User
-
-	writeRequest := (c.Request().Method != http.MethodGet)
-	if !checkUserPermissions(user, writeRequest, path) {
-		graviton.Logger.Info("User not authorized for resource", zap.String("Email", user.Email), zap.String("Path", path))
-		c.JSON(403, bson.M{"error": "not authorized for resource"})
-		return false
+		return nil
 	}
 
-	graviton.Logger.Info("User authorized for path", zap.String("User", user.Email), zap.String("Path", path))
-	sess.ExpiresAt = time.Now().Add(1 * time.Hour)
-	saveSession(*sess)
-
-	return true
+	return &Principal{User: &sess.User, Session: sess}
 }
 
 func GetAPIKey(c echo.Context) error {
-	if !IsAuthorized(c, "/auth/apikey") {
-		return nil
-	}
-
 	return c.JSON(200, bson.M{"key": getOrCreateAPIKey(false)})
 }
 
 func ResetAPIKey(c echo.Context) error {
-	if !IsAuthorized(c, "/auth/apikey") {
-		return nil
-	}
-
 	return c.JSON(200, bson.M{"key": getOrCreateAPIKey(true)})
 }
 
@@ -127,7 +169,11 @@ func getOrCreateAPIKey(reset bool) string {
 	return key.Key
 }
 
-func checkUserPermissions(user *User, write bool, path string) bool {
+// checkUserPermissions checks action on path against user's roles. A
+// role that denies it refuses it; otherwise any role that allows it
+// grants it, and failing that, so does owning the batch or hydrometer
+// it's on.
+func checkUserPermissions(user *User, action Action, path string) bool {
 	roles, err := getUserRoles(user)
 
 	if err != nil {
@@ -135,68 +181,89 @@ func checkUserPermissions(user *User, write bool, path string) bool {
 		return false
 	}
 
-	permissions := []Permission{}
-	for _, role := range roles {
-		permissions = append(permissions, role.Permissions...)
-	}
-
-	bestMatchLength := 0
-	var bestPermission Permission
-
-	for _, permission := range permissions {
-		if strings.HasPrefix(path, permission.Path) && len(permission.Path) > bestMatchLength {
-			bestMatchLength = len(permission.Path)
-			bestPermission = permission
-
-			// Stop searching on exact match
-			if bestPermission.Path == path {
-				break
-			}
-		}
+	allowed, denied := rolesAllow(roles, action, path)
+	if allowed || denied {
+		return allowed
 	}
 
-	return write && bestPermission.CanWrite || !write && bestPermission.CanRead
+	return ownsResource(user, path)
 }
 
+// verifyBaseRoles makes any missing built-in roles. Viewers and Editors
+// made before administration existed get the permission on adminPath
+// newer ones have, which grants nothing, so that their permission on "/"
+// doesn't reach it. It doesn't deny anything either, so users with
+// another role that allows adminPath still have it.
 func verifyBaseRoles() error {
-	n, err := db.roleCollection.Find(bson.M{"name": "Viewer"}).Count()
-
-	if err == nil && n > 0 {
-		return nil
-	}
-	graviton.Logger.Info("Making default roles")
-
-	viewerRole := Role{
-		ID:   bson.NewObjectId(),
-		Name: "Viewer",
-		Permissions: []Permission{
-			Permission{
-				Path:     "/",
-				CanRead:  true,
-				CanWrite: false,
+	baseRoles := []Role{
+		Role{
+			Name: viewerRole,
+			Permissions: []Permission{
+				Permission{
+					Path:     "/",
+					CanRead:  true,
+					CanWrite: false,
+				},
+				Permission{
+					Path:     "/auth/apikey",
+					CanRead:  false,
+					CanWrite: false,
+				},
+				Permission{
+					Path:     adminPath,
+					CanRead:  false,
+					CanWrite: false,
+				},
 			},
-			Permission{
-				Path:     "/auth/apikey",
-				CanRead:  false,
-				CanWrite: false,
+		},
+		Role{
+			Name: editorRole,
+			Permissions: []Permission{
+				Permission{
+					CanRead:  true,
+					CanWrite: true,
+					Path:     "/",
+				},
+				Permission{
+					Path:     adminPath,
+					CanRead:  false,
+					CanWrite: false,
+				},
+			},
+		},
+		Role{
+			Name: administratorRole,
+			Permissions: []Permission{
+				Permission{
+					CanRead:  true,
+					CanWrite: true,
+					Path:     "/",
+				},
 			},
 		},
 	}
 
-	db.roleCollection.UpsertId(viewerRole.ID, viewerRole)
+	for _, role := range baseRoles {
+		n, err := db.roleCollection.Find(bson.M{"name": role.Name}).Count()
 
-	editorRole := Role{
-		ID:   bson.NewObjectId(),
-		Name: "Editor",
-		Permissions: []Permission{
-			Permission{
-				CanRead:  true,
-				CanWrite: true,
-				Path:     "/",
-			},
-		},
+		if err != nil {
+			return err
+		} else if n > 0 {
+			continue
+		}
+
+		graviton.Logger.Info("Making default role", zap.String("Name", role.Name))
+		role.ID = bson.NewObjectId()
+		err = db.roleCollection.Insert(role)
+
+		if err != nil {
+			return err
+		}
 	}
 
-	db.roleCollection.UpsertId(editorRole.ID, editorRole)
-	return nil
+	_, err := db.roleCollection.UpdateAll(
+		bson.M{"name": bson.M{"$in": []string{viewerRole, editorRole}}, "permissions.path": bson.M{"$ne": adminPath}},
+		bson.M{"$push": bson.M{"permissions": Permission{Path: adminPath}}},
+	)
+	return err
 }
@@ -1,10 +1,13 @@
 package auth
 
 import (
+	"strings"
 	"time"
 
+	"github.com/jslater89/graviton"
 	"github.com/jslater89/graviton/config"
 	"github.com/markbates/goth"
+	"go.uber.org/zap"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -15,22 +18,39 @@ type Role struct {
 	Permissions []Permission  `bson:"permissions" json:"permissions"`
 }
 
+// Permission grants or denies actions on a path and everything beneath
+// it. Path segments in braces, like "/batches/{id}", match any one
+// segment.
 type Permission struct {
 	Path     string `bson:"path" json:"path"`
 	CanRead  bool   `bson:"canRead" json:"canRead"`
-	CanWrite bool   `bson:"canWrite" json:"canWrite"`
+	CanWrite bool   `bson:"canWrite" json:"canWrite"` // every action but read
+
+	// If set, the actions granted or denied, instead of CanRead and
+	// CanWrite
+	Actions []Action `bson:"actions,omitempty" json:"actions,omitempty"`
+
+	// Deny refuses Actions, or every action if none are listed, whatever
+	// other permissions and roles allow
+	Deny bool `bson:"deny,omitempty" json:"deny,omitempty"`
 }
 
 type User struct {
 	ID    bson.ObjectId   `bson:"_id"`
 	Email string          `bson:"email"`
 	Roles []bson.ObjectId `bson:"roles"`
+	Units string          `bson:"units,omitempty"` // preferred units; see units.ParseSystem
 }
 
 type APIUser struct {
 	ID    bson.ObjectId `json:"_id"`
 	Email string        `json:"email"`
 	Roles []*Role       `json:"roles"`
+	Units string        `json:"units"`
+}
+
+type UnitsParam struct {
+	Units string `json:"units"`
 }
 
 type Session struct {
@@ -57,6 +77,12 @@ func initLocalSessionStore(maxAge int) {
 		Key:    []string{"email"},
 		Unique: true,
 	})
+	db.userCollection.EnsureIndexKey("roles")
+
+	db.roleCollection.EnsureIndex(mgo.Index{
+		Key:    []string{"name"},
+		Unique: true,
+	})
 }
 
 func getSession(token string) (*Session, error) {
@@ -78,6 +104,12 @@ func saveSession(session Session) error {
 	return err
 }
 
+// UserExists reports whether there's a user with id.
+func UserExists(id bson.ObjectId) (bool, error) {
+	n, err := db.userCollection.FindId(id).Count()
+	return n > 0, err
+}
+
 func getUser(id bson.ObjectId) (*User, error) {
 	user := &User{}
 	err := db.userCollection.Find(bson.M{"_id": id}).One(user)
@@ -85,21 +117,30 @@ func getUser(id bson.ObjectId) (*User, error) {
 	return user, err
 }
 
+// getOrCreateUser finds the user with email, making a new Viewer if
+// there isn't one. The first user, and the user with the configured
+// adminEmail, are made administrators.
 func getOrCreateUser(email string) (*User, error) {
 	user := &User{}
 	err := db.userCollection.Find(bson.M{"email": email}).One(user)
+	firstUser := false
 
 	if err != nil && err != mgo.ErrNotFound {
 		return nil, err
 	} else if err == mgo.ErrNotFound {
-		roleName := "Viewer"
+		n, err := db.userCollection.Count()
+		if err != nil {
+			return nil, err
+		}
+		firstUser = n == 0
+
+		roleName := viewerRole
 
 		if config.GetConfig().TestMode {
-			roleName = "Editor"
+			roleName = editorRole
 		}
 
-		role := &Role{}
-		err = db.roleCollection.Find(bson.M{"name": roleName}).One(role)
+		role, err := getRole(roleName)
 
 		if err != nil {
 			return nil, err
@@ -115,13 +156,40 @@ func getOrCreateUser(email string) (*User, error) {
 		}
 	}
 
+	adminEmail := config.GetConfig().AdminEmail
+	if firstUser || adminEmail != "" && strings.EqualFold(email, adminEmail) {
+		role, err := getRole(administratorRole)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !hasRole(user, role.ID) {
+			graviton.Logger.Info("Making user an administrator", zap.String("Email", email), zap.Bool("FirstUser", firstUser))
+			user.Roles = append(user.Roles, role.ID)
+			err = saveUserRoles(user)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return user, nil
 }
 
+func getRole(name string) (*Role, error) {
+	role := &Role{}
+	err := db.roleCollection.Find(bson.M{"name": name}).One(role)
+
+	return role, err
+}
+
 func convertDatabaseUser(user *User) (*APIUser, error) {
 	apiUser := &APIUser{
 		ID:    user.ID,
 		Email: user.Email,
+		Units: user.Units,
 	}
 
 	roles, err := getUserRoles(user)
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/data"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DeviceToken is a credential for a single hydrometer. Only a hash
+// of the token is stored; the token itself is shown once, when issued.
+type DeviceToken struct {
+	ID           bson.ObjectId `bson:"_id"`
+	HydrometerID bson.ObjectId `bson:"hydrometer"`
+	Name         string        `bson:"name"`
+	Hash         string        `bson:"hash"`
+	CreatedAt    time.Time     `bson:"created"`
+	LastUsed     time.Time     `bson:"lastUsed"`
+	Revoked      bool          `bson:"revoked"`
+	RevokedAt    time.Time     `bson:"revokedAt"`
+}
+
+type APIDeviceToken struct {
+	ID           bson.ObjectId `json:"id"`
+	HydrometerID bson.ObjectId `json:"hydrometer"`
+	Name         string        `json:"name"`
+	Token        string        `json:"token,omitempty"`
+	CreatedAt    time.Time     `json:"created"`
+	LastUsed     time.Time     `json:"lastUsed"`
+	Revoked      bool          `json:"revoked"`
+	RevokedAt    time.Time     `json:"revokedAt"`
+}
+
+type DeviceTokenParam struct {
+	Name string `json:"name"`
+}
+
+func initDeviceTokenStore() {
+	db.deviceTokenCollection.EnsureIndex(mgo.Index{
+		Key:    []string{"hash"},
+		Unique: true,
+	})
+	db.deviceTokenCollection.EnsureIndexKey("hydrometer")
+}
+
+// ListDeviceTokens lists the tokens issued for a hydrometer,
+// including revoked ones.
+func ListDeviceTokens(c echo.Context) error {
+	hydrometer := paramHydrometer(c)
+	if hydrometer == nil {
+		return nil
+	}
+
+	tokens := []*DeviceToken{}
+	err := db.deviceTokenCollection.Find(bson.M{"hydrometer": hydrometer.ID}).Sort("created").All(&tokens)
+
+	if err != nil {
+		graviton.Logger.Warn("Device token query failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	apiTokens := []*APIDeviceToken{}
+	for _, token := range tokens {
+		apiTokens = append(apiTokens, convertDeviceToken(token, ""))
+	}
+
+	return c.JSON(200, apiTokens)
+}
+
+// IssueDeviceToken creates a new token for a hydrometer. The response
+// is the only time the token itself is available.
+func IssueDeviceToken(c echo.Context) error {
+	hydrometer := paramHydrometer(c)
+	if hydrometer == nil {
+		return nil
+	}
+
+	param := &DeviceTokenParam{}
+	err := c.Bind(param)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	tokenString := generateToken()
+	token := &DeviceToken{
+		ID:           bson.NewObjectId(),
+		HydrometerID: hydrometer.ID,
+		Name:         param.Name,
+		Hash:         hashToken(tokenString),
+		CreatedAt:    time.Now(),
+	}
+
+	err = db.deviceTokenCollection.Insert(token)
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to save device token", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to save token"})
+	}
+
+	graviton.Logger.Info("Issued device token", zap.String("Hydrometer", hydrometer.Name), zap.String("TokenID", token.ID.Hex()))
+	return c.JSON(200, convertDeviceToken(token, tokenString))
+}
+
+// RevokeDeviceToken permanently disables one of a hydrometer's tokens.
+func RevokeDeviceToken(c echo.Context) error {
+	hydrometer := paramHydrometer(c)
+	if hydrometer == nil {
+		return nil
+	}
+
+	tokenID := c.Param("tokenId")
+
+	if !bson.IsObjectIdHex(tokenID) {
+		return c.JSON(400, bson.M{"error": "bad object id"})
+	}
+
+	token := &DeviceToken{}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"revoked": true, "revokedAt": time.Now()}},
+		ReturnNew: true,
+	}
+	_, err := db.deviceTokenCollection.Find(bson.M{
+		"_id":        bson.ObjectIdHex(tokenID),
+		"hydrometer": hydrometer.ID,
+	}).Apply(change, token)
+
+	if err == mgo.ErrNotFound {
+		return c.JSON(404, bson.M{"error": "token not found"})
+	} else if err != nil {
+		graviton.Logger.Warn("Unable to revoke device token", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to revoke token"})
+	}
+
+	graviton.Logger.Info("Revoked device token", zap.String("Hydrometer", hydrometer.Name), zap.String("TokenID", tokenID))
+	return c.JSON(200, convertDeviceToken(token, ""))
+}
+
+// CanPostReadings checks that a request authorized with a device token
+// is posting readings for that token's hydrometer. Requests authorized
+// some other way are allowed. If not allowed, returns false and makes
+// an appropriate response with the context.
+func CanPostReadings(c echo.Context, hydrometerID bson.ObjectId) bool {
+	principal := RequestPrincipal(c)
+	if principal == nil || principal.DeviceToken == nil {
+		return true
+	}
+
+	token := principal.DeviceToken
+	if token.HydrometerID != hydrometerID {
+		graviton.Logger.Info("Device token used for wrong hydrometer",
+			zap.String("TokenID", token.ID.Hex()),
+			zap.String("Hydrometer", hydrometerID.Hex()))
+		c.JSON(403, bson.M{"error": "token not valid for hydrometer"})
+		return false
+	}
+
+	return true
+}
+
+// findDeviceToken looks up an unrevoked device token and records that
+// it was used. It returns nil if there isn't one.
+func findDeviceToken(bearer string) *DeviceToken {
+	if bearer == "" {
+		return nil
+	}
+
+	token := &DeviceToken{}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"lastUsed": time.Now()}},
+		ReturnNew: true,
+	}
+	_, err := db.deviceTokenCollection.Find(bson.M{
+		"hash":    hashToken(bearer),
+		"revoked": false,
+	}).Apply(change, token)
+
+	if err != nil {
+		return nil
+	}
+
+	return token
+}
+
+// paramHydrometer loads the hydrometer named by the :id route
+// parameter. If there isn't one, it makes an appropriate response
+// with the context and returns nil.
+func paramHydrometer(c echo.Context) *data.Hydrometer {
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		c.JSON(400, bson.M{"error": "bad object id"})
+		return nil
+	}
+
+	hydrometer, err := data.SingleHydrometer(data.HydrometerQuery{ID: bson.ObjectIdHex(id)})
+
+	if err == data.ErrNotFound {
+		c.JSON(404, bson.M{"error": "hydrometer not found"})
+		return nil
+	} else if err != nil {
+		graviton.Logger.Error("Failed to query single hydrometer", zap.String("id", id), zap.Error(err))
+		c.JSON(502, bson.M{"error": "database query failed"})
+		return nil
+	}
+
+	return hydrometer
+}
+
+func convertDeviceToken(token *DeviceToken, tokenString string) *APIDeviceToken {
+	return &APIDeviceToken{
+		ID:           token.ID,
+		HydrometerID: token.HydrometerID,
+		Name:         token.Name,
+		Token:        tokenString,
+		CreatedAt:    token.CreatedAt,
+		LastUsed:     token.LastUsed,
+		Revoked:      token.Revoked,
+		RevokedAt:    token.RevokedAt,
+	}
+}
+
+func generateToken() string {
+	tokenBytes := make([]byte, 24)
+	rand.Read(tokenBytes)
+	return hex.EncodeToString(tokenBytes)
+}
+
+// Device and reset tokens are long and random, so a fast hash is enough.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/config"
+	"github.com/labstack/echo"
+	"github.com/markbates/goth"
+	"go.uber.org/zap"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Identity links a login at an OAuth provider to a user. A user may
+// have identities at several providers, or several at one.
+type Identity struct {
+	ID       bson.ObjectId `bson:"_id" json:"id"`
+	UserID   bson.ObjectId `bson:"user" json:"user"`
+	Provider string        `bson:"provider" json:"provider"`
+	Subject  string        `bson:"subject" json:"subject"` // the provider's ID for the user
+	Email    string        `bson:"email" json:"email"`
+	LinkedAt time.Time     `bson:"linked" json:"linked"`
+	LastUsed time.Time     `bson:"lastUsed" json:"lastUsed"`
+}
+
+var (
+	errIdentityLinked  = errors.New("identity is linked to another user")
+	errEmailUnverified = errors.New("provider didn't verify this email address; log in another way and link the provider from your account")
+)
+
+func initIdentityStore() {
+	db.identityCollection.EnsureIndex(mgo.Index{
+		Key:    []string{"provider", "subject"},
+		Unique: true,
+	})
+	db.identityCollection.EnsureIndexKey("user")
+}
+
+// ListIdentities lists the logged-in user's linked identities.
+func ListIdentities(c echo.Context) error {
+	session := RequestPrincipal(c).Session
+
+	if session == nil {
+		return c.JSON(400, bson.M{"error": "not a user session"})
+	}
+
+	identities := []*Identity{}
+	err := db.identityCollection.Find(bson.M{"user": session.User.ID}).Sort("linked").All(&identities)
+
+	if err != nil {
+		graviton.Logger.Warn("Identity query failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	return c.JSON(200, identities)
+}
+
+// UnlinkIdentity unlinks the logged-in user's identity :id, unless it's
+// their only way to log in. A later login there with the user's email
+// links it again, if the provider verified the email.
+func UnlinkIdentity(c echo.Context) error {
+	session := RequestPrincipal(c).Session
+
+	if session == nil {
+		return c.JSON(400, bson.M{"error": "not a user session"})
+	}
+
+	id := c.Param("id")
+
+	if !bson.IsObjectIdHex(id) {
+		return c.JSON(400, bson.M{"error": "bad object id"})
+	}
+
+	identity := &Identity{}
+	err := db.identityCollection.Find(bson.M{"_id": bson.ObjectIdHex(id), "user": session.User.ID}).One(identity)
+
+	if err == mgo.ErrNotFound {
+		return c.JSON(404, bson.M{"error": "identity not found"})
+	} else if err != nil {
+		graviton.Logger.Warn("Identity query failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	n, err := db.identityCollection.Find(bson.M{"user": session.User.ID}).Count()
+
+	var credential *Credential
+	if err == nil {
+		credential, err = getCredential(session.User.ID)
+	}
+
+	if err != nil && err != mgo.ErrNotFound {
+		graviton.Logger.Warn("Identity query failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	if n <= 1 && (credential == nil || credential.Hash == "") {
+		return c.JSON(409, bson.M{"error": "can't unlink the only way to log in"})
+	}
+
+	err = db.identityCollection.RemoveId(identity.ID)
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to unlink identity", zap.String("Email", session.User.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to unlink identity"})
+	}
+
+	graviton.Logger.Info("Unlinked identity",
+		zap.String("Email", session.User.Email),
+		zap.String("Provider", identity.Provider))
+	return c.JSON(200, bson.M{"status": "ok"})
+}
+
+// identityUser finds the user a provider login belongs to: the one its
+// identity is linked to, or else the one with its email, made if need
+// be, who it's then linked to. Only logins whose provider verified the
+// email are matched to an existing user by it; see checkEmailLogin.
+func identityUser(login goth.User) (*User, error) {
+	if login.Provider == "" || login.UserID == "" {
+		return getOrCreateUser(login.Email)
+	}
+
+	identity := &Identity{}
+	err := db.identityCollection.Find(bson.M{"provider": login.Provider, "subject": login.UserID}).One(identity)
+
+	if err == nil {
+		err = db.identityCollection.UpdateId(identity.ID, bson.M{"$set": bson.M{"lastUsed": time.Now(), "email": login.Email}})
+		if err != nil {
+			return nil, err
+		}
+
+		user, err := getUser(identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Makes the user an administrator if they're adminEmail
+		return getOrCreateUser(user.Email)
+	} else if err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	err = checkEmailLogin(login)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := getOrCreateUser(login.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, linkIdentity(user, login)
+}
+
+// checkProviderLogin checks a provider login before it's handled, so
+// that a refusal can say why: logins with a linked identity are fine,
+// and others go to checkEmailLogin.
+func checkProviderLogin(login goth.User) error {
+	n, err := db.identityCollection.Find(bson.M{"provider": login.Provider, "subject": login.UserID}).Count()
+	if err != nil || n > 0 {
+		return err
+	}
+	return checkEmailLogin(login)
+}
+
+// checkEmailLogin checks that a login with no linked identity may be
+// matched to a user by its email. If its provider didn't verify the
+// email, it may only make a new user, and not one that would be made an
+// administrator; otherwise, anyone who could set the address at the
+// provider could take over the account. Users link such identities
+// from a logged-in session instead.
+func checkEmailLogin(login goth.User) error {
+	if login.Email == "" {
+		return errors.New("provider gave no email address")
+	}
+	if emailVerified(login) {
+		return nil
+	}
+
+	n, err := db.userCollection.Find(bson.M{"email": login.Email}).Count()
+	if err != nil {
+		return err
+	}
+
+	adminEmail := config.GetConfig().AdminEmail
+	if n > 0 || adminEmail != "" && strings.EqualFold(login.Email, adminEmail) {
+		return errEmailUnverified
+	}
+	return nil
+}
+
+// emailVerified reports whether a login's provider says it verified the
+// login's email address. OpenID Connect issuers and Google say so in a
+// claim; GitHub and GitLab profiles don't say, so their addresses never
+// count as verified.
+func emailVerified(login goth.User) bool {
+	switch providerType(login.Provider) {
+	case providerOIDC, providerGoogle:
+		// Google's userinfo calls it verified_email; some issuers
+		// send the claim as a string
+		for _, claim := range []string{"email_verified", "verified_email"} {
+			switch verified := login.RawData[claim].(type) {
+			case bool:
+				if verified {
+					return true
+				}
+			case string:
+				if verified == "true" {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// linkIdentity links a provider login to user. If it's linked to
+// another user, it returns errIdentityLinked.
+func linkIdentity(user *User, login goth.User) error {
+	identity := &Identity{}
+	err := db.identityCollection.Find(bson.M{"provider": login.Provider, "subject": login.UserID}).One(identity)
+
+	if err == nil {
+		if identity.UserID != user.ID {
+			return errIdentityLinked
+		}
+		return nil
+	} else if err != mgo.ErrNotFound {
+		return err
+	}
+
+	now := time.Now()
+	identity = &Identity{
+		ID:       bson.NewObjectId(),
+		UserID:   user.ID,
+		Provider: login.Provider,
+		Subject:  login.UserID,
+		Email:    login.Email,
+		LinkedAt: now,
+		LastUsed: now,
+	}
+
+	err = db.identityCollection.Insert(identity)
+	if mgo.IsDup(err) {
+		return errIdentityLinked
+	} else if err != nil {
+		return err
+	}
+
+	graviton.Logger.Info("Linked identity",
+		zap.String("Email", user.Email),
+		zap.String("Provider", login.Provider),
+		zap.String("Subject", login.UserID))
+	return nil
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Policy is what a route requires of a request.
+type Policy struct {
+	// Public routes need no credentials, like the login routes.
+	Public bool
+
+	// Path is the permission path to check, with :name segments filled
+	// in from route parameters, like "/batches/:id". If empty, any
+	// logged-in user is allowed.
+	Path string
+
+	// Action to check; if empty, the one the request method implies:
+	// read for GET, create for POST, update for PUT and delete for
+	// DELETE.
+	Action Action
+
+	// Devices allows device tokens and the legacy API key, besides
+	// users with permission. Handlers still check the device's
+	// hydrometer; see CanPostReadings.
+	Devices bool
+
+	// Bearer finds credentials somewhere besides the Authorization
+	// header or cookie, for requests without an Authorization header.
+	Bearer func(c echo.Context) string
+}
+
+// Public allows anyone.
+func Public() Policy {
+	return Policy{Public: true}
+}
+
+// LoggedIn allows any logged-in user.
+func LoggedIn() Policy {
+	return Policy{}
+}
+
+// Allow allows users with permission for path, for the action the
+// request method implies.
+func Allow(path string) Policy {
+	return Policy{Path: path}
+}
+
+// AllowTo allows users with permission for action on path.
+func AllowTo(action Action, path string) Policy {
+	return Policy{Path: path, Action: action}
+}
+
+// Devices allows devices, and users with permission for path.
+func Devices(path string) Policy {
+	return Policy{Path: path, Devices: true}
+}
+
+// Router registers routes along with the Policy that authorizes them.
+// Its Authorize middleware refuses requests to routes without one, so
+// a route can't be left open by forgetting to declare one.
+type Router struct {
+	echo     *echo.Echo
+	policies map[string]Policy
+}
+
+func NewRouter(e *echo.Echo) *Router {
+	return &Router{
+		echo:     e,
+		policies: map[string]Policy{},
+	}
+}
+
+func (r *Router) Add(method string, path string, h echo.HandlerFunc, policy Policy) *echo.Route {
+	r.policies[method+" "+path] = policy
+	return r.echo.Add(method, path, h)
+}
+
+func (r *Router) GET(path string, h echo.HandlerFunc, policy Policy) *echo.Route {
+	return r.Add(echo.GET, path, h, policy)
+}
+
+func (r *Router) POST(path string, h echo.HandlerFunc, policy Policy) *echo.Route {
+	return r.Add(echo.POST, path, h, policy)
+}
+
+func (r *Router) PUT(path string, h echo.HandlerFunc, policy Policy) *echo.Route {
+	return r.Add(echo.PUT, path, h, policy)
+}
+
+func (r *Router) DELETE(path string, h echo.HandlerFunc, policy Policy) *echo.Route {
+	return r.Add(echo.DELETE, path, h, policy)
+}
+
+// Authorize is middleware enforcing each route's Policy. It puts the
+// request's Principal in the context for handlers, and extends logged-in
+// users' sessions.
+func (r *Router) Authorize(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		policy, ok := r.policies[c.Request().Method+" "+c.Path()]
+
+		if !ok && !r.routed(c) {
+			// Echo's not found or method not allowed response
+			return next(c)
+		}
+		if !ok {
+			graviton.Logger.Error("Route has no policy",
+				zap.String("Method", c.Request().Method),
+				zap.String("Route", c.Path()))
+			return c.JSON(403, bson.M{"error": "not authorized for resource"})
+		}
+
+		if policy.Public || authorize(c, policy) {
+			return next(c)
+		}
+		return nil
+	}
+}
+
+// routed reports whether the request matched a route registered with
+// echo, by the router or not.
+func (r *Router) routed(c echo.Context) bool {
+	for _, route := range r.echo.Routes() {
+		if route.Method == c.Request().Method && route.Path == c.Path() {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks the request's credentials against policy. If they
+// aren't good enough, it makes an appropriate response with the context
+// and returns false.
+func authorize(c echo.Context, policy Policy) bool {
+	bearer := extractBearer(c)
+	if policy.Bearer != nil && c.Request().Header.Get("Authorization") == "" {
+		if policyBearer := policy.Bearer(c); policyBearer != "" {
+			bearer = policyBearer
+		}
+	}
+
+	principal := authenticate(c, bearer)
+	if principal == nil {
+		return false
+	}
+
+	path := policy.path(c)
+
+	if principal.User == nil {
+		if !policy.Devices {
+			graviton.Logger.Info("Device credential used outside reading ingestion", zap.String("Path", path))
+			c.JSON(403, bson.M{"error": "device credentials may only post readings"})
+			return false
+		}
+
+		c.Set(principalContextKey, principal)
+		return true
+	}
+
+	user := principal.User
+	action := policy.Action
+	if action == "" {
+		action = methodAction(c.Request().Method)
+	}
+
+	if path != "" && !checkUserPermissions(user, action, path) {
+		graviton.Logger.Info("User not authorized for resource",
+			zap.String("Email", user.Email),
+			zap.String("Action", string(action)),
+			zap.String("Path", path))
+		c.JSON(403, bson.M{"error": "not authorized for resource"})
+		return false
+	}
+
+	c.Set(principalContextKey, principal)
+	principal.Session.ExpiresAt = time.Now().Add(1 * time.Hour)
+	saveSession(*principal.Session)
+
+	return true
+}
+
+// path fills in the route parameters in p.Path.
+func (p Policy) path(c echo.Context) string {
+	segments := strings.Split(p.Path, "/")
+
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = c.Param(segment[1:])
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
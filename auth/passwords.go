@@ -0,0 +1,397 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/config"
+	"github.com/labstack/echo"
+	"github.com/markbates/goth"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Passwords are checked against bcrypt hashes, and bcrypt ignores
+// anything past 72 bytes.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// How long an administrator's reset token may be used
+const resetTokenLifetime = 24 * time.Hour
+
+// How recently a user must have logged in with a provider to set their
+// first password
+const firstPasswordLoginWindow = 10 * time.Minute
+
+// Credential is a local account's password, stored apart from the
+// user so that sessions' copies of users don't carry it. Reset tokens
+// are stored hashed, like device tokens.
+type Credential struct {
+	UserID       bson.ObjectId `bson:"_id"`
+	Hash         string        `bson:"hash,omitempty"`
+	ChangedAt    time.Time     `bson:"changed,omitempty"`
+	ResetHash    string        `bson:"resetHash,omitempty"`
+	ResetExpires time.Time     `bson:"resetExpires,omitempty"`
+}
+
+type LoginParam struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type PasswordParam struct {
+	Current  string `json:"current"` // not needed if the user has no password yet; see ChangePassword
+	Password string `json:"password"`
+}
+
+type ResetParam struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type NewUserParam struct {
+	Email string `json:"email"`
+}
+
+// APIPasswordReset is a reset token for a user; the token is shown
+// only once, when issued.
+type APIPasswordReset struct {
+	User    *APIUser  `json:"user"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Compared against when there's no such user, so that logins take as
+// long either way.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("graviton"), bcrypt.DefaultCost)
+
+func initCredentialStore() {
+	db.credentialCollection.EnsureIndexKey("resetHash")
+}
+
+// LocalLogin starts a session for a local account; takes a LoginParam.
+// Like the OAuth callback, it sets the bearer cookie, and it returns
+// the bearer token too.
+func LocalLogin(c echo.Context) error {
+	param := &LoginParam{}
+	err := c.Bind(param)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	user := &User{}
+	err = db.userCollection.Find(bson.M{"email": strings.TrimSpace(param.Email)}).One(user)
+
+	var credential *Credential
+	if err == nil {
+		credential, err = getCredential(user.ID)
+	}
+
+	if err != nil && err != mgo.ErrNotFound {
+		graviton.Logger.Error("Failed to query credentials", zap.String("Email", param.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	hash := dummyHash
+	if credential != nil && credential.Hash != "" {
+		hash = []byte(credential.Hash)
+	}
+
+	err = bcrypt.CompareHashAndPassword(hash, []byte(param.Password))
+
+	if err != nil || credential == nil || credential.Hash == "" {
+		graviton.Logger.Info("Failed local login", zap.String("Email", param.Email))
+		return c.JSON(401, bson.M{"error": "wrong email or password"})
+	}
+
+	session, err := startSession(user)
+
+	if err != nil {
+		graviton.Logger.Warn("Error storing session", zap.String("Email", user.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to save session"})
+	}
+
+	graviton.Logger.Info("Local login", zap.String("Email", user.Email))
+	c.SetCookie(getCookie(session.Token))
+	return c.JSON(200, bson.M{"bearer": session.Token})
+}
+
+// ChangePassword sets the logged-in user's password; takes a
+// PasswordParam. The user's other sessions are ended. Users without a
+// password must have just logged in with a provider to set one, or else
+// use a reset token; a password outlives their provider identities, so
+// any old session isn't enough.
+func ChangePassword(c echo.Context) error {
+	session := RequestPrincipal(c).Session
+
+	if session == nil {
+		return c.JSON(400, bson.M{"error": "not a user session"})
+	}
+
+	param := &PasswordParam{}
+	err := c.Bind(param)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	if err = checkPasswordLength(param.Password); err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	credential, err := getCredential(session.User.ID)
+
+	if err != nil && err != mgo.ErrNotFound {
+		graviton.Logger.Error("Failed to query credentials", zap.String("Email", session.User.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	if credential != nil && credential.Hash != "" {
+		err = bcrypt.CompareHashAndPassword([]byte(credential.Hash), []byte(param.Current))
+		if err != nil {
+			return c.JSON(403, bson.M{"error": "wrong password"})
+		}
+	} else if !freshProviderLogin(session) {
+		return c.JSON(403, bson.M{"error": "log out and in again with your provider to set a password, or use a reset token"})
+	}
+
+	err = setPassword(session.User.ID, param.Password, session.Token)
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to save password", zap.String("Email", session.User.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to save password"})
+	}
+
+	graviton.Logger.Info("Password changed", zap.String("Email", session.User.Email))
+	return c.JSON(200, bson.M{"status": "ok"})
+}
+
+// ResetPassword sets a password with a reset token from an
+// administrator; takes a ResetParam. The user's sessions are ended.
+func ResetPassword(c echo.Context) error {
+	param := &ResetParam{}
+	err := c.Bind(param)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	if err = checkPasswordLength(param.Password); err != nil {
+		return c.JSON(400, bson.M{"error": err.Error()})
+	}
+
+	credential := &Credential{}
+	err = db.credentialCollection.Find(bson.M{
+		"resetHash":    hashToken(param.Token),
+		"resetExpires": bson.M{"$gt": time.Now()},
+	}).One(credential)
+
+	if err == mgo.ErrNotFound || param.Token == "" {
+		return c.JSON(403, bson.M{"error": "invalid or expired reset token"})
+	} else if err != nil {
+		graviton.Logger.Error("Failed to query credentials", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	}
+
+	err = setPassword(credential.UserID, param.Password, "")
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to save password", zap.String("UserID", credential.UserID.Hex()), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to save password"})
+	}
+
+	graviton.Logger.Info("Password reset", zap.String("UserID", credential.UserID.Hex()))
+	return c.JSON(200, bson.M{"status": "ok"})
+}
+
+// NewLocalUser creates a user to log in with a password; takes a
+// NewUserParam. The response includes a reset token for the user to
+// set their first password with.
+func NewLocalUser(c echo.Context) error {
+	param := &NewUserParam{}
+	err := c.Bind(param)
+
+	if err != nil {
+		graviton.Logger.Warn("Invalid input", zap.Error(err))
+		return c.JSON(400, bson.M{"error": "invalid input"})
+	}
+
+	param.Email = strings.TrimSpace(param.Email)
+	if param.Email == "" {
+		return c.JSON(400, bson.M{"error": "user needs an email"})
+	}
+
+	n, err := db.userCollection.Find(bson.M{"email": param.Email}).Count()
+
+	if err != nil {
+		graviton.Logger.Warn("User query failed", zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database query failed"})
+	} else if n > 0 {
+		return c.JSON(409, bson.M{"error": "email already in use"})
+	}
+
+	user, err := getOrCreateUser(param.Email)
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to create user", zap.String("Email", param.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to create user"})
+	}
+
+	graviton.Logger.Info("Created local user", zap.String("Email", user.Email), zap.String("By", RequestUser(c)))
+	return issuePasswordReset(c, user)
+}
+
+// IssuePasswordReset makes a reset token for the user :id, replacing
+// any earlier one. Their current password works until it's used.
+func IssuePasswordReset(c echo.Context) error {
+	user := paramUser(c)
+	if user == nil {
+		return nil
+	}
+
+	graviton.Logger.Info("Issuing password reset", zap.String("Email", user.Email), zap.String("By", RequestUser(c)))
+	return issuePasswordReset(c, user)
+}
+
+func issuePasswordReset(c echo.Context, user *User) error {
+	token, expires, err := newResetToken(user.ID)
+
+	if err != nil {
+		graviton.Logger.Warn("Unable to save reset token", zap.String("Email", user.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "unable to save reset token"})
+	}
+
+	apiUser, err := convertDatabaseUser(user)
+
+	if err != nil {
+		graviton.Logger.Warn("Could not look up roles for user", zap.String("Email", user.Email), zap.Error(err))
+		return c.JSON(502, bson.M{"error": "database lookup error"})
+	}
+
+	return c.JSON(200, &APIPasswordReset{
+		User:    apiUser,
+		Token:   token,
+		Expires: expires,
+	})
+}
+
+func newResetToken(userID bson.ObjectId) (string, time.Time, error) {
+	token := generateToken()
+	expires := time.Now().Add(resetTokenLifetime)
+
+	_, err := db.credentialCollection.UpsertId(userID, bson.M{"$set": bson.M{
+		"resetHash":    hashToken(token),
+		"resetExpires": expires,
+	}})
+
+	return token, expires, err
+}
+
+// setPassword stores a new password for a user, using up any reset
+// token, and ends their sessions besides keepSession.
+func setPassword(userID bson.ObjectId, password string, keepSession string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.credentialCollection.UpsertId(userID, bson.M{
+		"$set":   bson.M{"hash": string(hash), "changed": time.Now()},
+		"$unset": bson.M{"resetHash": "", "resetExpires": ""},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.sessionCollection.RemoveAll(bson.M{"user._id": userID, "token": bson.M{"$ne": keepSession}})
+	return err
+}
+
+func getCredential(userID bson.ObjectId) (*Credential, error) {
+	credential := &Credential{}
+	err := db.credentialCollection.FindId(userID).One(credential)
+
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func checkPasswordLength(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("passwords must be %d to %d characters", minPasswordLength, maxPasswordLength)
+	}
+	return nil
+}
+
+// startSession makes a session for user, as HandleUser does for OAuth
+// logins.
+// freshProviderLogin reports whether session began with a provider
+// login within firstPasswordLoginWindow.
+func freshProviderLogin(session *Session) bool {
+	provider := session.UserInfo.Provider
+	return provider != "" && provider != "local" && time.Since(session.CreatedAt) < firstPasswordLoginWindow
+}
+
+func startSession(user *User) (*Session, error) {
+	session := &Session{
+		ID:        bson.NewObjectId(),
+		User:      *user,
+		UserInfo:  goth.User{Provider: "local", Email: user.Email, UserID: user.ID.Hex()},
+		Token:     bson.ObjectId(generateSessionToken()).Hex(),
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(1 * time.Hour),
+	}
+
+	return session, saveSession(*session)
+}
+
+// bootstrapLocalAdmin makes sure there's a way to log in without
+// OAuth: it makes the configured admin user an administrator, creating
+// them if need be, and logs a reset token for them until they set a
+// password.
+func bootstrapLocalAdmin() error {
+	adminEmail := config.GetConfig().AdminEmail
+
+	if adminEmail == "" {
+		n, err := db.userCollection.Count()
+		if err == nil && n == 0 {
+			graviton.Logger.Warn("OAuth is off and there are no users; set adminEmail to create an administrator")
+		}
+		return err
+	}
+
+	user, err := getOrCreateUser(adminEmail)
+	if err != nil {
+		return err
+	}
+
+	credential, err := getCredential(user.ID)
+
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	} else if credential != nil && credential.Hash != "" {
+		return nil
+	}
+
+	token, expires, err := newResetToken(user.ID)
+	if err != nil {
+		return err
+	}
+
+	graviton.Logger.Warn("Administrator has no password; set one with this reset token at /api/v1/auth/local/reset",
+		zap.String("Email", user.Email),
+		zap.String("Token", token),
+		zap.Time("Expires", expires))
+	return nil
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/data"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Action is something a permission grants or denies.
+type Action string
+
+const (
+	ActionRead    Action = "read"
+	ActionCreate  Action = "create"
+	ActionUpdate  Action = "update"
+	ActionDelete  Action = "delete"
+	ActionArchive Action = "archive"
+)
+
+var actions = []Action{ActionRead, ActionCreate, ActionUpdate, ActionDelete, ActionArchive}
+
+func ParseAction(action string) (Action, error) {
+	for _, a := range actions {
+		if string(a) == action {
+			return a, nil
+		}
+	}
+	return "", errors.New("unknown action " + action)
+}
+
+// methodAction is the action a request's method implies, for handlers
+// that don't name one.
+func methodAction(method string) Action {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return ActionRead
+	case http.MethodPost:
+		return ActionCreate
+	case http.MethodDelete:
+		return ActionDelete
+	default:
+		return ActionUpdate
+	}
+}
+
+// covers reports whether p applies to action.
+func (p Permission) covers(action Action) bool {
+	if len(p.Actions) > 0 {
+		for _, a := range p.Actions {
+			if a == action {
+				return true
+			}
+		}
+		return false
+	}
+
+	if p.Deny {
+		return true
+	}
+	if action == ActionRead {
+		return p.CanRead
+	}
+	return p.CanWrite
+}
+
+// rolesAllow checks action on path against roles. Explicit denies in
+// any role win. Otherwise, each role's most specific permission for
+// path applies, and action is allowed if any role allows it. denied
+// reports an explicit deny, which ownership doesn't override either.
+func rolesAllow(roles []*Role, action Action, path string) (allowed bool, denied bool) {
+	for _, role := range roles {
+		bestScore := -1
+		var best Permission
+
+		for _, permission := range role.Permissions {
+			matched, score := matchPath(permission.Path, path)
+			if !matched {
+				continue
+			}
+
+			if permission.Deny {
+				if permission.covers(action) {
+					return false, true
+				}
+			} else if score > bestScore {
+				bestScore = score
+				best = permission
+			}
+		}
+
+		if bestScore >= 0 && best.covers(action) {
+			allowed = true
+		}
+	}
+
+	return allowed, false
+}
+
+// matchPath reports whether pattern matches path or a path beneath it.
+// Pattern segments in braces, like the {id} in "/batches/{id}", match
+// any one segment. The score ranks matches: patterns with more
+// segments are more specific, then patterns with more literal ones.
+func matchPath(pattern string, path string) (bool, int) {
+	patternSegments := pathSegments(pattern)
+	segments := pathSegments(path)
+
+	if len(patternSegments) > len(segments) {
+		return false, 0
+	}
+
+	literals := 0
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			continue
+		}
+		if segment != segments[i] {
+			return false, 0
+		}
+		literals++
+	}
+
+	return true, len(patternSegments)*1000 + literals
+}
+
+func pathSegments(path string) []string {
+	segments := []string{}
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// ownsResource reports whether user owns the batch or hydrometer at
+// path, like /batches/<id>/readings. Owners may do anything with
+// their resources except give them away; see ownerSegment.
+func ownsResource(user *User, path string) bool {
+	segments := pathSegments(path)
+	if len(segments) < 2 || !bson.IsObjectIdHex(segments[1]) {
+		return false
+	}
+	if len(segments) > 2 && segments[2] == ownerSegment {
+		return false
+	}
+
+	id := bson.ObjectIdHex(segments[1])
+	var owner bson.ObjectId
+	var err error
+
+	switch segments[0] {
+	case "batches":
+		var batch *data.Batch
+		batch, err = data.SingleBatch(data.BatchQuery{ID: id})
+		if err == nil {
+			owner = batch.OwnerID
+		}
+	case "hydrometers":
+		var hydrometer *data.Hydrometer
+		hydrometer, err = data.SingleHydrometer(data.HydrometerQuery{ID: id})
+		if err == nil {
+			owner = hydrometer.OwnerID
+		}
+	default:
+		return false
+	}
+
+	if err != nil && err != data.ErrNotFound {
+		graviton.Logger.Warn("Resource owner lookup error", zap.String("Path", path), zap.Error(err))
+	}
+
+	return owner != "" && owner == user.ID
+}
+
+// ownerSegment ends the path that changes a resource's owner, like
+// /batches/<id>/owner.
+const ownerSegment = "owner"
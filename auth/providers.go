@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/config"
+	"github.com/labstack/echo"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/github"
+	"github.com/markbates/goth/providers/gitlab"
+	"github.com/markbates/goth/providers/google"
+	"github.com/markbates/goth/providers/openidConnect"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Provider types, for config.OAuthProvider
+const (
+	providerOIDC   = "oidc"
+	providerGitHub = "github"
+	providerGitLab = "gitlab"
+	providerGoogle = "google"
+)
+
+// The scopes each type needs for an email address
+var providerScopes = map[string][]string{
+	providerOIDC:   []string{"email", "profile"},
+	providerGitHub: []string{"user:email"},
+	providerGitLab: []string{"read_user"},
+	providerGoogle: []string{"email"},
+}
+
+// Provider names are route segments under /api/v1/auth, so they can't
+// be the ones other auth routes use.
+var (
+	providerNamePattern   = regexp.MustCompile(`^[a-z0-9-]+$`)
+	reservedProviderNames = []string{"local", "logout", "apikey", "providers"}
+)
+
+const authRoutePrefix = "/api/v1/auth/"
+
+type APIProvider struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// The providers registered with goth, in configuration order
+var providers []APIProvider
+
+// providerType returns the type of the registered provider name, or ""
+// if there's none.
+func providerType(name string) string {
+	for _, provider := range providers {
+		if provider.Name == name {
+			return provider.Type
+		}
+	}
+	return ""
+}
+
+// ListProviders lists the providers users can log in with, for login
+// pages.
+func ListProviders(c echo.Context) error {
+	return c.JSON(200, providers)
+}
+
+// configuredProviders returns the configured providers, with a Google
+// provider from the deprecated googleClientId and googleSecret if
+// they're set and no provider is named google.
+func configuredProviders(c config.Config) []config.OAuthProvider {
+	configured := []config.OAuthProvider{}
+	legacyGoogle := c.GoogleClientID != ""
+
+	for _, provider := range c.OAuthProviders {
+		if provider.Name == "" {
+			provider.Name = provider.Type
+		}
+		if provider.Name == providerGoogle {
+			legacyGoogle = false
+		}
+		configured = append(configured, provider)
+	}
+
+	if legacyGoogle {
+		configured = append(configured, config.OAuthProvider{
+			Name:     providerGoogle,
+			Type:     providerGoogle,
+			ClientID: c.GoogleClientID,
+			Secret:   c.GoogleSecret,
+		})
+	}
+
+	return configured
+}
+
+// registerProviders replaces goth's providers with configured. Bad
+// configuration is an error; an OpenID Connect issuer whose discovery
+// document can't be fetched is logged and left out, so that the others
+// still work.
+func registerProviders(configured []config.OAuthProvider) error {
+	gothProviders := []goth.Provider{}
+	registered := []APIProvider{}
+	names := map[string]bool{}
+
+	for _, provider := range configured {
+		if provider.Name == "" {
+			provider.Name = provider.Type
+		}
+
+		err := validateProvider(provider)
+		if err == nil && names[provider.Name] {
+			err = errors.New("duplicate name")
+		}
+		if err != nil {
+			return errors.New("oauth provider " + provider.Name + ": " + err.Error())
+		}
+		names[provider.Name] = true
+
+		gothProvider, err := newProvider(provider)
+		if err != nil {
+			graviton.Logger.Error("Unable to set up OAuth provider",
+				zap.String("Name", provider.Name),
+				zap.String("Type", provider.Type),
+				zap.Error(err))
+			continue
+		}
+
+		gothProviders = append(gothProviders, gothProvider)
+		registered = append(registered, APIProvider{Name: provider.Name, Type: provider.Type})
+	}
+
+	goth.ClearProviders()
+	goth.UseProviders(gothProviders...)
+	providers = registered
+
+	return nil
+}
+
+func validateProvider(provider config.OAuthProvider) error {
+	if !providerNamePattern.MatchString(provider.Name) {
+		return errors.New("names may only have lowercase letters, digits and dashes")
+	}
+	for _, reserved := range reservedProviderNames {
+		if provider.Name == reserved {
+			return errors.New("name is reserved")
+		}
+	}
+
+	if _, ok := providerScopes[provider.Type]; !ok {
+		return errors.New("unknown type " + provider.Type)
+	}
+	if provider.Type == providerOIDC && provider.DiscoveryURL == "" {
+		return errors.New("oidc providers need a discoveryUrl")
+	}
+	if provider.ClientID == "" {
+		return errors.New("no clientId")
+	}
+
+	return nil
+}
+
+// newProvider makes a goth provider, named for provider and with its
+// callback under serverRedirect.
+func newProvider(provider config.OAuthProvider) (goth.Provider, error) {
+	callback := config.GetConfig().ServerRedirect + authRoutePrefix + provider.Name + "/callback"
+	scopes := append(append([]string{}, providerScopes[provider.Type]...), provider.Scopes...)
+
+	switch provider.Type {
+	case providerOIDC:
+		p, err := openidConnect.New(provider.ClientID, provider.Secret, callback, provider.DiscoveryURL, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		p.SetName(provider.Name)
+		return p, nil
+	case providerGitHub:
+		p := github.New(provider.ClientID, provider.Secret, callback, scopes...)
+		p.SetName(provider.Name)
+		return p, nil
+	case providerGitLab:
+		p := gitlab.New(provider.ClientID, provider.Secret, callback, scopes...)
+		p.SetName(provider.Name)
+		return p, nil
+	default:
+		p := google.New(provider.ClientID, provider.Secret, callback, scopes...)
+		p.SetName(provider.Name)
+		return p, nil
+	}
+}
+
+// providerName gets the provider from a request's path, like the
+// github in /api/v1/auth/github/login, for gothic.
+func providerName(req *http.Request) (string, error) {
+	path := req.URL.Path
+	if !strings.HasPrefix(path, authRoutePrefix) {
+		return "", errors.New("not an auth route")
+	}
+
+	name := strings.SplitN(strings.TrimPrefix(path, authRoutePrefix), "/", 2)[0]
+	if _, err := goth.GetProvider(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// paramProvider checks the :provider route parameter. If it isn't a
+// registered provider, it makes an appropriate response with the
+// context and returns false.
+func paramProvider(c echo.Context) bool {
+	if _, err := goth.GetProvider(c.Param("provider")); err != nil {
+		c.JSON(404, bson.M{"error": "unknown provider"})
+		return false
+	}
+	return true
+}
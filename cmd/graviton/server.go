@@ -6,10 +6,10 @@ import (
 	"github.com/jslater89/graviton/auth"
 	"github.com/jslater89/graviton/config"
 	"github.com/jslater89/graviton/data"
+	"github.com/jslater89/graviton/notify"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"go.uber.org/zap"
-	"gopkg.in/mgo.v2/bson"
 )
 
 func main() {
@@ -17,48 +17,119 @@ func main() {
 	config := config.GetConfig()
 
 	auth.InitOauth(config.MongoAddress, config.GetDBName())
-	data.InitMongo(config.MongoAddress, config.GetDBName())
+	if err := data.InitMongo(config.MongoAddress, config.GetDBName()); err != nil {
+		graviton.Logger.Fatal("Unable to set up database", zap.Error(err))
+	}
 
 	if config.DemoData {
 		ensureDemoData()
 	}
 
-	e := echo.New()
-
-	e.GET("/api/v1/auth/google/login", auth.GoogleAuthLogin)
-	e.GET("/api/v1/auth/google/callback", auth.GoogleAuthCallback)
-	e.GET("/api/v1/auth/logout", auth.Logout)
-	e.GET("/api/v1/auth/apikey", auth.GetAPIKey)
-	e.POST("/api/v1/auth/apikey/reset", auth.ResetAPIKey)
-	e.GET("/api/v1/users/me", auth.GetSelf)
+	if config.CompletionCheckInterval > 0 {
+		go data.MonitorCompletion(data.CompletionOptions{
+			Threshold:  config.CompletionThreshold,
+			Window:     config.CompletionWindow,
+			AutoFinish: config.AutoFinishBatches,
+		}, config.CompletionCheckInterval)
+	}
 
-	e.GET("/api/v1/batches", api.QueryBatches) // returns lightweight batches: last reading and attenuation only
-	e.POST("/api/v1/batches", api.NewBatch)    // takes a BatchParam
+	if config.AlertCheckInterval > 0 {
+		go data.MonitorAlerts(config.AlertCheckInterval)
+	}
 
-	e.GET("/api/v1/batches/:id", api.GetBatch)              // returns full batch, including all readings
-	e.PUT("/api/v1/batches/:id", api.EditBatch)             // takes a BatchParam, use to start batches
-	e.POST("/api/v1/batch/:id/finish", api.FinishBatch)     // sets a batch inactive, releasing its hydrometer and stopping readings
-	e.DELETE("/api/v1/batch/:id/archive", api.ArchiveBatch) // sets a batch archived, removing it from default search results
+	if err := notify.ValidateChannels(config.NotificationChannels); err != nil {
+		graviton.Logger.Fatal("Bad notification channel config", zap.Error(err))
+	}
+	if config.NotifyInterval > 0 {
+		go notify.Run(config.NotifyInterval)
+	}
 
-	// Called by hydrometers; the API finds the correct
-	// batch by matching the hydrometer name.
-	e.POST("/api/v1/reading", api.AddReading)
+	e := echo.New()
 
-	e.GET("/api/v1/hydrometers", api.QueryHydrometers)
-	e.POST("/api/v1/hydrometers", api.NewHydrometer)
-	e.GET("/api/v1/hydrometers/available", api.QueryAvailableHydrometers) // gets all hydrometers not currently batch-assigned
+	// Every route declares who may use it; router.Authorize refuses
+	// routes that don't
+	router := auth.NewRouter(e)
 
-	e.GET("/api/v1/hydrometers/:id", api.GetHydrometer)
-	e.PUT("/api/v1/hydrometers/:id", api.EditHydrometer)
-	e.DELETE("/api/v1/hydrometers/:id", api.ArchiveHydrometer) // sets a hydrometer archived
+	// OAuth providers, named in config
+	if config.OAuthEnabled {
+		router.GET("/api/v1/auth/providers", auth.ListProviders, auth.Public())
+		router.GET("/api/v1/auth/:provider/login", auth.OAuthLogin, auth.Public())
+		router.GET("/api/v1/auth/:provider/callback", auth.OAuthCallback, auth.Public())
+		router.GET("/api/v1/auth/:provider/link", auth.OAuthLink, auth.LoggedIn()) // links another identity to the logged-in user
+	}
+	router.POST("/api/v1/auth/local/login", auth.LocalLogin, auth.Public())    // takes a LoginParam; returns a bearer token
+	router.POST("/api/v1/auth/local/reset", auth.ResetPassword, auth.Public()) // takes a ResetParam, with a token from an administrator
+	router.GET("/api/v1/auth/logout", auth.Logout, auth.LoggedIn())
+	router.GET("/api/v1/auth/apikey", auth.GetAPIKey, auth.Allow("/auth/apikey"))
+	router.POST("/api/v1/auth/apikey/reset", auth.ResetAPIKey, auth.Allow("/auth/apikey"))
+	router.GET("/api/v1/users/me", auth.GetSelf, auth.LoggedIn())
+	router.PUT("/api/v1/users/me/units", auth.SetUnits, auth.LoggedIn())          // e.g. {"units": "metric"} or {"units": "brix,c"}
+	router.PUT("/api/v1/users/me/password", auth.ChangePassword, auth.LoggedIn()) // takes a PasswordParam; ends the user's other sessions
+	router.GET("/api/v1/users/me/identities", auth.ListIdentities, auth.LoggedIn())
+	router.DELETE("/api/v1/users/me/identities/:id", auth.UnlinkIdentity, auth.LoggedIn())
+
+	router.GET("/api/v1/admin/users", auth.ListUsers, auth.Allow("/admin"))
+	router.POST("/api/v1/admin/users", auth.NewLocalUser, auth.Allow("/admin"))                 // takes a NewUserParam; returns a reset token to set a password
+	router.POST("/api/v1/admin/users/:id/reset", auth.IssuePasswordReset, auth.Allow("/admin")) // returns a reset token, shown only once
+	router.PUT("/api/v1/admin/users/:id/roles/:roleId", auth.GrantRole, auth.Allow("/admin"))
+	router.DELETE("/api/v1/admin/users/:id/roles/:roleId", auth.RevokeRole, auth.Allow("/admin")) // the last administrator can't be demoted
+	router.GET("/api/v1/admin/roles", auth.ListRoles, auth.Allow("/admin"))
+	router.POST("/api/v1/admin/roles", auth.NewRole, auth.Allow("/admin")) // takes a RoleParam
+	router.PUT("/api/v1/admin/roles/:id", auth.EditRole, auth.Allow("/admin"))
+	router.DELETE("/api/v1/admin/roles/:id", auth.DeleteRole, auth.Allow("/admin")) // custom roles only
+
+	router.GET("/api/v1/batches", api.QueryBatches, auth.Allow("/batches")) // returns lightweight batches: last reading and attenuation only
+	router.POST("/api/v1/batches", api.NewBatch, auth.Allow("/batches"))    // takes a BatchParam
+
+	router.GET("/api/v1/batches/:id", api.GetBatch, auth.Allow("/batches/:id"))                                    // returns full batch, including all readings
+	router.GET("/api/v1/batches/:id/readings", api.GetBatchReadings, auth.Allow("/batches/:id/readings"))          // paged; see GetBatchReadings for range and resolution parameters
+	router.GET("/api/v1/batches/:id/analytics", api.GetBatchAnalytics, auth.Allow("/batches/:id/analytics"))       // returns OG, attenuation, ABV and gravity rates
+	router.PUT("/api/v1/batches/:id", api.EditBatch, auth.Allow("/batches/:id"))                                   // takes a BatchParam, use to start batches
+	router.POST("/api/v1/batch/:id/finish", api.FinishBatch, auth.AllowTo(auth.ActionUpdate, "/batches/:id"))      // sets a batch inactive, releasing its hydrometer and stopping readings
+	router.DELETE("/api/v1/batch/:id/archive", api.ArchiveBatch, auth.AllowTo(auth.ActionArchive, "/batches/:id")) // sets a batch archived, removing it from default search results
+	router.PUT("/api/v1/batches/:id/owner", api.SetBatchOwner, auth.Allow("/batches/:id/owner"))                   // takes an OwnerParam; owners may do anything with their batches
+
+	router.POST("/api/v1/reprocess", api.ReprocessReadings, auth.AllowTo(auth.ActionUpdate, "/batches")) // a dry run unless apply is set
+	router.GET("/api/v1/reprocess", api.QueryReprocessings, auth.Allow("/batches"))                      // audit trail of applied reprocessings
+
+	router.GET("/api/v1/alerts", api.QueryAlerts, auth.Allow("/alerts")) // unresolved alerts by default; see QueryAlerts for filters
+	router.POST("/api/v1/alerts/:id/acknowledge", api.AcknowledgeAlert, auth.AllowTo(auth.ActionUpdate, "/alerts/:id"))
+	router.POST("/api/v1/alerts/:id/resolve", api.ResolveAlert, auth.AllowTo(auth.ActionUpdate, "/alerts/:id"))
+
+	router.GET("/api/v1/stream", api.StreamEvents, auth.LoggedIn()) // Server-Sent Events; see StreamEvents for subscriptions
+
+	// Called by hydrometers; the API finds the correct batch by
+	// matching the hydrometer's device ID, or its name if it has none.
+	router.POST("/api/v1/reading", api.AddReading, auth.Devices("/reading"))
+	router.POST("/api/v1/readings", api.AddReadings, auth.Devices("/reading"))                                                                // takes a BulkHydrometerReadings, for readings buffered offline
+	router.POST("/api/v1/reading/ispindel", api.AddISpindelReading, auth.Policy{Path: "/reading", Devices: true, Bearer: api.ISpindelBearer}) // takes iSpindel's HTTP service payload
+
+	router.GET("/api/v1/hydrometers", api.QueryHydrometers, auth.Allow("/hydrometers"))
+	router.POST("/api/v1/hydrometers", api.NewHydrometer, auth.Allow("/hydrometers"))
+	router.GET("/api/v1/hydrometers/available", api.QueryAvailableHydrometers, auth.Allow("/hydrometers")) // gets all hydrometers not currently batch-assigned
+
+	router.GET("/api/v1/hydrometers/:id", api.GetHydrometer, auth.Allow("/hydrometers/:id"))
+	router.PUT("/api/v1/hydrometers/:id", api.EditHydrometer, auth.Allow("/hydrometers/:id"))
+	router.DELETE("/api/v1/hydrometers/:id", api.ArchiveHydrometer, auth.AllowTo(auth.ActionArchive, "/hydrometers/:id")) // sets a hydrometer archived
+	router.PUT("/api/v1/hydrometers/:id/owner", api.SetHydrometerOwner, auth.Allow("/hydrometers/:id/owner"))
+
+	router.GET("/api/v1/hydrometers/:id/calibrations", api.GetCalibrations, auth.Allow("/hydrometers/:id/calibrations"))
+	router.POST("/api/v1/hydrometers/:id/calibrations", api.CalibrateHydrometer, auth.Allow("/hydrometers/:id/calibrations")) // fits a new calibration to angle/gravity points
+
+	router.GET("/api/v1/hydrometers/:id/tokens", auth.ListDeviceTokens, auth.Allow("/hydrometers/:id/tokens"))
+	router.POST("/api/v1/hydrometers/:id/tokens", auth.IssueDeviceToken, auth.Allow("/hydrometers/:id/tokens")) // response includes the token, shown only once
+	router.DELETE("/api/v1/hydrometers/:id/tokens/:tokenId", auth.RevokeDeviceToken, auth.Allow("/hydrometers/:id/tokens"))
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		Skipper:      middleware.DefaultCORSConfig.Skipper,
 		AllowOrigins: config.CorsOrigins,
 		AllowMethods: middleware.DefaultCORSConfig.AllowMethods,
+		// Paging headers on list endpoints
+		ExposeHeaders: []string{"X-Total-Count", "X-Next-Cursor"},
 	}))
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(router.Authorize)
 
 	if config.UseSSL {
 		e.StartTLS(config.ServerAddress, config.SSLCert, config.SSLKey)
@@ -71,7 +142,7 @@ func ensureDemoData() {
 	// Generate won't insert duplicates; it'll invalid-key it up
 	data.GenerateDemoData()
 
-	b, err := data.QueryBatches(bson.M{"recipe": "Hop Forward"})
+	b, err := data.QueryBatches(data.BatchQuery{RecipeName: "Hop Forward"})
 	if err != nil {
 		graviton.Logger.Warn("No batches", zap.Error(err))
 		return
@@ -82,7 +153,7 @@ func ensureDemoData() {
 		return
 	}
 
-	h, err := data.QueryHydrometers(bson.M{"name": "Blue Hydrometer"})
+	h, err := data.QueryHydrometers(data.HydrometerQuery{Name: "Blue Hydrometer"})
 	if err != nil {
 		graviton.Logger.Warn("No hydrometers", zap.Error(err))
 		return
@@ -93,7 +164,7 @@ func ensureDemoData() {
 		return
 	}
 
-	if len(b[0].GravityReadings) == 0 {
+	if b[0].ReadingCount == 0 {
 		b[0].SetHydrometer(h[0])
 		data.GenerateDemoReadings(b[0])
 	}
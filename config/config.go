@@ -2,6 +2,7 @@ package config
 
 import (
 	"flag"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -18,9 +19,60 @@ type Config struct {
 	CorsOrigins     []string `mapstructure:"corsOrigins"`
 	MongoAddress    string   `mapstructure:"mongoAddress"`
 	DBName          string   `mapstructure:"dbName"`
-	GoogleClientID  string   `mapstructure:"googleClientId"`
+	OAuthEnabled    bool     `mapstructure:"oauthEnabled"`
+	GoogleClientID  string   `mapstructure:"googleClientId"` // deprecated; see OAuthProviders
 	GoogleSecret    string   `mapstructure:"googleSecret"`
 	ServerRedirect  string   `mapstructure:"serverRedirect"`
+	AdminEmail      string   `mapstructure:"adminEmail"`
+
+	OAuthProviders []OAuthProvider `mapstructure:"oauthProviders"`
+
+	MaxReadingFutureSkew    time.Duration `mapstructure:"maxReadingFutureSkew"`
+	AutoRegisterHydrometers bool          `mapstructure:"autoRegisterHydrometers"`
+
+	CompletionThreshold     float64       `mapstructure:"completionThreshold"`
+	CompletionWindow        time.Duration `mapstructure:"completionWindow"`
+	CompletionCheckInterval time.Duration `mapstructure:"completionCheckInterval"`
+	AutoFinishBatches       bool          `mapstructure:"autoFinishBatches"`
+
+	AlertCheckInterval     time.Duration `mapstructure:"alertCheckInterval"`
+	AlertMinBatteryVoltage float64       `mapstructure:"alertMinBatteryVoltage"`
+	AlertSilentAfter       time.Duration `mapstructure:"alertSilentAfter"`
+	AlertStallWindow       time.Duration `mapstructure:"alertStallWindow"`
+	AlertStallThreshold    float64       `mapstructure:"alertStallThreshold"`
+	AlertStallAttenuation  float64       `mapstructure:"alertStallAttenuation"`
+
+	NotificationChannels []NotificationChannel `mapstructure:"notificationChannels"`
+	NotifyInterval       time.Duration         `mapstructure:"notifyInterval"`
+	SMTPAddress          string                `mapstructure:"smtpAddress"`
+	SMTPUsername         string                `mapstructure:"smtpUsername"`
+	SMTPPassword         string                `mapstructure:"smtpPassword"`
+	SMTPFrom             string                `mapstructure:"smtpFrom"`
+}
+
+// OAuthProvider is somewhere to log in with OAuth, at
+// /api/v1/auth/<name>/login.
+type OAuthProvider struct {
+	Name     string `mapstructure:"name"` // defaults to the type
+	Type     string `mapstructure:"type"` // oidc, github, gitlab or google
+	ClientID string `mapstructure:"clientId"`
+	Secret   string `mapstructure:"secret"`
+	// oidc only: the issuer's discovery document, like
+	// https://issuer/.well-known/openid-configuration
+	DiscoveryURL string   `mapstructure:"discoveryUrl"`
+	Scopes       []string `mapstructure:"scopes"` // besides the ones for an email address
+}
+
+// NotificationChannel is somewhere to send notifications of events.
+type NotificationChannel struct {
+	Name   string   `mapstructure:"name"`
+	Type   string   `mapstructure:"type"`   // webhook, email or slack
+	URL    string   `mapstructure:"url"`    // webhook and slack
+	Secret string   `mapstructure:"secret"` // webhook HMAC key
+	To     []string `mapstructure:"to"`     // email recipients
+	// Event types to send, like "batch.finished", or "alert" for every
+	// alert.* type. Every event is sent if empty.
+	Events []string `mapstructure:"events"`
 }
 
 func (c Config) GetDBName() string {
@@ -40,6 +92,31 @@ func OverrideTest(t bool) {
 	config.TestMode = true
 }
 
+func OverrideAdminEmail(email string) {
+	config.AdminEmail = email
+}
+
+func OverrideOAuthEnabled(enabled bool) {
+	config.OAuthEnabled = enabled
+}
+
+func OverrideOAuthProviders(providers []OAuthProvider) {
+	config.OAuthProviders = providers
+}
+
+func OverrideAutoRegister(autoRegister bool) {
+	config.AutoRegisterHydrometers = autoRegister
+}
+
+func OverrideNotificationChannels(channels []NotificationChannel) {
+	config.NotificationChannels = channels
+}
+
+func OverrideSMTP(address string, from string) {
+	config.SMTPAddress = address
+	config.SMTPFrom = from
+}
+
 func Load(configOverride *string) error {
 	var configFile *string
 	if flag.Lookup("testMode") == nil {
@@ -51,10 +128,29 @@ func Load(configOverride *string) error {
 		flag.String("serverAddress", "localhost:10000", "address to run the graviton service on")
 		flag.String("mongoAddress", "localhost", "address of the database instance to connect to")
 		flag.String("dbName", "graviton", "mongo db name to use")
-		flag.String("googleClientId", "", "google client ID for oauth2")
-		flag.String("googleSecret", "", "google secret for oauth2")
+		flag.Bool("oauthEnabled", true, "allow logging in with oauthProviders; local accounts work either way")
+		flag.String("googleClientId", "", "google client ID for oauth2; deprecated, use oauthProviders")
+		flag.String("googleSecret", "", "google secret for oauth2; deprecated, use oauthProviders")
 		flag.String("redirectAddress", "http://localhost:8080/#/authenticated", "address to redirect to after oauth, to get Graviton bearer token")
 		flag.String("serverRedirect", "http://localhost:10000", "external address to the server, for oauth redirects")
+		flag.String("adminEmail", "", "email of a user to make an administrator when they log in")
+		flag.Duration("maxReadingFutureSkew", 5*time.Minute, "how far in the future a device-supplied reading time may be")
+		flag.Bool("autoRegisterHydrometers", false, "create a hydrometer the first time an unknown device reports")
+		flag.Float64("completionThreshold", 0.002, "largest gravity change, in SG, over completionWindow for a batch to count as stable")
+		flag.Duration("completionWindow", 48*time.Hour, "how long gravity must hold steady for a batch to count as stable")
+		flag.Duration("completionCheckInterval", 15*time.Minute, "how often to check active batches for stable gravity; 0 disables checks")
+		flag.Bool("autoFinishBatches", false, "finish batches automatically once their gravity is stable, releasing their hydrometers")
+		flag.Duration("alertCheckInterval", 5*time.Minute, "how often to check alert rules, besides on every reading; 0 disables scheduled checks")
+		flag.Float64("alertMinBatteryVoltage", 3.5, "default battery voltage below which a hydrometer raises an alert; 0 disables")
+		flag.Duration("alertSilentAfter", time.Hour, "default time without a reading before an assigned hydrometer raises an alert; 0 disables")
+		flag.Duration("alertStallWindow", 24*time.Hour, "default period over which gravity must drop by alertStallThreshold; 0 disables stall alerts")
+		flag.Float64("alertStallThreshold", 0.002, "default gravity drop, in SG, below which fermentation has stalled")
+		flag.Float64("alertStallAttenuation", 0.6, "default apparent attenuation past which slow fermentation isn't a stall")
+		flag.Duration("notifyInterval", 30*time.Second, "how often to deliver queued notifications")
+		flag.String("smtpAddress", "", "host:port of the SMTP server for email notifications")
+		flag.String("smtpUsername", "", "SMTP username, if the server needs one")
+		flag.String("smtpPassword", "", "SMTP password")
+		flag.String("smtpFrom", "graviton@localhost", "sender address for email notifications")
 
 		configFile = flag.String("configFile", "config.toml", "the config file to use")
 		pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
@@ -0,0 +1,416 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/analytics"
+	"github.com/jslater89/graviton/config"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type AlertKind string
+
+const (
+	AlertTemperature AlertKind = "temperature" // latest reading outside the batch's range
+	AlertBattery     AlertKind = "battery"     // latest reading's battery voltage too low
+	AlertSilent      AlertKind = "silent"      // assigned hydrometer hasn't reported lately
+	AlertStalled     AlertKind = "stalled"     // gravity stopped dropping short of attenuation
+)
+
+var alertKinds = []AlertKind{AlertTemperature, AlertBattery, AlertSilent, AlertStalled}
+
+// ParseAlertKind checks an alert kind from user input.
+func ParseAlertKind(kind string) (AlertKind, error) {
+	for _, k := range alertKinds {
+		if string(k) == kind {
+			return k, nil
+		}
+	}
+	return "", errors.New("unknown alert kind " + kind)
+}
+
+type AlertState string
+
+const (
+	AlertOpen         AlertState = "open"
+	AlertAcknowledged AlertState = "acknowledged"
+	AlertResolved     AlertState = "resolved"
+)
+
+// UnresolvedAlertStates are the states of alerts still in effect.
+var UnresolvedAlertStates = []AlertState{AlertOpen, AlertAcknowledged}
+
+// ParseAlertState checks an alert state from user input.
+func ParseAlertState(state string) (AlertState, error) {
+	for _, s := range []AlertState{AlertOpen, AlertAcknowledged, AlertResolved} {
+		if string(s) == state {
+			return s, nil
+		}
+	}
+	return "", errors.New("unknown alert state " + state)
+}
+
+// ErrAlertResolved is returned when changing an alert that has already
+// been resolved.
+var ErrAlertResolved = errors.New("alert already resolved")
+
+// AlertRules say when a batch raises alerts. A zero field disables its
+// rule, except in a batch's own rules, where it falls back to
+// DefaultAlertRules; batches turn rules off by listing them in Disabled.
+type AlertRules struct {
+	MinTemperature    float64       `bson:"minTemperature,omitempty"` // °F
+	MaxTemperature    float64       `bson:"maxTemperature,omitempty"` // °F
+	MinBatteryVoltage float64       `bson:"minBatteryVoltage,omitempty"`
+	SilentAfter       time.Duration `bson:"silentAfter,omitempty"`
+
+	// Gravity has stalled if it drops less than StallThreshold over
+	// StallWindow, before reaching StallAttenuation apparent attenuation.
+	StallWindow      time.Duration `bson:"stallWindow,omitempty"`
+	StallThreshold   float64       `bson:"stallThreshold,omitempty"`
+	StallAttenuation float64       `bson:"stallAttenuation,omitempty"`
+
+	// Rules that are off, whatever the defaults say
+	Disabled []AlertKind `bson:"disabled,omitempty"`
+}
+
+// DefaultAlertRules returns the configured rules for batches that don't
+// set their own.
+func DefaultAlertRules() AlertRules {
+	c := config.GetConfig()
+	return AlertRules{
+		MinBatteryVoltage: c.AlertMinBatteryVoltage,
+		SilentAfter:       c.AlertSilentAfter,
+		StallWindow:       c.AlertStallWindow,
+		StallThreshold:    c.AlertStallThreshold,
+		StallAttenuation:  c.AlertStallAttenuation,
+	}
+}
+
+// WithDefaults returns r with its zero fields taken from defaults, and
+// the fields of its disabled rules zeroed.
+func (r AlertRules) WithDefaults(defaults AlertRules) AlertRules {
+	if r.MinTemperature == 0 {
+		r.MinTemperature = defaults.MinTemperature
+	}
+	if r.MaxTemperature == 0 {
+		r.MaxTemperature = defaults.MaxTemperature
+	}
+	if r.MinBatteryVoltage == 0 {
+		r.MinBatteryVoltage = defaults.MinBatteryVoltage
+	}
+	if r.SilentAfter == 0 {
+		r.SilentAfter = defaults.SilentAfter
+	}
+	if r.StallWindow == 0 {
+		r.StallWindow = defaults.StallWindow
+	}
+	if r.StallThreshold == 0 {
+		r.StallThreshold = defaults.StallThreshold
+	}
+	if r.StallAttenuation == 0 {
+		r.StallAttenuation = defaults.StallAttenuation
+	}
+
+	for _, kind := range r.Disabled {
+		switch kind {
+		case AlertTemperature:
+			r.MinTemperature, r.MaxTemperature = 0, 0
+		case AlertBattery:
+			r.MinBatteryVoltage = 0
+		case AlertSilent:
+			r.SilentAfter = 0
+		case AlertStalled:
+			r.StallWindow = 0
+		}
+	}
+	r.Disabled = nil
+	return r
+}
+
+// Alert is a problem with a batch. It stays open until acknowledged by
+// a user, and is resolved when its condition clears or a user resolves
+// it. A batch has at most one unresolved alert of each kind.
+type Alert struct {
+	ID           bson.ObjectId `json:"id" bson:"_id"`
+	Kind         AlertKind     `json:"kind" bson:"kind"`
+	State        AlertState    `json:"state" bson:"state"`
+	BatchID      bson.ObjectId `json:"batch" bson:"batch"`
+	HydrometerID bson.ObjectId `json:"hydrometer" bson:"hydrometer"`
+	Message      string        `json:"message" bson:"message"`
+	// What raised the alert: °F, volts, minutes silent or gravity
+	Value float64 `json:"value" bson:"value"`
+
+	OpenedAt       time.Time `json:"openedAt" bson:"openedAt"`
+	AcknowledgedAt time.Time `json:"acknowledgedAt,omitempty" bson:"acknowledgedAt,omitempty"`
+	AcknowledgedBy string    `json:"acknowledgedBy,omitempty" bson:"acknowledgedBy,omitempty"`
+	ResolvedAt     time.Time `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+	// Empty when the condition cleared by itself
+	ResolvedBy string `json:"resolvedBy,omitempty" bson:"resolvedBy,omitempty"`
+}
+
+func QueryAlerts(query AlertQuery) ([]*Alert, error) {
+	return store.QueryAlerts(query)
+}
+
+func SingleAlert(query AlertQuery) (*Alert, error) {
+	alerts, err := store.QueryAlerts(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(alerts) != 1 {
+		return nil, ErrNotFound
+	}
+
+	return alerts[0], nil
+}
+
+// Acknowledge marks an open alert as seen by user.
+func (a *Alert) Acknowledge(user string) error {
+	if a.State == AlertResolved {
+		return ErrAlertResolved
+	}
+	if a.State == AlertAcknowledged {
+		return nil
+	}
+
+	a.State = AlertAcknowledged
+	a.AcknowledgedAt = time.Now()
+	a.AcknowledgedBy = user
+	return store.SaveAlert(a)
+}
+
+// Resolve closes an alert on user's say-so. If its condition persists,
+// the next check opens a new one.
+func (a *Alert) Resolve(user string) error {
+	if a.State == AlertResolved {
+		return ErrAlertResolved
+	}
+
+	a.State = AlertResolved
+	a.ResolvedAt = time.Now()
+	a.ResolvedBy = user
+	return store.SaveAlert(a)
+}
+
+// alertCondition is a rule's verdict on a batch.
+type alertCondition struct {
+	firing  bool
+	value   float64
+	message string
+}
+
+// CheckAlerts evaluates b's alert rules, falling back to defaults, as
+// of now. It opens alerts for conditions that have started, resolves
+// those whose conditions have cleared, and returns the alerts it opened.
+func (b *Batch) CheckAlerts(defaults AlertRules, now time.Time) ([]*Alert, error) {
+	rules := b.AlertRules.WithDefaults(defaults)
+
+	conditions := map[AlertKind]alertCondition{}
+	if b.Active {
+		conditions[AlertTemperature] = b.temperatureCondition(rules)
+		conditions[AlertBattery] = b.batteryCondition(rules)
+		conditions[AlertSilent] = b.silentCondition(rules, now)
+
+		stalled, err := b.stalledCondition(rules)
+		if err != nil {
+			return nil, err
+		}
+		conditions[AlertStalled] = stalled
+	}
+
+	unresolved, err := store.QueryAlerts(AlertQuery{BatchID: b.ID, States: UnresolvedAlertStates})
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[AlertKind]*Alert{}
+	for _, a := range unresolved {
+		existing[a.Kind] = a
+	}
+
+	opened := []*Alert{}
+	for _, kind := range alertKinds {
+		condition := conditions[kind]
+		alert := existing[kind]
+
+		if condition.firing && alert == nil {
+			alert = &Alert{
+				ID:           bson.NewObjectId(),
+				Kind:         kind,
+				State:        AlertOpen,
+				BatchID:      b.ID,
+				HydrometerID: b.HydrometerID,
+				Message:      condition.message,
+				Value:        condition.value,
+				OpenedAt:     now,
+			}
+			err = store.SaveAlert(alert)
+			if err == nil {
+				Notify(b.alertEvent(alert))
+			}
+			opened = append(opened, alert)
+		} else if !condition.firing && alert != nil {
+			alert.State = AlertResolved
+			alert.ResolvedAt = now
+			err = store.SaveAlert(alert)
+		}
+
+		if err != nil {
+			return opened, err
+		}
+	}
+
+	return opened, nil
+}
+
+func (b *Batch) temperatureCondition(rules AlertRules) alertCondition {
+	// Zero is a hydrometer that doesn't report temperature
+	t := b.LatestReading.Temperature
+	if b.ReadingCount == 0 || t == 0 {
+		return alertCondition{}
+	}
+
+	if rules.MinTemperature != 0 && t < rules.MinTemperature {
+		return alertCondition{true, t, fmt.Sprintf("Temperature %.1f°F is below %.1f°F", t, rules.MinTemperature)}
+	}
+	if rules.MaxTemperature != 0 && t > rules.MaxTemperature {
+		return alertCondition{true, t, fmt.Sprintf("Temperature %.1f°F is above %.1f°F", t, rules.MaxTemperature)}
+	}
+	return alertCondition{}
+}
+
+func (b *Batch) batteryCondition(rules AlertRules) alertCondition {
+	v := b.LatestReading.BatteryVoltage
+	if b.ReadingCount == 0 || v == 0 || rules.MinBatteryVoltage == 0 {
+		return alertCondition{}
+	}
+
+	if v < rules.MinBatteryVoltage {
+		return alertCondition{true, v, fmt.Sprintf("Battery at %.2fV is below %.2fV", v, rules.MinBatteryVoltage)}
+	}
+	return alertCondition{}
+}
+
+func (b *Batch) silentCondition(rules AlertRules, now time.Time) alertCondition {
+	if rules.SilentAfter == 0 || b.HydrometerID == "" || b.HydrometerID == graviton.EmptyID() {
+		return alertCondition{}
+	}
+
+	// A new batch has until SilentAfter past its start to report
+	last := b.StartDate
+	if b.ReadingCount > 0 {
+		last = b.LatestReading.Date
+	}
+
+	silence := now.Sub(last)
+	if silence > rules.SilentAfter {
+		minutes := silence.Minutes()
+		return alertCondition{true, minutes, fmt.Sprintf("No reading for %.0f minutes", minutes)}
+	}
+	return alertCondition{}
+}
+
+func (b *Batch) stalledCondition(rules AlertRules) (alertCondition, error) {
+	if rules.StallWindow == 0 || b.ReadingCount < 2 {
+		return alertCondition{}, nil
+	}
+
+	end := b.LatestReading.Date
+	start := end.Add(-rules.StallWindow)
+	if b.FirstReading.Date.After(start) {
+		// Too early to tell
+		return alertCondition{}, nil
+	}
+
+	cg := b.CurrentGravity
+	attenuation := analytics.ApparentAttenuation(b.OriginalGravity, cg)
+	if attenuation >= rules.StallAttenuation {
+		return alertCondition{}, nil
+	}
+
+	readings, err := b.QueryReadings(ReadingQuery{From: start, Hidden: Bool(false)})
+	if err != nil {
+		return alertCondition{}, err
+	}
+
+	days := rules.StallWindow.Hours() / 24
+	drop := -analytics.GravityRate(AnalyticsReadings(readings), rules.StallWindow) * days
+	if len(readings) < 2 || drop >= rules.StallThreshold {
+		return alertCondition{}, nil
+	}
+
+	return alertCondition{true, cg, fmt.Sprintf("Gravity dropped %.4f in %s, at %.0f%% attenuation",
+		drop, rules.StallWindow, attenuation*100)}, nil
+}
+
+// CheckAllAlerts runs CheckAlerts on every active batch, and resolves
+// alerts left over on batches that have since finished. Failures are
+// logged, and don't stop the other batches being checked.
+func CheckAllAlerts(defaults AlertRules) {
+	now := time.Now()
+
+	batches, err := QueryBatches(BatchQuery{Active: Bool(true)})
+	if err != nil {
+		graviton.Logger.Error("Failed to query active batches", zap.Error(err))
+		return
+	}
+
+	checked := map[bson.ObjectId]bool{}
+	for _, b := range batches {
+		checked[b.ID] = true
+		CheckBatchAlerts(b, defaults, now)
+	}
+
+	unresolved, err := store.QueryAlerts(AlertQuery{States: UnresolvedAlertStates})
+	if err != nil {
+		graviton.Logger.Error("Failed to query unresolved alerts", zap.Error(err))
+		return
+	}
+
+	for _, a := range unresolved {
+		if checked[a.BatchID] {
+			continue
+		}
+		checked[a.BatchID] = true
+
+		b, err := SingleBatch(BatchQuery{ID: a.BatchID})
+		if err != nil {
+			graviton.Logger.Warn("Failed to load batch for alert", zap.String("AlertID", a.ID.Hex()), zap.Error(err))
+			continue
+		}
+		CheckBatchAlerts(b, defaults, now)
+	}
+}
+
+// CheckBatchAlerts runs b.CheckAlerts, logging the alerts it opens.
+// Failures are logged too, for callers with nothing better to do.
+func CheckBatchAlerts(b *Batch, defaults AlertRules, now time.Time) {
+	opened, err := b.CheckAlerts(defaults, now)
+
+	if err != nil {
+		graviton.Logger.Warn("Failed to check batch alerts",
+			zap.String("BatchID", b.ID.Hex()),
+			zap.Error(err))
+	}
+
+	for _, a := range opened {
+		graviton.Logger.Info("Alert opened",
+			zap.String("BatchID", b.ID.Hex()),
+			zap.String("Kind", string(a.Kind)),
+			zap.String("Message", a.Message))
+	}
+}
+
+// MonitorAlerts runs CheckAllAlerts with DefaultAlertRules every
+// interval. It never returns, so run it in its own goroutine.
+func MonitorAlerts(interval time.Duration) {
+	for range time.Tick(interval) {
+		CheckAllAlerts(DefaultAlertRules())
+	}
+}
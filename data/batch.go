@@ -4,9 +4,8 @@ import (
 	"errors"
 	"time"
 
-	"gopkg.in/mgo.v2"
-
 	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/analytics"
 	"go.uber.org/zap"
 
 	"gopkg.in/mgo.v2/bson"
@@ -21,15 +20,10 @@ func (b *Batch) Save() error {
 		b.ID = bson.NewObjectId()
 	}
 
-	_, err := db.batchCollection.UpsertId(b.ID, *b)
-
-	if err != nil {
-		return err
-	}
-	return nil
+	return store.SaveBatch(b)
 }
 
-func SingleBatch(query bson.M) (*Batch, error) {
+func SingleBatch(query BatchQuery) (*Batch, error) {
 	batches, err := QueryBatches(query)
 
 	if err != nil {
@@ -42,26 +36,25 @@ func SingleBatch(query bson.M) (*Batch, error) {
 	}
 
 	if len(batches) < 1 {
-		return nil, mgo.ErrNotFound
+		return nil, ErrNotFound
 	}
 
 	return batches[0], nil
 }
 
-func QueryBatches(query bson.M) ([]*Batch, error) {
-	batches := []*Batch{}
-	err := db.batchCollection.Find(query).All(&batches)
-	return batches, err
+func QueryBatches(query BatchQuery) ([]*Batch, error) {
+	return store.QueryBatches(query)
 }
 
 func AddBatch(b *Batch) (*Batch, error) {
 	newBatch := &Batch{
-		RecipeName:      b.RecipeName,
-		StartDate:       b.StartDate,
-		UniqueID:        b.UniqueID,
-		Active:          b.Active,
-		Archived:        b.Archived,
-		GravityReadings: []GravityReading{},
+		RecipeName: b.RecipeName,
+		StartDate:  b.StartDate,
+		UniqueID:   b.UniqueID,
+		Active:     b.Active,
+		Archived:   b.Archived,
+		AlertRules: b.AlertRules,
+		OwnerID:    b.OwnerID,
 	}
 
 	err := newBatch.Save()
@@ -72,10 +65,14 @@ func AddBatch(b *Batch) (*Batch, error) {
 
 	err = newBatch.SetHydrometerID(b.HydrometerID)
 
-	if err != nil && err != mgo.ErrNotFound {
+	if err != nil && err != ErrNotFound {
 		return nil, err
 	}
 
+	if newBatch.Active {
+		publish(BatchStarted{Batch: newBatch})
+	}
+
 	return newBatch, nil
 }
 
@@ -84,11 +81,11 @@ func (b *Batch) SetHydrometerID(hID bson.ObjectId) error {
 		hID = graviton.EmptyID()
 	}
 
-	hydrometer, err := SingleHydrometer(bson.M{"_id": hID})
+	hydrometer, err := SingleHydrometer(HydrometerQuery{ID: hID})
 
-	if err != nil && err != mgo.ErrNotFound {
+	if err != nil && err != ErrNotFound {
 		return err
-	} else if err != nil && err == mgo.ErrNotFound {
+	} else if err != nil && err == ErrNotFound {
 		return b.SetHydrometer(&Hydrometer{ID: graviton.EmptyID()})
 	}
 
@@ -99,7 +96,7 @@ func (b *Batch) SetHydrometer(h *Hydrometer) error {
 	// TODO: test case for this block: setting a hydrometer on a batch
 	// should unset the batch's original hydrometer's batch
 	if b.HydrometerID != "" && b.HydrometerID != graviton.EmptyID() {
-		hydrometer, err := SingleHydrometer(bson.M{"_id": b.HydrometerID})
+		hydrometer, err := SingleHydrometer(HydrometerQuery{ID: b.HydrometerID})
 
 		if err != nil {
 			return err
@@ -112,6 +109,7 @@ func (b *Batch) SetHydrometer(h *Hydrometer) error {
 		}
 	}
 
+	assigned := b.HydrometerID != h.ID
 	b.HydrometerID = h.ID
 	h.CurrentBatchID = b.ID
 
@@ -125,75 +123,292 @@ func (b *Batch) SetHydrometer(h *Hydrometer) error {
 		if err != nil {
 			return err
 		}
+
+		if assigned {
+			publish(HydrometerAssigned{Hydrometer: h, Batch: b})
+		}
 	}
 
 	return nil
 }
 
+// Start makes b active with hydrometer h, which may be a hydrometer
+// with graviton.EmptyID for none.
+func (b *Batch) Start(h *Hydrometer) error {
+	b.Active = true
+
+	err := b.SetHydrometer(h)
+	if err != nil {
+		return err
+	}
+
+	publish(BatchStarted{Batch: b})
+	return nil
+}
+
+// ErrDuplicateReading is returned by AddReading for a reading the
+// batch already has, as when a device retries an upload.
+var ErrDuplicateReading = errors.New("duplicate reading")
+
+// duplicateReadingWindow is how close in time two readings with the
+// same values must be to count as duplicates. Resent readings dated
+// from their age can be off by a little.
+const duplicateReadingWindow = 2 * time.Second
+
+// AddReading stores a reading for this batch. The batch's reading
+// summary is updated in the store atomically, so concurrent readings
+// and edits don't overwrite one another; b is then refreshed from it.
+// A reading from the same device at the same time is a duplicate, as
+// is one with the same values within duplicateReadingWindow; the store
+// enforces the first, so concurrent retries are caught too.
 func (b *Batch) AddReading(r GravityReading) error {
 	r.Hidden = false
 
 	if r.ID == "" {
 		r.ID = bson.NewObjectId()
 	}
+	r.BatchID = b.ID
 
-	// Insert at the correct time
-	insertBefore := 0
-	for i, reading := range b.GravityReadings {
-		insertBefore = i
-		if r.Date.Before(reading.Date) {
-			break
-		}
+	nearby, err := store.QueryReadings(ReadingQuery{
+		BatchID: b.ID,
+		From:    r.Date.Add(-duplicateReadingWindow),
+		To:      r.Date.Add(duplicateReadingWindow),
+	})
+	if err != nil {
+		return err
+	}
 
-		if i == len(b.GravityReadings) - 1 {
-			insertBefore = -1;
+	for _, other := range nearby {
+		if other.Gravity == r.Gravity && other.Temperature == r.Temperature {
+			return ErrDuplicateReading
 		}
 	}
 
-	var readings []GravityReading
-	if insertBefore > 0 {
-		readings = append(b.GravityReadings[:insertBefore], append([]GravityReading{r}, b.GravityReadings[insertBefore:]...)...)
-	} else {
-		readings = append(b.GravityReadings, r)
+	err = store.AddReading(&r, time.Now())
+	if err == ErrDuplicateKey {
+		return ErrDuplicateReading
+	} else if err != nil {
+		return err
 	}
 
-	b.GravityReadings = readings
-	b.LastUpdate = time.Now()
-	return b.Save()
+	err = b.updateEstimates()
+	if err != nil {
+		return err
+	}
+
+	err = b.refreshSummary()
+	if err != nil {
+		return err
+	}
+
+	publish(ReadingAdded{Batch: b, Reading: r})
+	return nil
 }
 
+// Readings returns all of this batch's readings, oldest first.
+func (b *Batch) Readings() ([]GravityReading, error) {
+	return store.QueryReadings(ReadingQuery{BatchID: b.ID})
+}
+
+// QueryReadings returns the batch's readings matching query, whatever
+// batch the query names.
+func (b *Batch) QueryReadings(query ReadingQuery) ([]GravityReading, error) {
+	query.BatchID = b.ID
+	return store.QueryReadings(query)
+}
+
+// QueryBatchSummaries finds batches like QueryBatches, loading only
+// what's needed to list them.
+func QueryBatchSummaries(query BatchQuery) ([]*BatchSummary, error) {
+	return store.QueryBatchSummaries(query)
+}
+
+// CountBatches counts the batches query matches, ignoring its cursor
+// and limit, for totals when paging.
+func CountBatches(query BatchQuery) (int, error) {
+	return store.CountBatches(query)
+}
+
+// summary returns b's summary fields. The hydrometer name is left for
+// the store to fill in.
+func (b *Batch) summary() *BatchSummary {
+	return &BatchSummary{
+		ID:            b.ID,
+		RecipeName:    b.RecipeName,
+		UniqueID:      b.UniqueID,
+		HydrometerID:  b.HydrometerID,
+		FirstReading:  b.FirstReading,
+		LatestReading: b.LatestReading,
+		ReadingCount:  b.ReadingCount,
+		StartDate:     b.StartDate,
+		LastUpdate:    b.LastUpdate,
+		Active:        b.Active,
+		Archived:      b.Archived,
+		Stable:        b.Stable,
+		FinalGravity:  b.FinalGravity,
+		Version:       b.Version,
+
+		OriginalGravity: b.OriginalGravity,
+		CurrentGravity:  b.CurrentGravity,
+	}
+}
+
+// HideReadingID hides one of the batch's readings, leaving it out of
+// the reading summary and analytics.
 func (b *Batch) HideReadingID(id bson.ObjectId) error {
-	for i, reading := range b.GravityReadings {
-		if reading.ID == id {
-			reading.Hidden = true
+	return b.setReadingHidden(id, true)
+}
+
+// UnhideReadingID shows a hidden reading again.
+func (b *Batch) UnhideReadingID(id bson.ObjectId) error {
+	return b.setReadingHidden(id, false)
+}
+
+func (b *Batch) setReadingHidden(id bson.ObjectId, hidden bool) error {
+	readings, err := store.QueryReadings(ReadingQuery{ID: id, BatchID: b.ID})
+	if err != nil {
+		return err
+	}
+
+	if len(readings) == 0 {
+		return errors.New("reading not found")
+	}
+
+	reading := readings[0]
+	reading.Hidden = hidden
+
+	err = store.SaveReading(&reading)
+	if err != nil {
+		return err
+	}
+
+	return b.recomputeSummary()
+}
+
+// recomputeSummary rebuilds the batch's first and latest readings and
+// gravity estimates from its visible readings, then refreshes b.
+func (b *Batch) recomputeSummary() error {
+	var ends [2]GravityReading
 
-			readings := append(b.GravityReadings[:i], reading)
-			readings = append(readings, b.GravityReadings[i+1:]...)
-			b.GravityReadings = readings
-			return b.Save()
+	for i, reverse := range []bool{false, true} {
+		readings, err := b.QueryReadings(ReadingQuery{Hidden: Bool(false), Limit: 1, Reverse: reverse})
+		if err != nil {
+			return err
+		}
+		if len(readings) > 0 {
+			ends[i] = readings[0]
 		}
 	}
-	return errors.New("reading not found")
+
+	err := store.SaveReadingEnds(b.ID, ends[0], ends[1])
+	if err != nil {
+		return err
+	}
+
+	err = b.updateEstimates()
+	if err != nil {
+		return err
+	}
+
+	return b.refreshSummary()
+}
+
+// refreshSummary copies the stored reading summary into b, leaving
+// any unsaved edits to other fields alone.
+func (b *Batch) refreshSummary() error {
+	stored, err := SingleBatch(BatchQuery{ID: b.ID})
+	if err != nil {
+		return err
+	}
+
+	b.FirstReading = stored.FirstReading
+	b.LatestReading = stored.LatestReading
+	b.ReadingCount = stored.ReadingCount
+	b.LastUpdate = stored.LastUpdate
+	b.OriginalGravity = stored.OriginalGravity
+	b.CurrentGravity = stored.CurrentGravity
+	return nil
+}
+
+// updateEstimates recomputes the batch's gravity estimates and saves
+// them. Analyze finds original and current gravity from the readings
+// at either end of the series, so only those are loaded. Readings
+// added concurrently may leave the estimates a reading behind until
+// the next one.
+func (b *Batch) updateEstimates() error {
+	opts := analytics.DefaultOptions()
+	opts.RateWindows = nil
+
+	ends := opts.OGSamples
+	if opts.CurrentSamples > ends {
+		ends = opts.CurrentSamples
+	}
+
+	readings, err := b.QueryReadings(ReadingQuery{Hidden: Bool(false), Limit: ends})
+	if err != nil {
+		return err
+	}
+
+	if len(readings) == ends {
+		latest, err := b.QueryReadings(ReadingQuery{Hidden: Bool(false), Limit: ends, Reverse: true})
+		if err != nil {
+			return err
+		}
+
+		loaded := map[bson.ObjectId]bool{}
+		for _, r := range readings {
+			loaded[r.ID] = true
+		}
+		for _, r := range latest {
+			if !loaded[r.ID] {
+				readings = append(readings, r)
+			}
+		}
+	}
+
+	summary := analytics.Analyze(AnalyticsReadings(readings), opts)
+	return store.SaveGravityEstimates(b.ID, summary.OriginalGravity, summary.CurrentGravity)
+}
+
+func (b *Batch) includeReading(r GravityReading) {
+	// The ends are empty until there's a visible reading
+	if b.FirstReading.ID == "" || r.Date.Before(b.FirstReading.Date) {
+		b.FirstReading = r
+	}
+
+	if b.LatestReading.ID == "" || !r.Date.Before(b.LatestReading.Date) {
+		b.LatestReading = r
+	}
+
+	b.ReadingCount++
 }
 
 func (b *Batch) FinishBatch() error {
 	b.Active = false
 	b.LastUpdate = time.Now()
 
-	hydrometers, err := QueryHydrometers(bson.M{"_id": b.HydrometerID})
-
+	err := b.Save()
 	if err != nil {
 		return err
 	}
 
-	h := hydrometers[0]
-	h.CurrentBatchID = graviton.EmptyID()
+	publish(BatchFinished{Batch: b})
 
-	err = b.Save()
-	if err != nil {
+	// Batches without a hydrometer have nothing to release
+	if b.HydrometerID == "" || b.HydrometerID == graviton.EmptyID() {
+		return nil
+	}
+
+	h, err := SingleHydrometer(HydrometerQuery{ID: b.HydrometerID})
+
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
 		return err
 	}
 
+	h.CurrentBatchID = graviton.EmptyID()
+
 	return h.Save()
 }
 
@@ -206,20 +421,59 @@ func (b *Batch) ArchiveBatch() error {
 	}
 
 	b.Archived = true
-	return b.Save()
+	err := b.Save()
+	if err != nil {
+		return err
+	}
+
+	publish(BatchArchived{Batch: b})
+	return nil
+}
+
+// CalculateGravityDelta returns how far the batch's gravity has
+// dropped from its original gravity.
+func (b *Batch) CalculateGravityDelta() (float64, error) {
+	summary, err := b.Analyze(analytics.DefaultOptions())
+	if err != nil {
+		return 0, err
+	}
+
+	return summary.OriginalGravity - summary.CurrentGravity, nil
+}
+
+// Analyze computes fermentation statistics over the batch's
+// visible readings.
+func (b *Batch) Analyze(opts analytics.Options) (analytics.Summary, error) {
+	readings, err := b.Readings()
+	if err != nil {
+		return analytics.Summary{}, err
+	}
+
+	return analytics.Analyze(AnalyticsReadings(readings), opts), nil
 }
 
-func (b *Batch) CalculateGravityDelta() float64 {
-	return 1.0
+// AnalyticsReadings converts readings for the analytics package,
+// leaving out hidden readings.
+func AnalyticsReadings(readings []GravityReading) []analytics.Reading {
+	converted := []analytics.Reading{}
+	for _, r := range readings {
+		if !r.Hidden {
+			converted = append(converted, analytics.Reading{
+				Date:    r.Date,
+				Gravity: r.EffectiveGravity(),
+			})
+		}
+	}
+	return converted
 }
 
 func (b *Batch) verify() error {
 	if b.HydrometerID == "" {
 		b.HydrometerID = graviton.EmptyID()
 	} else if b.HydrometerID != graviton.EmptyID() {
-		query := bson.M{
-			"hydrometer": b.HydrometerID,
-			"active":     true,
+		query := BatchQuery{
+			HydrometerID: b.HydrometerID,
+			Active:       Bool(true),
 		}
 
 		batches, err := QueryBatches(query)
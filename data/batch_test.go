@@ -1,12 +1,18 @@
 package data
 
 import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/analytics"
+	"github.com/jslater89/graviton/config"
 )
 
 // Batch tests happen to cover all the current hydrometer features, too.
@@ -109,13 +115,9 @@ func TestAddGravityReading(t *testing.T) {
 		Temperature:    68.9,
 	})
 
-	for i, reading := range flueSeason.GravityReadings {
-		if i == 1 {
-			if reading.ID != newReadingID {
-				t.Errorf("Reading not sorted by time: id %v in %v\n", newReadingID, flueSeason.GravityReadings)
-			}
-			break
-		}
+	readings, _ := flueSeason.Readings()
+	if len(readings) < 2 || readings[1].ID != newReadingID {
+		t.Errorf("Reading not sorted by time: id %v in %v\n", newReadingID, readings)
 	}
 
 	newReadingID = bson.NewObjectId()
@@ -127,10 +129,72 @@ func TestAddGravityReading(t *testing.T) {
 		Temperature:    71.2,
 	})
 
-	reading := flueSeason.GravityReadings[len(flueSeason.GravityReadings)-1]
+	readings, _ = flueSeason.Readings()
+	reading := readings[len(readings)-1]
 
 	if reading.ID != newReadingID {
-		t.Errorf("Reading not sorted by time: id %v in %v\n", newReadingID, flueSeason.GravityReadings)
+		t.Errorf("Reading not sorted by time: id %v in %v\n", newReadingID, readings)
+	}
+
+	if flueSeason.LatestReading.ID != newReadingID || flueSeason.ReadingCount != len(readings) {
+		t.Errorf("Batch reading summary not updated: %v\n", flueSeason.LatestReading)
+	}
+
+	CleanupTestData()
+}
+
+func TestDuplicateGravityReading(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	_, _, flueSeason, _ := GetTestObjects()
+
+	reading := GravityReading{
+		BatteryVoltage: 3.7,
+		Date:           time.Now().Add(time.Minute * 45),
+		Gravity:        1.073,
+		Temperature:    68.9,
+	}
+
+	err := flueSeason.AddReading(reading)
+
+	if err != nil {
+		t.Errorf("Unable to add reading: %v\n", err)
+	}
+
+	reading.Date = reading.Date.Add(time.Second)
+	err = flueSeason.AddReading(reading)
+
+	if err != ErrDuplicateReading {
+		t.Errorf("Added duplicate reading: %v\n", err)
+	}
+
+	reading.Gravity = 1.072
+	err = flueSeason.AddReading(reading)
+
+	if err != nil {
+		t.Errorf("Unable to add distinct reading: %v\n", err)
+	}
+
+	// The same device can't report twice at once, whatever the values
+	reading.DeviceID = "a4cf12"
+	reading.Date = reading.Date.Add(time.Hour)
+	err = flueSeason.AddReading(reading)
+
+	if err != nil {
+		t.Errorf("Unable to add reading from a device: %v\n", err)
+	}
+
+	reading.Gravity = 1.071
+	err = flueSeason.AddReading(reading)
+
+	if err != ErrDuplicateReading {
+		t.Errorf("Added two readings from a device at once: %v\n", err)
+	}
+
+	readings, _ := flueSeason.Readings()
+	if flueSeason.ReadingCount != len(readings) {
+		t.Errorf("Duplicate counted: %d readings, count %d\n", len(readings), flueSeason.ReadingCount)
 	}
 
 	CleanupTestData()
@@ -142,20 +206,33 @@ func TestHideGravityReading(t *testing.T) {
 
 	_, _, flueSeason, _ := GetTestObjects()
 
-	for i, reading := range flueSeason.GravityReadings {
-		if i == 1 {
-			flueSeason.HideReadingID(reading.ID)
-			break
-		}
+	readings, _ := flueSeason.Readings()
+	flueSeason.HideReadingID(readings[1].ID)
+
+	readings, _ = flueSeason.Readings()
+	if !readings[1].Hidden {
+		t.Errorf("Not correctly hidden")
 	}
 
-	for i, reading := range flueSeason.GravityReadings {
-		if i == 1 {
-			if !reading.Hidden {
-				t.Errorf("Not correctly hidden")
-				break
-			}
-		}
+	// Hidden readings drop out of the summary
+	flueSeason.HideReadingID(readings[0].ID)
+	flueSeason.HideReadingID(readings[3].ID)
+
+	_, _, flueSeason, _ = GetTestObjects()
+	summary, _ := flueSeason.Analyze(analytics.DefaultOptions())
+
+	if flueSeason.FirstReading.ID != readings[2].ID || flueSeason.LatestReading.ID != readings[2].ID {
+		t.Errorf("Summary includes hidden readings: %v %v", flueSeason.FirstReading, flueSeason.LatestReading)
+	}
+	if flueSeason.OriginalGravity != summary.OriginalGravity || flueSeason.CurrentGravity != readings[2].Gravity {
+		t.Errorf("Estimates include hidden readings: %v %v", flueSeason.OriginalGravity, flueSeason.CurrentGravity)
+	}
+
+	flueSeason.UnhideReadingID(readings[3].ID)
+
+	_, _, flueSeason, _ = GetTestObjects()
+	if flueSeason.LatestReading.ID != readings[3].ID || flueSeason.LatestReading.Hidden {
+		t.Errorf("Unhidden reading not in summary: %v", flueSeason.LatestReading)
 	}
 
 	CleanupTestData()
@@ -190,3 +267,588 @@ func TestFinishBatch(t *testing.T) {
 
 	CleanupTestData()
 }
+
+func TestCheckCompletion(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	config.OverrideNotificationChannels([]config.NotificationChannel{{Name: "batches", Type: "webhook", Events: []string{"batch"}}})
+	defer config.OverrideNotificationChannels(nil)
+
+	_, _, flueSeason, _ := GetTestObjects()
+	opts := CompletionOptions{Threshold: 0.002, Window: time.Hour}
+
+	changed, err := flueSeason.CheckCompletion(opts)
+	if err != nil || changed {
+		t.Errorf("Actively fermenting batch changed: %v", err)
+	}
+
+	addReadings := func(start time.Duration, gravities ...float64) {
+		for i, g := range gravities {
+			flueSeason.AddReading(GravityReading{
+				Date:        time.Now().Add(start + time.Duration(i)*30*time.Minute),
+				Gravity:     g,
+				Temperature: 68,
+			})
+		}
+	}
+
+	addReadings(time.Hour*3, 1.0125, 1.012, 1.0125)
+
+	changed, err = flueSeason.CheckCompletion(opts)
+	if err != nil || !changed || !flueSeason.Stable || !flueSeason.Active {
+		t.Fatalf("Batch not marked stable: %v", err)
+	}
+	if math.Abs(flueSeason.FinalGravity-1.0124) > 0.0002 || flueSeason.StableAt.IsZero() {
+		t.Errorf("Wrong final gravity %v at %v", flueSeason.FinalGravity, flueSeason.StableAt)
+	}
+
+	// Fermentation restarts
+	addReadings(time.Hour*5, 1.009)
+
+	changed, err = flueSeason.CheckCompletion(opts)
+	if err != nil || !changed || flueSeason.Stable || flueSeason.FinalGravity != 0 {
+		t.Errorf("Batch still stable after gravity dropped: %v", err)
+	}
+
+	addReadings(time.Hour*6, 1.0085, 1.0085, 1.009)
+	opts.AutoFinish = true
+
+	changed, err = flueSeason.CheckCompletion(opts)
+	if err != nil || !changed {
+		t.Errorf("Batch not finished: %v", err)
+	}
+
+	_, greenHydrometer, flueSeason, _ := GetTestObjects()
+
+	if flueSeason.Active || !flueSeason.Stable {
+		t.Errorf("Stored batch not stable and finished")
+	}
+	if greenHydrometer.CurrentBatchID != graviton.EmptyID() {
+		t.Errorf("Finished batch didn't release its hydrometer")
+	}
+
+	events := []string{}
+	notifications, _ := QueryNotifications(NotificationQuery{State: NotificationPending})
+	for _, n := range notifications {
+		events = append(events, n.Event.Type)
+	}
+	if strings.Join(events, ",") != "batch.stable,batch.stable,batch.finished" {
+		t.Errorf("Wrong notifications queued: %v", events)
+	}
+
+	CleanupTestData()
+}
+
+// The memory store keeps whole batches, so this applies SaveBatch's
+// Mongo update to a stored document by hand.
+func TestSaveBatchClearsFields(t *testing.T) {
+	b := &Batch{
+		ID:           bson.NewObjectId(),
+		RecipeName:   "Flue Season",
+		HydrometerID: graviton.EmptyID(),
+		Stable:       true,
+		FinalGravity: 1.012,
+		StableAt:     time.Now(),
+		OwnerID:      bson.NewObjectId(),
+	}
+
+	stored, err := batchFields(b)
+	if err != nil {
+		t.Fatalf("Marshaling failed: %v", err)
+	}
+
+	b.Stable = false
+	b.FinalGravity = 0
+	b.StableAt = time.Time{}
+	b.OwnerID = ""
+
+	update, err := batchUpdate(b)
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	for key, value := range update["$set"].(bson.M) {
+		stored[key] = value
+	}
+	unset, _ := update["$unset"].(bson.M)
+	for key := range unset {
+		delete(stored, key)
+	}
+
+	raw, _ := bson.Marshal(stored)
+	saved := &Batch{}
+	bson.Unmarshal(raw, saved)
+
+	if saved.Stable || saved.FinalGravity != 0 || !saved.StableAt.IsZero() || saved.OwnerID != "" {
+		t.Errorf("Cleared fields not saved: %v %v %v %v", saved.Stable, saved.FinalGravity, saved.StableAt, saved.OwnerID)
+	}
+}
+
+func TestCheckAlerts(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	_, _, flueSeason, _ := GetTestObjects()
+	now := flueSeason.LatestReading.Date
+
+	kinds := func(alerts []*Alert) map[AlertKind]*Alert {
+		found := map[AlertKind]*Alert{}
+		for _, a := range alerts {
+			found[a.Kind] = a
+		}
+		return found
+	}
+
+	// The latest reading is at 71.1°F and 3.67V
+	flueSeason.AlertRules = AlertRules{MaxTemperature: 70}
+	flueSeason.Save()
+
+	opened, err := flueSeason.CheckAlerts(AlertRules{MinBatteryVoltage: 3.68, MaxTemperature: 80}, now)
+	if err != nil || len(opened) != 2 || kinds(opened)[AlertTemperature] == nil || kinds(opened)[AlertBattery] == nil {
+		t.Fatalf("Expected temperature and battery alerts, got %v (%v)", opened, err)
+	}
+
+	err = kinds(opened)[AlertTemperature].Acknowledge("test@example.com")
+	if err != nil {
+		t.Errorf("Unable to acknowledge alert: %v", err)
+	}
+
+	opened, _ = flueSeason.CheckAlerts(AlertRules{MinBatteryVoltage: 3.68}, now)
+	if len(opened) != 0 {
+		t.Errorf("Reopened alerts already in effect: %v", opened)
+	}
+
+	// Warmer range clears the temperature alert; silence opens another
+	flueSeason.AlertRules.MaxTemperature = 75
+	opened, _ = flueSeason.CheckAlerts(AlertRules{SilentAfter: time.Hour}, now.Add(2*time.Hour))
+	if len(opened) != 1 || opened[0].Kind != AlertSilent {
+		t.Errorf("Expected a silent alert, got %v", opened)
+	}
+
+	resolved, _ := QueryAlerts(AlertQuery{BatchID: flueSeason.ID, States: []AlertState{AlertResolved}})
+	if len(resolved) != 2 || kinds(resolved)[AlertTemperature].AcknowledgedBy != "test@example.com" {
+		t.Errorf("Expected resolved temperature and battery alerts, got %v", resolved)
+	}
+
+	// Batches can turn off a rule the defaults turn on
+	flueSeason.AlertRules.Disabled = []AlertKind{AlertSilent}
+	flueSeason.CheckAlerts(AlertRules{SilentAfter: time.Hour}, now.Add(2*time.Hour))
+
+	resolved, _ = QueryAlerts(AlertQuery{BatchID: flueSeason.ID, States: []AlertState{AlertResolved}})
+	if kinds(resolved)[AlertSilent] == nil {
+		t.Errorf("Disabled rule's alert not resolved: %v", resolved)
+	}
+	flueSeason.AlertRules.Disabled = nil
+
+	// Gravity holds at 1.071 for the last hour, at about 8% attenuation
+	flueSeason.AddReading(GravityReading{Date: now.Add(time.Hour), Gravity: 1.071, Temperature: 68})
+	flueSeason.AddReading(GravityReading{Date: now.Add(90 * time.Minute), Gravity: 1.0712, Temperature: 68})
+
+	stallRules := AlertRules{StallWindow: time.Hour, StallThreshold: 0.002, StallAttenuation: 0.6}
+	opened, err = flueSeason.CheckAlerts(stallRules, now.Add(90*time.Minute))
+	if err != nil || len(opened) != 1 || opened[0].Kind != AlertStalled {
+		t.Errorf("Expected a stalled alert, got %v (%v)", opened, err)
+	}
+
+	// Finished batches have nothing to alert about
+	flueSeason.FinishBatch()
+	flueSeason.CheckAlerts(stallRules, now)
+
+	unresolved, _ := QueryAlerts(AlertQuery{BatchID: flueSeason.ID, States: UnresolvedAlertStates})
+	if len(unresolved) != 0 {
+		t.Errorf("Finished batch has unresolved alerts: %v", unresolved)
+	}
+
+	CleanupTestData()
+}
+
+func TestSubscribe(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	_, _, flueSeason, hopForward := GetTestObjects()
+
+	subscription := Subscribe(func(e Event) bool { return e.BatchID == flueSeason.ID })
+
+	hopForward.AddReading(GravityReading{Date: time.Now(), Gravity: 1.010})
+	flueSeason.AddReading(GravityReading{Date: time.Now(), Gravity: 1.012})
+	Notify(Event{Type: EventBatchFinished, BatchID: flueSeason.ID})
+
+	reading := <-subscription.Events
+	if reading.Type != EventReadingAdded || reading.Reading.Gravity != 1.012 || reading.Reading.BatchID != flueSeason.ID {
+		t.Errorf("Wrong reading event: %v", reading)
+	}
+
+	finished := <-subscription.Events
+	if finished.Type != EventBatchFinished || finished.Time.IsZero() {
+		t.Errorf("Wrong batch event: %v", finished)
+	}
+
+	subscription.Close()
+	flueSeason.AddReading(GravityReading{Date: time.Now(), Gravity: 1.011})
+
+	if _, open := <-subscription.Events; open {
+		t.Errorf("Received an event after closing")
+	}
+
+	CleanupTestData()
+}
+
+func TestSubscribeLifecycle(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	config.OverrideNotificationChannels([]config.NotificationChannel{{Name: "everything", Type: "webhook"}})
+	defer config.OverrideNotificationChannels(nil)
+
+	_, greenHydrometer, flueSeason, _ := GetTestObjects()
+
+	subscription := Subscribe(func(e Event) bool {
+		return e.BatchID == flueSeason.ID || e.HydrometerID == greenHydrometer.ID
+	})
+	defer subscription.Close()
+
+	flueSeason.ArchiveBatch()
+	greenHydrometer, _ = SingleHydrometer(HydrometerQuery{ID: greenHydrometer.ID})
+	greenHydrometer.Archive()
+
+	batch, _ := AddBatch(&Batch{RecipeName: "Second Runnings"})
+	batch.Start(&Hydrometer{ID: graviton.EmptyID()})
+
+	received := []string{}
+	for len(received) < 3 {
+		received = append(received, (<-subscription.Events).Type)
+	}
+	if strings.Join(received, ",") != "batch.finished,batch.archived,hydrometer.archived" {
+		t.Errorf("Wrong lifecycle events: %v", received)
+	}
+
+	queued := []string{}
+	notifications, _ := QueryNotifications(NotificationQuery{State: NotificationPending})
+	for _, n := range notifications {
+		queued = append(queued, n.Event.Type)
+	}
+	if strings.Join(queued, ",") != "batch.finished,batch.archived,hydrometer.archived,batch.started" {
+		t.Errorf("Wrong notifications queued: %v", queued)
+	}
+
+	CleanupTestData()
+}
+
+func TestDomainEvents(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	// Listeners can't be removed, so this one outlives the test
+	recording := true
+	events := []string{}
+	Listen(func(event DomainEvent) {
+		if recording {
+			events = append(events, strings.TrimPrefix(fmt.Sprintf("%T", event), "data."))
+		}
+	})
+	Listen(func(event DomainEvent) {
+		if recording {
+			panic("listener failure")
+		}
+	})
+	defer func() { recording = false }()
+
+	_, greenHydrometer, flueSeason, _ := GetTestObjects()
+
+	flueSeason.AddReading(GravityReading{Date: time.Now(), Gravity: 1.011, Temperature: 68})
+	flueSeason.ArchiveBatch()
+	greenHydrometer, _ = SingleHydrometer(HydrometerQuery{ID: greenHydrometer.ID})
+	greenHydrometer.Archive()
+
+	batch, err := AddBatch(&Batch{RecipeName: "Second Runnings"})
+	if err != nil {
+		t.Fatalf("Unable to add batch: %v", err)
+	}
+	spare, _ := RegisterHydrometer("8265091", "Spare Hydrometer")
+	batch.Start(spare)
+
+	expected := "ReadingAdded,BatchFinished,BatchArchived,HydrometerArchived,HydrometerAssigned,BatchStarted"
+	if strings.Join(events, ",") != expected {
+		t.Errorf("Wrong domain events: %v", events)
+	}
+
+	CleanupTestData()
+}
+
+func TestBatchVersionConflict(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	_, _, flueSeason, _ := GetTestObjects()
+	_, _, staleFlueSeason, _ := GetTestObjects()
+
+	flueSeason.RecipeName = "Flue Season II"
+	err := flueSeason.Save()
+
+	if err != nil {
+		t.Errorf("Unable to save batch: %v\n", err)
+	}
+
+	staleFlueSeason.RecipeName = "Flue Season III"
+	err = staleFlueSeason.Save()
+
+	if err != ErrConflict {
+		t.Errorf("Stale save did not conflict: %v\n", err)
+	}
+
+	CleanupTestData()
+}
+
+func TestConcurrentReadings(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	_, _, flueSeason, _ := GetTestObjects()
+	startingCount := flueSeason.ReadingCount
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Each goroutine loads its own copy, as concurrent requests would
+			_, _, batch, _ := GetTestObjects()
+			batch.AddReading(GravityReading{
+				BatteryVoltage: 3.7,
+				Date:           time.Now().Add(time.Hour * time.Duration(i+2)),
+				Gravity:        1.060,
+				Temperature:    68.0,
+			})
+		}(i)
+	}
+
+	// An edit made alongside the readings shouldn't drop any of them
+	flueSeason.RecipeName = "Flue Season II"
+	flueSeason.Save()
+	wg.Wait()
+
+	_, _, flueSeason, _ = GetTestObjects()
+	readings, _ := flueSeason.Readings()
+
+	if len(readings) != startingCount+20 || flueSeason.ReadingCount != len(readings) {
+		t.Errorf("Lost readings: %d stored, count %d\n", len(readings), flueSeason.ReadingCount)
+	}
+
+	if flueSeason.LatestReading.ID != readings[len(readings)-1].ID {
+		t.Errorf("Latest reading summary wrong: %v\n", flueSeason.LatestReading)
+	}
+
+	CleanupTestData()
+}
+
+func TestReprocessReadings(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	_, greenHydrometer, flueSeason, _ := GetTestObjects()
+
+	// A calibration that reads 0.010 low, then a corrected one
+	greenHydrometer.Calibrate([]CalibrationPoint{{Angle: 25, Gravity: 0.990}, {Angle: 65, Gravity: 1.070}}, 1)
+	greenHydrometer.Calibrate([]CalibrationPoint{{Angle: 25, Gravity: 1.000}, {Angle: 65, Gravity: 1.080}}, 1)
+	greenHydrometer.Save()
+
+	rawReading := GravityReading{
+		Date:        time.Now().Add(time.Hour * 3),
+		Angle:       45,
+		Temperature: 20,
+		Raw:         &RawReading{Angle: 45, Temperature: 20, TemperatureUnits: "C"},
+	}
+	rawReading.Gravity = greenHydrometer.CalibrationVersion(1).Gravity(45)
+	rawReading.Temperature = 68
+	rawReading.CalibrationVersion = 1
+	flueSeason.AddReading(rawReading)
+
+	opts := ReprocessOptions{
+		BatchID:            flueSeason.ID,
+		From:               time.Now().Add(time.Hour * 2),
+		CalibrationVersion: 2,
+	}
+	plan, err := PlanReprocessing(opts)
+
+	if err != nil {
+		t.Fatalf("Planning failed: %v", err)
+	}
+
+	if len(plan.Changes) != 1 || plan.Changes[0].NewCalibrationVersion != 2 || math.Abs(plan.Changes[0].NewGravity-1.040) > 0.00001 {
+		t.Errorf("Wrong plan: %v\n", plan.Changes)
+	}
+
+	readings, _ := flueSeason.Readings()
+	if readings[len(readings)-1].CalibrationVersion != 1 {
+		t.Errorf("Dry run changed readings: %v\n", readings[len(readings)-1])
+	}
+
+	err = plan.Apply("brewer@example.com")
+
+	if err != nil {
+		t.Errorf("Apply failed: %v", err)
+	}
+
+	_, _, flueSeason, _ = GetTestObjects()
+	if flueSeason.LatestReading.CalibrationVersion != 2 || math.Abs(flueSeason.LatestReading.Gravity-1.040) > 0.00001 {
+		t.Errorf("Reprocessing not applied: %v\n", flueSeason.LatestReading)
+	}
+
+	audit, _ := QueryReprocessings(ReprocessingQuery{BatchID: flueSeason.ID})
+	if len(audit) != 1 || audit[0].AppliedBy != "brewer@example.com" {
+		t.Errorf("Missing audit record: %v\n", audit)
+	}
+
+	// Reprocessing again with the same settings changes nothing
+	plan, _ = PlanReprocessing(opts)
+	if len(plan.Changes) != 0 {
+		t.Errorf("Repeated reprocessing has changes: %v\n", plan.Changes)
+	}
+
+	CleanupTestData()
+}
+
+func TestReprocessTemperatureOffset(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	_, greenHydrometer, flueSeason, _ := GetTestObjects()
+
+	greenHydrometer.Calibrate([]CalibrationPoint{{Angle: 25, Gravity: 1.000}, {Angle: 65, Gravity: 1.080}}, 1)
+	greenHydrometer.Save()
+
+	// Angle-only readings, as from a device that doesn't compute gravity
+	for i := 3; i < 5; i++ {
+		reading := GravityReading{
+			Date:        time.Now().Add(time.Hour * time.Duration(i)),
+			Angle:       45,
+			Temperature: 68,
+			Raw:         &RawReading{Angle: 45, Temperature: 68, TemperatureUnits: "F"},
+		}
+		greenHydrometer.ConvertReading(&reading)
+		flueSeason.AddReading(reading)
+	}
+
+	opts := ReprocessOptions{
+		BatchID:           flueSeason.ID,
+		From:              time.Now().Add(time.Hour * 2),
+		TemperatureOffset: -2,
+	}
+	plan, err := PlanReprocessing(opts)
+
+	if err != nil {
+		t.Fatalf("Planning failed: %v", err)
+	}
+
+	if len(plan.Changes) != 2 {
+		t.Fatalf("Wrong plan: %v\n", plan.Changes)
+	}
+	for _, change := range plan.Changes {
+		if math.Abs(change.NewGravity-1.040) > 0.00001 || change.NewCalibrationVersion != 1 || change.NewTemperature != 66 {
+			t.Errorf("Wrong change: %v\n", change)
+		}
+	}
+
+	// Without the reading's calibration, its gravity stays put
+	readings, _ := flueSeason.Readings()
+	change := reprocessReading(readings[len(readings)-1], &Hydrometer{}, nil, opts)
+	if change == nil || math.Abs(change.NewGravity-1.040) > 0.00001 || change.NewCalibrationVersion != 1 {
+		t.Errorf("Wrong change without calibration: %v\n", change)
+	}
+
+	CleanupTestData()
+}
+
+func TestGravityEstimates(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	batch, err := AddBatch(&Batch{RecipeName: "Estimates", UniqueID: "estimates", StartDate: time.Now()})
+	if err != nil {
+		t.Fatalf("Unable to add batch: %v", err)
+	}
+
+	// A noisy first reading, which the median leaves out
+	gravities := []float64{1.060, 1.050, 1.051, 1.050, 1.049, 1.045, 1.040, 1.030, 1.020, 1.015, 1.012, 1.011}
+	for i, g := range gravities {
+		batch.AddReading(GravityReading{
+			Date:        time.Now().Add(time.Duration(i) * time.Hour),
+			Gravity:     g,
+			Temperature: 60,
+		})
+
+		summary, _ := batch.Analyze(analytics.DefaultOptions())
+		if batch.OriginalGravity != summary.OriginalGravity || batch.CurrentGravity != summary.CurrentGravity {
+			t.Errorf("Estimates %v %v after %d readings, want %v %v", batch.OriginalGravity, batch.CurrentGravity,
+				i+1, summary.OriginalGravity, summary.CurrentGravity)
+		}
+	}
+
+	summaries, _ := QueryBatchSummaries(BatchQuery{ID: batch.ID})
+	if len(summaries) != 1 || summaries[0].OriginalGravity != 1.050 || summaries[0].CurrentGravity != 1.012 {
+		t.Errorf("Wrong summary estimates: %v", summaries)
+	}
+
+	CleanupTestData()
+}
+
+func TestPageBatches(t *testing.T) {
+	graviton.InitTest()
+	generateTestData()
+
+	start := time.Now().Add(-time.Hour * 24 * 30)
+	for i, recipe := range []string{"Altbier", "Bock", "Cream Ale"} {
+		_, err := AddBatch(&Batch{
+			RecipeName: recipe,
+			UniqueID:   "page-" + recipe,
+			StartDate:  start.Add(time.Duration(i) * time.Hour * 24),
+		})
+		if err != nil {
+			t.Fatalf("Unable to add batch: %v", err)
+		}
+	}
+
+	// Newest first, two at a time
+	query := BatchQuery{Sort: "-startDate", Limit: 2}
+	recipes := []string{}
+	for pages := 0; pages < 5; pages++ {
+		summaries, err := QueryBatchSummaries(query)
+		if err != nil {
+			t.Fatalf("Page query failed: %v", err)
+		}
+		for _, s := range summaries {
+			recipes = append(recipes, s.RecipeName)
+		}
+		if len(summaries) < query.Limit {
+			break
+		}
+		query.After = summaries[len(summaries)-1].Cursor(query.Sort)
+	}
+
+	if len(recipes) != 5 {
+		t.Fatalf("Expected 5 batches across pages, got %v", recipes)
+	}
+	if recipes[2] != "Cream Ale" || recipes[3] != "Bock" || recipes[4] != "Altbier" {
+		t.Errorf("Batches out of order: %v", recipes)
+	}
+
+	total, err := CountBatches(query)
+	if err != nil || total != 5 {
+		t.Errorf("Expected a total of 5 ignoring the cursor, got %d (%v)", total, err)
+	}
+
+	batches, err := QueryBatches(BatchQuery{Sort: "recipe", StartedBefore: start.Add(time.Hour * 36)})
+	if err != nil || len(batches) != 2 || batches[0].RecipeName != "Altbier" {
+		t.Errorf("Start date range selected the wrong batches: %v", err)
+	}
+
+	_, err = QueryBatches(BatchQuery{Sort: "hydrometer"})
+	if err != ErrBadSort {
+		t.Errorf("Expected ErrBadSort, got %v", err)
+	}
+
+	CleanupTestData()
+}
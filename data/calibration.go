@@ -0,0 +1,160 @@
+package data
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jslater89/graviton/analytics"
+	"github.com/jslater89/graviton/units"
+)
+
+// DefaultCalibrationTemperature is the temperature, in °F, most
+// hydrometers are calibrated at.
+const DefaultCalibrationTemperature = 60.0
+
+// ErrNoCalibration is returned when a reading carries only a raw
+// angle, and its hydrometer has no calibration to convert it with.
+var ErrNoCalibration = errors.New("hydrometer has no calibration for raw readings")
+
+type CalibrationPoint struct {
+	Angle   float64 `bson:"angle"`
+	Gravity float64 `bson:"gravity"`
+}
+
+// Calibration maps a hydrometer's tilt angle to gravity. A hydrometer
+// keeps every calibration it has had, so readings can be traced to
+// the one that produced their gravity.
+type Calibration struct {
+	Version      int                `bson:"version"`
+	Degree       int                `bson:"degree"`
+	Points       []CalibrationPoint `bson:"points"`
+	Coefficients []float64          `bson:"coefficients"` // constant term first
+	CreatedAt    time.Time          `bson:"created"`
+}
+
+// ReferenceTemperature returns the temperature, in °F, the hydrometer
+// reads true at.
+func (h *Hydrometer) ReferenceTemperature() float64 {
+	if h.CalibrationTemperature == 0 {
+		return DefaultCalibrationTemperature
+	}
+	return h.CalibrationTemperature
+}
+
+// EffectiveGravity returns the temperature-corrected gravity, or the
+// measured gravity for readings stored before correction was added.
+func (r *GravityReading) EffectiveGravity() float64 {
+	if r.CorrectedGravity == 0 {
+		return r.Gravity
+	}
+	return r.CorrectedGravity
+}
+
+// correctGravity returns gravity corrected to the reference
+// temperature. Without a sample temperature, it can't be corrected.
+func correctGravity(gravity float64, temperature float64, referenceTemperature float64) float64 {
+	if temperature == 0 {
+		return gravity
+	}
+	return analytics.CorrectGravity(gravity, temperature, referenceTemperature)
+}
+
+// Gravity converts an angle to gravity.
+func (c *Calibration) Gravity(angle float64) float64 {
+	return analytics.EvaluatePolynomial(c.Coefficients, angle)
+}
+
+// Calibrate fits a new calibration to points and makes it the
+// hydrometer's current one. The hydrometer still needs to be saved.
+func (h *Hydrometer) Calibrate(points []CalibrationPoint, degree int) (*Calibration, error) {
+	angles := []float64{}
+	gravities := []float64{}
+	for _, p := range points {
+		angles = append(angles, p.Angle)
+		gravities = append(gravities, p.Gravity)
+	}
+
+	coefficients, err := analytics.FitPolynomial(angles, gravities, degree)
+	if err != nil {
+		return nil, err
+	}
+
+	version := 1
+	if current := h.CurrentCalibration(); current != nil {
+		version = current.Version + 1
+	}
+
+	h.Calibrations = append(h.Calibrations, Calibration{
+		Version:      version,
+		Degree:       degree,
+		Points:       points,
+		Coefficients: coefficients,
+		CreatedAt:    time.Now(),
+	})
+
+	return h.CurrentCalibration(), nil
+}
+
+// CurrentCalibration returns the newest calibration, or nil if the
+// hydrometer has never been calibrated.
+func (h *Hydrometer) CurrentCalibration() *Calibration {
+	if len(h.Calibrations) == 0 {
+		return nil
+	}
+	return &h.Calibrations[len(h.Calibrations)-1]
+}
+
+// CalibrationVersion returns the given version of the hydrometer's
+// calibration, or nil if there is no such version.
+func (h *Hydrometer) CalibrationVersion(version int) *Calibration {
+	for i := range h.Calibrations {
+		if h.Calibrations[i].Version == version {
+			return &h.Calibrations[i]
+		}
+	}
+	return nil
+}
+
+// ConvertReading sets a reading's gravity from its raw angle using the
+// hydrometer's current calibration, and records the calibration
+// version. Readings without an angle, or from uncalibrated hydrometers
+// that reported their own gravity, keep their gravity. Either way, the
+// reported values are kept in r.Raw, if the caller hasn't set it, and
+// the gravity is corrected for temperature.
+func (h *Hydrometer) ConvertReading(r *GravityReading) error {
+	err := h.calibrateReading(r)
+	if err != nil {
+		return err
+	}
+
+	r.CorrectedGravity = correctGravity(r.Gravity, r.Temperature, h.ReferenceTemperature())
+	return nil
+}
+
+func (h *Hydrometer) calibrateReading(r *GravityReading) error {
+	calibration := h.CurrentCalibration()
+
+	if r.Raw == nil {
+		r.Raw = &RawReading{
+			Gravity:          r.Gravity,
+			Temperature:      r.Temperature,
+			TemperatureUnits: string(units.Fahrenheit),
+			Angle:            r.Angle,
+		}
+	}
+
+	if r.Angle == 0 {
+		return nil
+	}
+
+	if calibration == nil {
+		if r.Gravity == 0 {
+			return ErrNoCalibration
+		}
+		return nil
+	}
+
+	r.Gravity = calibration.Gravity(r.Angle)
+	r.CalibrationVersion = calibration.Version
+	return nil
+}
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/analytics"
+	"go.uber.org/zap"
+)
+
+// CompletionOptions say when fermentation counts as complete, and what
+// to do about it.
+type CompletionOptions struct {
+	// Threshold is the largest gravity change, in SG, over Window for
+	// gravity to count as stable.
+	Threshold float64
+	Window    time.Duration
+	// AutoFinish finishes stable batches, releasing their hydrometers.
+	AutoFinish bool
+}
+
+// CheckCompletion checks whether b's gravity has settled. If it has,
+// b is marked stable with its final gravity, and finished if
+// opts.AutoFinish is set. A stable batch whose gravity starts moving
+// again is unmarked. CheckCompletion reports whether b changed.
+func (b *Batch) CheckCompletion(opts CompletionOptions) (bool, error) {
+	readings, err := b.Readings()
+	if err != nil {
+		return false, err
+	}
+
+	converted := AnalyticsReadings(readings)
+	gravity, stable := analytics.TerminalGravity(converted, opts.Threshold, opts.Window)
+	becameStable := stable && !b.Stable
+
+	switch {
+	case stable && !b.Stable:
+		b.Stable = true
+		b.FinalGravity = gravity
+		b.StableAt = converted[len(converted)-1].Date
+	case !stable && b.Stable:
+		b.Stable = false
+		b.FinalGravity = 0
+		b.StableAt = time.Time{}
+	case !(stable && opts.AutoFinish):
+		return false, nil
+	}
+
+	err = b.Save()
+	if err != nil {
+		return true, err
+	}
+
+	if becameStable {
+		Notify(Event{
+			Type:         EventBatchStable,
+			BatchID:      b.ID,
+			HydrometerID: b.HydrometerID,
+			Message:      fmt.Sprintf("%s is stable at %.3f", b.RecipeName, b.FinalGravity),
+		})
+	}
+
+	if b.Stable && opts.AutoFinish {
+		err = b.FinishBatch()
+	}
+	return true, err
+}
+
+// CheckActiveBatches runs CheckCompletion on every active batch.
+// Failures are logged, and don't stop the other batches being checked.
+func CheckActiveBatches(opts CompletionOptions) {
+	batches, err := QueryBatches(BatchQuery{Active: Bool(true)})
+	if err != nil {
+		graviton.Logger.Error("Failed to query active batches", zap.Error(err))
+		return
+	}
+
+	for _, b := range batches {
+		changed, err := b.CheckCompletion(opts)
+
+		if err != nil {
+			// Conflicts are retried on the next check
+			graviton.Logger.Warn("Failed to check batch completion",
+				zap.String("BatchID", b.ID.Hex()),
+				zap.Error(err))
+		} else if changed {
+			graviton.Logger.Info("Batch completion changed",
+				zap.String("BatchID", b.ID.Hex()),
+				zap.Bool("stable", b.Stable),
+				zap.Bool("finished", !b.Active),
+				zap.Float64("finalGravity", b.FinalGravity))
+		}
+	}
+}
+
+// MonitorCompletion runs CheckActiveBatches every interval. It never
+// returns, so run it in its own goroutine.
+func MonitorCompletion(opts CompletionOptions, interval time.Duration) {
+	for range time.Tick(interval) {
+		CheckActiveBatches(opts)
+	}
+}
@@ -6,32 +6,107 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+// Batch holds summary information about a batch. Its readings are
+// stored separately; see Batch.Readings.
 type Batch struct {
-	ID              bson.ObjectId    `bson:"_id,omitempty"`
-	RecipeName      string           `bson:"recipe"`
-	UniqueID        string           `bson:"stringId"`
-	HydrometerID    bson.ObjectId    `bson:"hydrometer"`
-	GravityReadings []GravityReading `bson:"readings"`
-	StartDate       time.Time        `bson:"startDate"`
-	LastUpdate      time.Time        `bson:"lastUpdate"`
+	ID            bson.ObjectId  `bson:"_id,omitempty"`
+	RecipeName    string         `bson:"recipe"`
+	UniqueID      string         `bson:"stringId"`
+	HydrometerID  bson.ObjectId  `bson:"hydrometer"`
+	FirstReading  GravityReading `bson:"firstReading,omitempty"`
+	LatestReading GravityReading `bson:"latestReading,omitempty"`
+	ReadingCount  int            `bson:"readingCount"`
+	Version       int            `bson:"version"`
+	StartDate     time.Time      `bson:"startDate"`
+	LastUpdate    time.Time      `bson:"lastUpdate"`
+
+	// Gravity estimates from the visible readings, as Analyze finds them
+	// with the default options, so batches can be listed without loading
+	// their readings. See Batch.updateEstimates.
+	OriginalGravity float64 `bson:"originalGravity"`
+	CurrentGravity  float64 `bson:"currentGravity"`
 
 	Active   bool `bson:"active"`
 	Archived bool `bson:"archived"`
+
+	// Set by CheckCompletion once gravity settles. StableAt is the date
+	// of the reading that showed it.
+	Stable       bool      `bson:"stable"`
+	FinalGravity float64   `bson:"finalGravity,omitempty"`
+	StableAt     time.Time `bson:"stableAt,omitempty"`
+
+	AlertRules AlertRules `bson:"alertRules"`
+
+	// The user who may do anything with the batch; see auth.Allowed
+	OwnerID bson.ObjectId `bson:"owner,omitempty"`
+}
+
+// BatchSummary is what it takes to list a batch: its summary fields
+// and its hydrometer's name, loaded in one query without readings.
+type BatchSummary struct {
+	ID             bson.ObjectId  `bson:"_id"`
+	RecipeName     string         `bson:"recipe"`
+	UniqueID       string         `bson:"stringId"`
+	HydrometerID   bson.ObjectId  `bson:"hydrometer"`
+	HydrometerName string         `bson:"hydrometerName"`
+	FirstReading   GravityReading `bson:"firstReading"`
+	LatestReading  GravityReading `bson:"latestReading"`
+	ReadingCount   int            `bson:"readingCount"`
+	StartDate      time.Time      `bson:"startDate"`
+	LastUpdate     time.Time      `bson:"lastUpdate"`
+	Active         bool           `bson:"active"`
+	Archived       bool           `bson:"archived"`
+	Stable         bool           `bson:"stable"`
+	FinalGravity   float64        `bson:"finalGravity"`
+	Version        int            `bson:"version"`
+
+	OriginalGravity float64 `bson:"originalGravity"`
+	CurrentGravity  float64 `bson:"currentGravity"`
 }
 
 type GravityReading struct {
 	ID             bson.ObjectId `json:"id" bson:"_id"`
+	BatchID        bson.ObjectId `json:"batch" bson:"batch"`
 	Date           time.Time     `json:"date" bson:"date"`
 	Gravity        float64       `json:"gravity" bson:"gravity"`
 	Temperature    float64       `json:"temperature" bson:"temperature"`
 	BatteryVoltage float64       `json:"battery" bson:"battery"`
 	Hidden         bool          `json:"hidden" bson:"hidden"`
+
+	// Gravity corrected for the difference between Temperature and the
+	// hydrometer's calibration temperature; see EffectiveGravity
+	CorrectedGravity float64 `json:"correctedGravity,omitempty" bson:"correctedGravity,omitempty"`
+
+	// Raw tilt angle and signal strength, for devices that report them
+	Angle float64 `json:"angle,omitempty" bson:"angle,omitempty"`
+	RSSI  int     `json:"rssi,omitempty" bson:"rssi,omitempty"`
+
+	// The reporting hydrometer's device ID, if it has one. A batch
+	// can't have two readings from one device at the same time.
+	DeviceID string `json:"deviceId,omitempty" bson:"deviceId,omitempty"`
+
+	// The hydrometer calibration that converted Angle to Gravity; zero
+	// if the device reported its own gravity
+	CalibrationVersion int `json:"calibrationVersion,omitempty" bson:"calibrationVersion,omitempty"`
+
+	// What the device reported; nil for readings stored before raw
+	// values were kept
+	Raw *RawReading `json:"raw,omitempty" bson:"raw,omitempty"`
 }
 
 type Hydrometer struct {
 	ID             bson.ObjectId `bson:"_id,omitempty"`
 	Name           string        `bson:"name"`
+	DeviceID       string        `bson:"deviceId,omitempty"` // chip ID or MAC address; ingestion matches on this
 	Description    string        `bson:"description"`
 	CurrentBatchID bson.ObjectId `bson:"batch"`
 	Archived       bool          `bson:"archived"`
+
+	// In °F; zero means DefaultCalibrationTemperature
+	CalibrationTemperature float64 `bson:"calibrationTemperature,omitempty"`
+
+	Calibrations []Calibration `bson:"calibrations,omitempty"` // oldest first
+
+	// The user who may do anything with the hydrometer
+	OwnerID bson.ObjectId `bson:"owner,omitempty"`
 }
@@ -0,0 +1,147 @@
+package data
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jslater89/graviton"
+	"go.uber.org/zap"
+)
+
+// A DomainEvent is a change to batches or hydrometers, published after
+// the change is stored. Events hold the changed objects; listeners
+// must not modify them.
+type DomainEvent interface {
+	domainEvent()
+}
+
+// ReadingAdded follows Batch.AddReading.
+type ReadingAdded struct {
+	Batch   *Batch
+	Reading GravityReading
+}
+
+// BatchStarted follows a batch becoming active, by AddBatch or Start.
+type BatchStarted struct {
+	Batch *Batch
+}
+
+// BatchFinished follows FinishBatch, before the batch's hydrometer is
+// released.
+type BatchFinished struct {
+	Batch *Batch
+}
+
+// BatchArchived follows ArchiveBatch.
+type BatchArchived struct {
+	Batch *Batch
+}
+
+// HydrometerAssigned follows SetHydrometer giving a batch a hydrometer
+// it didn't already have.
+type HydrometerAssigned struct {
+	Hydrometer *Hydrometer
+	Batch      *Batch
+}
+
+// HydrometerArchived follows Hydrometer.Archive.
+type HydrometerArchived struct {
+	Hydrometer *Hydrometer
+}
+
+func (ReadingAdded) domainEvent()       {}
+func (BatchStarted) domainEvent()       {}
+func (BatchFinished) domainEvent()      {}
+func (BatchArchived) domainEvent()      {}
+func (HydrometerAssigned) domainEvent() {}
+func (HydrometerArchived) domainEvent() {}
+
+// A Listener is called with every domain event, and picks the ones it
+// wants by type.
+type Listener func(event DomainEvent)
+
+var listeners struct {
+	sync.RWMutex
+	all []Listener
+}
+
+func init() {
+	Listen(publishEvents)
+}
+
+// Listen registers l for domain events. Register listeners at startup,
+// before anything changes; events published earlier aren't replayed.
+func Listen(l Listener) {
+	listeners.Lock()
+	listeners.all = append(listeners.all, l)
+	listeners.Unlock()
+}
+
+// publish calls each listener in turn, in the publisher's goroutine. A
+// panicking listener is logged, and doesn't stop the others or fail the
+// change that was published.
+func publish(event DomainEvent) {
+	listeners.RLock()
+	all := listeners.all
+	listeners.RUnlock()
+
+	for _, l := range all {
+		callListener(l, event)
+	}
+}
+
+func callListener(l Listener, event DomainEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			graviton.Logger.Error("Domain event listener panicked",
+				zap.String("Event", fmt.Sprintf("%T", event)),
+				zap.Any("Panic", r))
+		}
+	}()
+
+	l(event)
+}
+
+// publishEvents passes domain events on to live subscribers and, but
+// for readings, notification channels.
+func publishEvents(event DomainEvent) {
+	switch e := event.(type) {
+	case ReadingAdded:
+		reading := e.Reading
+		Publish(Event{
+			Type:         EventReadingAdded,
+			BatchID:      e.Batch.ID,
+			HydrometerID: e.Batch.HydrometerID,
+			Message:      e.Batch.RecipeName + ": new reading",
+			Reading:      &reading,
+		})
+	case BatchStarted:
+		Notify(batchEvent(EventBatchStarted, e.Batch, " started"))
+	case BatchFinished:
+		Notify(batchEvent(EventBatchFinished, e.Batch, " finished"))
+	case BatchArchived:
+		Notify(batchEvent(EventBatchArchived, e.Batch, " archived"))
+	case HydrometerAssigned:
+		Notify(Event{
+			Type:         EventHydrometerAssigned,
+			BatchID:      e.Batch.ID,
+			HydrometerID: e.Hydrometer.ID,
+			Message:      e.Hydrometer.Name + " assigned to " + e.Batch.RecipeName,
+		})
+	case HydrometerArchived:
+		Notify(Event{
+			Type:         EventHydrometerArchived,
+			HydrometerID: e.Hydrometer.ID,
+			Message:      e.Hydrometer.Name + " archived",
+		})
+	}
+}
+
+func batchEvent(eventType string, b *Batch, happened string) Event {
+	return Event{
+		Type:         eventType,
+		BatchID:      b.ID,
+		HydrometerID: b.HydrometerID,
+		Message:      b.RecipeName + happened,
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"errors"
 
 	"github.com/jslater89/graviton"
-	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -13,24 +12,28 @@ func (h *Hydrometer) Save() error {
 		return err
 	}
 
+	if h.ID == "" {
+		h.ID = bson.NewObjectId()
+	}
+
 	if h.CurrentBatchID == "" {
 		h.CurrentBatchID = graviton.EmptyID()
 	}
-	_, err := db.hydrometerCollection.UpsertId(h.ID, *h)
 
-	if err != nil {
-		return err
-	}
-	return nil
+	return store.SaveHydrometer(h)
+}
+
+func QueryHydrometers(query HydrometerQuery) ([]*Hydrometer, error) {
+	return store.QueryHydrometers(query)
 }
 
-func QueryHydrometers(query bson.M) ([]*Hydrometer, error) {
-	hydrometers := []*Hydrometer{}
-	err := db.hydrometerCollection.Find(query).All(&hydrometers)
-	return hydrometers, err
+// CountHydrometers counts the hydrometers query matches, ignoring its
+// cursor and limit, for totals when paging.
+func CountHydrometers(query HydrometerQuery) (int, error) {
+	return store.CountHydrometers(query)
 }
 
-func SingleHydrometer(query bson.M) (*Hydrometer, error) {
+func SingleHydrometer(query HydrometerQuery) (*Hydrometer, error) {
 	hydrometers, err := QueryHydrometers(query)
 
 	if err != nil {
@@ -43,12 +46,60 @@ func SingleHydrometer(query bson.M) (*Hydrometer, error) {
 	}
 
 	if len(hydrometers) < 1 {
-		return nil, mgo.ErrNotFound
+		return nil, ErrNotFound
 	}
 
 	return hydrometers[0], nil
 }
 
+// RegisterHydrometer creates an unassigned hydrometer for a device
+// that reported before anyone set it up. If the device's name is
+// missing or already taken, the hydrometer is named after its device ID.
+func RegisterHydrometer(deviceID string, name string) (*Hydrometer, error) {
+	if deviceID == "" {
+		return nil, errors.New("can't register a hydrometer without a device ID")
+	}
+
+	if name == "" {
+		name = "Hydrometer " + deviceID
+	} else if _, err := SingleHydrometer(HydrometerQuery{Name: name}); err != ErrNotFound {
+		name = name + " (" + deviceID + ")"
+	}
+
+	hydrometer := &Hydrometer{
+		ID:             bson.NewObjectId(),
+		Name:           name,
+		DeviceID:       deviceID,
+		Description:    "Registered automatically when it first reported.",
+		CurrentBatchID: graviton.EmptyID(),
+	}
+
+	err := hydrometer.Save()
+	if err != nil {
+		return nil, err
+	}
+
+	return hydrometer, nil
+}
+
+var ErrHydrometerInUse = errors.New("can't archive hydrometer in use")
+
+// Archive archives an unassigned hydrometer.
+func (h *Hydrometer) Archive() error {
+	if h.CurrentBatchID != "" && h.CurrentBatchID != graviton.EmptyID() {
+		return ErrHydrometerInUse
+	}
+
+	h.Archived = true
+	err := h.Save()
+	if err != nil {
+		return err
+	}
+
+	publish(HydrometerArchived{Hydrometer: h})
+	return nil
+}
+
 func (h *Hydrometer) verify() error {
 	return nil
 }
@@ -0,0 +1,441 @@
+package data
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memoryStore keeps everything in process memory. It enforces the
+// same uniqueness rules as the Mongo indices, and hands out copies so
+// callers can't modify stored objects without saving them.
+type memoryStore struct {
+	lock sync.RWMutex
+
+	batchOrder      []bson.ObjectId
+	batches         map[bson.ObjectId]*Batch
+	hydrometerOrder []bson.ObjectId
+	hydrometers     map[bson.ObjectId]*Hydrometer
+	readingOrder    []bson.ObjectId
+	readings        map[bson.ObjectId]*GravityReading
+	reprocessings   []*Reprocessing
+	alerts          []*Alert
+	notifications   []*Notification
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		batches:     map[bson.ObjectId]*Batch{},
+		hydrometers: map[bson.ObjectId]*Hydrometer{},
+		readings:    map[bson.ObjectId]*GravityReading{},
+	}
+}
+
+func (s *memoryStore) SaveBatch(b *Batch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, other := range s.batches {
+		if id != b.ID && other.UniqueID == b.UniqueID {
+			return ErrDuplicateKey
+		}
+	}
+
+	saved := *b
+	existing, ok := s.batches[b.ID]
+
+	if ok {
+		if existing.Version != b.Version {
+			return ErrConflict
+		}
+		saved.FirstReading = existing.FirstReading
+		saved.LatestReading = existing.LatestReading
+		saved.ReadingCount = existing.ReadingCount
+		saved.OriginalGravity = existing.OriginalGravity
+		saved.CurrentGravity = existing.CurrentGravity
+	} else {
+		if b.Version != 0 {
+			return ErrConflict
+		}
+		s.batchOrder = append(s.batchOrder, b.ID)
+	}
+
+	saved.Version++
+	s.batches[b.ID] = &saved
+	b.Version = saved.Version
+
+	return nil
+}
+
+func (s *memoryStore) QueryBatches(query BatchQuery) ([]*Batch, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	matched, err := s.matchBatches(query)
+	if err != nil {
+		return nil, err
+	}
+
+	batches := []*Batch{}
+	for _, b := range matched {
+		found := *b
+		batches = append(batches, &found)
+	}
+
+	return batches, nil
+}
+
+// matchBatches returns the stored batches query matches, sorted and
+// limited. Callers must hold the lock, and copy what they return.
+func (s *memoryStore) matchBatches(query BatchQuery) ([]*Batch, error) {
+	order, err := query.order()
+	if err != nil {
+		return nil, err
+	}
+
+	batches := []*Batch{}
+	for _, id := range s.batchOrder {
+		if b := s.batches[id]; query.matches(b) {
+			batches = append(batches, b)
+		}
+	}
+
+	if query.sorted() {
+		sort.SliceStable(batches, func(i, j int) bool {
+			return order.before(batches[i].summary().Cursor(query.Sort), batches[j].summary().Cursor(query.Sort))
+		})
+	}
+	if query.Limit > 0 && len(batches) > query.Limit {
+		batches = batches[:query.Limit]
+	}
+
+	return batches, nil
+}
+
+func (s *memoryStore) CountBatches(query BatchQuery) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	query.After = nil
+	query.Limit = 0
+
+	count := 0
+	for _, b := range s.batches {
+		if query.matches(b) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *memoryStore) QueryBatchSummaries(query BatchQuery) ([]*BatchSummary, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	batches, err := s.matchBatches(query)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []*BatchSummary{}
+	for _, b := range batches {
+		summary := b.summary()
+		if h, ok := s.hydrometers[b.HydrometerID]; ok {
+			summary.HydrometerName = h.Name
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+func (s *memoryStore) SaveHydrometer(h *Hydrometer) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, other := range s.hydrometers {
+		if id != h.ID && (other.Name == h.Name || h.DeviceID != "" && other.DeviceID == h.DeviceID) {
+			return ErrDuplicateKey
+		}
+	}
+
+	if _, ok := s.hydrometers[h.ID]; !ok {
+		s.hydrometerOrder = append(s.hydrometerOrder, h.ID)
+	}
+	saved := copyHydrometer(h)
+	s.hydrometers[h.ID] = saved
+
+	return nil
+}
+
+func (s *memoryStore) QueryHydrometers(query HydrometerQuery) ([]*Hydrometer, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	order, err := query.order()
+	if err != nil {
+		return nil, err
+	}
+
+	hydrometers := []*Hydrometer{}
+	for _, id := range s.hydrometerOrder {
+		if h := s.hydrometers[id]; query.matches(h) {
+			hydrometers = append(hydrometers, copyHydrometer(h))
+		}
+	}
+
+	if query.sorted() {
+		sort.SliceStable(hydrometers, func(i, j int) bool {
+			return order.before(hydrometers[i].Cursor(query.Sort), hydrometers[j].Cursor(query.Sort))
+		})
+	}
+	if query.Limit > 0 && len(hydrometers) > query.Limit {
+		hydrometers = hydrometers[:query.Limit]
+	}
+
+	return hydrometers, nil
+}
+
+func (s *memoryStore) CountHydrometers(query HydrometerQuery) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	query.After = nil
+	query.Limit = 0
+
+	count := 0
+	for _, h := range s.hydrometers {
+		if query.matches(h) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *memoryStore) AddReading(r *GravityReading, updated time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.readings[r.ID]; ok {
+		return ErrDuplicateKey
+	}
+	for _, other := range s.readings {
+		if other.BatchID == r.BatchID && other.Date.Equal(r.Date) && other.DeviceID == r.DeviceID {
+			return ErrDuplicateKey
+		}
+	}
+
+	saved := *r
+	s.readingOrder = append(s.readingOrder, r.ID)
+	s.readings[r.ID] = &saved
+
+	if b, ok := s.batches[r.BatchID]; ok {
+		b.includeReading(saved)
+		if updated.After(b.LastUpdate) {
+			b.LastUpdate = updated
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) SaveReading(r *GravityReading) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.readings[r.ID]; !ok {
+		return ErrNotFound
+	}
+
+	saved := *r
+	s.readings[r.ID] = &saved
+
+	for _, b := range s.batches {
+		if b.FirstReading.ID == r.ID {
+			b.FirstReading = saved
+		}
+		if b.LatestReading.ID == r.ID {
+			b.LatestReading = saved
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) QueryReadings(query ReadingQuery) ([]GravityReading, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	readings := []GravityReading{}
+	for _, id := range s.readingOrder {
+		if r := s.readings[id]; query.matches(r) {
+			readings = append(readings, *r)
+		}
+	}
+
+	sort.Slice(readings, func(i, j int) bool {
+		if query.Reverse {
+			return readingBefore(&readings[j], &readings[i])
+		}
+		return readingBefore(&readings[i], &readings[j])
+	})
+
+	if query.Limit > 0 && len(readings) > query.Limit {
+		readings = readings[:query.Limit]
+	}
+
+	return readings, nil
+}
+
+func (s *memoryStore) SaveReadingEnds(batchID bson.ObjectId, first GravityReading, latest GravityReading) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, ok := s.batches[batchID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	b.FirstReading = first
+	b.LatestReading = latest
+	return nil
+}
+
+func (s *memoryStore) SaveGravityEstimates(batchID bson.ObjectId, originalGravity float64, currentGravity float64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, ok := s.batches[batchID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	b.OriginalGravity = originalGravity
+	b.CurrentGravity = currentGravity
+	return nil
+}
+
+func (s *memoryStore) AddReprocessing(p *Reprocessing) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	saved := *p
+	s.reprocessings = append(s.reprocessings, &saved)
+	return nil
+}
+
+func (s *memoryStore) QueryReprocessings(query ReprocessingQuery) ([]*Reprocessing, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	reprocessings := []*Reprocessing{}
+	for _, p := range s.reprocessings {
+		if query.matches(p) {
+			found := *p
+			reprocessings = append(reprocessings, &found)
+		}
+	}
+
+	return reprocessings, nil
+}
+
+func (s *memoryStore) SaveAlert(a *Alert) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	saved := *a
+	for i, existing := range s.alerts {
+		if existing.ID == a.ID {
+			s.alerts[i] = &saved
+			return nil
+		}
+	}
+
+	s.alerts = append(s.alerts, &saved)
+	return nil
+}
+
+func (s *memoryStore) QueryAlerts(query AlertQuery) ([]*Alert, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// Alerts are saved in the order they opened
+	alerts := []*Alert{}
+	for i := len(s.alerts) - 1; i >= 0; i-- {
+		if a := s.alerts[i]; query.matches(a) {
+			found := *a
+			alerts = append(alerts, &found)
+		}
+	}
+
+	return alerts, nil
+}
+
+func (s *memoryStore) SaveNotification(n *Notification) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	saved := *n
+	for i, existing := range s.notifications {
+		if existing.ID == n.ID {
+			s.notifications[i] = &saved
+			return nil
+		}
+	}
+
+	s.notifications = append(s.notifications, &saved)
+	return nil
+}
+
+func (s *memoryStore) QueryNotifications(query NotificationQuery) ([]*Notification, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	notifications := []*Notification{}
+	for _, n := range s.notifications {
+		if query.matches(n) {
+			found := *n
+			notifications = append(notifications, &found)
+		}
+	}
+
+	sort.SliceStable(notifications, func(i, j int) bool {
+		return notifications[i].NextAttempt.Before(notifications[j].NextAttempt)
+	})
+
+	if query.Limit > 0 && len(notifications) > query.Limit {
+		notifications = notifications[:query.Limit]
+	}
+
+	return notifications, nil
+}
+
+func (s *memoryStore) Drop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.batchOrder = nil
+	s.batches = map[bson.ObjectId]*Batch{}
+	s.hydrometerOrder = nil
+	s.hydrometers = map[bson.ObjectId]*Hydrometer{}
+	s.readingOrder = nil
+	s.readings = map[bson.ObjectId]*GravityReading{}
+	s.reprocessings = nil
+	s.alerts = nil
+	s.notifications = nil
+
+	return nil
+}
+
+// copyHydrometer copies h along with its calibration history, which
+// callers may append to.
+func copyHydrometer(h *Hydrometer) *Hydrometer {
+	copied := *h
+	copied.Calibrations = append([]Calibration(nil), h.Calibrations...)
+	return &copied
+}
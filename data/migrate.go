@@ -0,0 +1,188 @@
+package data
+
+import (
+	"sort"
+
+	"github.com/jslater89/graviton"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// legacyBatch is the part of a batch document written before readings
+// moved to their own collection.
+type legacyBatch struct {
+	ID       bson.ObjectId    `bson:"_id"`
+	Readings []GravityReading `bson:"readings"`
+}
+
+// migrateEmbeddedReadings moves readings stored in the old batch
+// 'readings' array into the readings collection, and fills in the
+// batch's reading summary. Embedded readings have no device ID, so two
+// at the same time are duplicates, and only the first is kept. Readings
+// already stored are left as they are, so a migration interrupted
+// partway through is safe to run again.
+func (s *mongoStore) migrateEmbeddedReadings() error {
+	iter := s.batchCollection.Find(bson.M{"readings": bson.M{"$exists": true}}).
+		Select(bson.M{"readings": 1}).Iter()
+
+	legacy := legacyBatch{}
+	for iter.Next(&legacy) {
+		sort.SliceStable(legacy.Readings, func(i, j int) bool {
+			return legacy.Readings[i].Date.Before(legacy.Readings[j].Date)
+		})
+
+		readings := []GravityReading{}
+		for _, r := range legacy.Readings {
+			if len(readings) > 0 && r.Date.Equal(readings[len(readings)-1].Date) {
+				continue
+			}
+			r.BatchID = legacy.ID
+			r.DeviceID = ""
+
+			stored := GravityReading{}
+			err := s.readingCollection.Find(bson.M{"batch": r.BatchID, "date": r.Date, "deviceId": nil}).One(&stored)
+			if err == nil {
+				r = stored
+			} else if err == mgo.ErrNotFound {
+				if r.ID == "" {
+					r.ID = bson.NewObjectId()
+				}
+				err = s.readingCollection.Insert(r)
+			}
+
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			readings = append(readings, r)
+		}
+
+		// Hidden readings are left out of the summary, as when they're
+		// hidden later
+		summary := bson.M{"readingCount": len(readings)}
+		unset := bson.M{"readings": "", "firstReading": "", "latestReading": ""}
+		for i := range readings {
+			if !readings[i].Hidden {
+				summary["firstReading"] = readings[i]
+				delete(unset, "firstReading")
+				break
+			}
+		}
+		for i := len(readings) - 1; i >= 0; i-- {
+			if !readings[i].Hidden {
+				summary["latestReading"] = readings[i]
+				delete(unset, "latestReading")
+				break
+			}
+		}
+
+		update := bson.M{
+			"$set":   summary,
+			"$unset": unset,
+		}
+
+		err := s.batchCollection.UpdateId(legacy.ID, update)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+
+		graviton.Logger.Info("Migrated embedded readings",
+			zap.String("BatchID", legacy.ID.Hex()),
+			zap.Int("Count", len(readings)),
+			zap.Int("Duplicates", len(legacy.Readings)-len(readings)))
+		legacy = legacyBatch{}
+	}
+
+	return iter.Close()
+}
+
+// backfillGravityEstimates fills in the gravity estimates of batches
+// with readings stored before they were kept. The store must be in use.
+func (s *mongoStore) backfillGravityEstimates() error {
+	iter := s.batchCollection.Find(bson.M{
+		"readingCount":    bson.M{"$gt": 0},
+		"originalGravity": bson.M{"$exists": false},
+	}).Select(bson.M{"_id": 1}).Iter()
+
+	b := &Batch{}
+	for iter.Next(b) {
+		err := b.updateEstimates()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+
+		graviton.Logger.Info("Filled in gravity estimates", zap.String("BatchID", b.ID.Hex()))
+		b = &Batch{}
+	}
+
+	return iter.Close()
+}
+
+// removeDuplicateReadings removes readings stored more than once with
+// the same batch, date and device, before the index that prevents it
+// existed, keeping the first stored. It returns the batches it removed
+// readings from, whose summaries need repairing.
+func (s *mongoStore) removeDuplicateReadings() ([]bson.ObjectId, error) {
+	iter := s.readingCollection.Pipe([]bson.M{
+		{"$sort": bson.M{"_id": 1}},
+		{"$group": bson.M{
+			"_id":   bson.M{"batch": "$batch", "date": "$date", "deviceId": "$deviceId"},
+			"batch": bson.M{"$first": "$batch"},
+			"ids":   bson.M{"$push": "$_id"},
+		}},
+		{"$match": bson.M{"ids.1": bson.M{"$exists": true}}},
+	}).AllowDiskUse().Iter()
+
+	affected := []bson.ObjectId{}
+	group := struct {
+		BatchID bson.ObjectId   `bson:"batch"`
+		IDs     []bson.ObjectId `bson:"ids"`
+	}{}
+	for iter.Next(&group) {
+		_, err := s.readingCollection.RemoveAll(bson.M{"_id": bson.M{"$in": group.IDs[1:]}})
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+
+		graviton.Logger.Info("Removed duplicate readings",
+			zap.String("BatchID", group.BatchID.Hex()),
+			zap.Int("Count", len(group.IDs)-1))
+		affected = append(affected, group.BatchID)
+	}
+
+	return affected, iter.Close()
+}
+
+// repairReadingSummaries recounts and recomputes the reading summaries
+// of active batches, in case a reading was stored but not folded into
+// one (see mongoStore.AddReading), and of the batches in also. The store
+// must be in use.
+func (s *mongoStore) repairReadingSummaries(also []bson.ObjectId) error {
+	iter := s.batchCollection.Find(bson.M{"$or": []bson.M{
+		{"active": true},
+		{"_id": bson.M{"$in": also}},
+	}}).Select(bson.M{"_id": 1}).Iter()
+
+	b := &Batch{}
+	for iter.Next(b) {
+		count, err := s.readingCollection.Find(bson.M{"batch": b.ID}).Count()
+		if err == nil {
+			err = s.batchCollection.UpdateId(b.ID, bson.M{"$set": bson.M{"readingCount": count}})
+		}
+		if err == nil {
+			err = b.recomputeSummary()
+		}
+		if err != nil {
+			iter.Close()
+			return err
+		}
+
+		b = &Batch{}
+	}
+
+	return iter.Close()
+}
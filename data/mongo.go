@@ -1,49 +1,479 @@
 package data
 
 import (
+	"time"
+
 	"github.com/jslater89/graviton/config"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
-type database struct {
+type mongoStore struct {
 	session              *mgo.Session
 	dbRef                *mgo.Database
 	batchCollection      *mgo.Collection
 	hydrometerCollection *mgo.Collection
+	readingCollection    *mgo.Collection
+	reprocessCollection  *mgo.Collection
+	alertCollection      *mgo.Collection
+	outboxCollection     *mgo.Collection
 }
 
-var db database
-
+// InitMongo connects to MongoDB and makes it the data package's store.
 func InitMongo(dbAddr string, database string) error {
+	s := &mongoStore{}
+
 	var err error
-	db.session, err = mgo.Dial("localhost")
+	s.session, err = mgo.Dial("localhost")
 
 	if err != nil {
 		return err
 	}
 
-	db.dbRef = db.session.DB(config.GetConfig().GetDBName())
-	db.batchCollection = db.dbRef.C("batches")
-	db.hydrometerCollection = db.dbRef.C("hydrometers")
+	s.dbRef = s.session.DB(config.GetConfig().GetDBName())
+	s.batchCollection = s.dbRef.C("batches")
+	s.hydrometerCollection = s.dbRef.C("hydrometers")
+	s.readingCollection = s.dbRef.C("readings")
+	s.reprocessCollection = s.dbRef.C("reprocessing")
+	s.alertCollection = s.dbRef.C("alerts")
+	s.outboxCollection = s.dbRef.C("outbox")
 
-	ensureIndices()
+	// Readings have to be migrated and made unique before they can be
+	// indexed
+	err = s.migrateEmbeddedReadings()
+	if err != nil {
+		return err
+	}
 
-	return nil
+	duplicated, err := s.removeDuplicateReadings()
+	if err != nil {
+		return err
+	}
+
+	err = s.ensureIndices()
+	if err != nil {
+		return err
+	}
+
+	UseStore(s)
+
+	err = s.backfillGravityEstimates()
+	if err != nil {
+		return err
+	}
+
+	return s.repairReadingSummaries(duplicated)
 }
 
-func ensureIndices() {
-	db.batchCollection.EnsureIndexKey("recipe")
-	db.batchCollection.EnsureIndexKey("-startDate")
-	db.batchCollection.EnsureIndexKey("-lastUpdate")
-	db.batchCollection.EnsureIndexKey("hydrometer")
-	db.batchCollection.EnsureIndexKey("active")
-	db.batchCollection.EnsureIndex(mgo.Index{
+// ensureIndices makes the collections' indices. Only a failure to make
+// the unique readings index is returned, since the store relies on it
+// to refuse duplicate readings.
+func (s *mongoStore) ensureIndices() error {
+	s.batchCollection.EnsureIndexKey("recipe")
+	// With ID, for stable paging in either direction
+	s.batchCollection.EnsureIndexKey("-startDate", "-_id")
+	s.batchCollection.EnsureIndexKey("-lastUpdate", "-_id")
+	s.batchCollection.EnsureIndexKey("hydrometer")
+	s.batchCollection.EnsureIndexKey("active")
+	s.batchCollection.EnsureIndex(mgo.Index{
 		Key:    []string{"stringId"},
 		Unique: true,
 	})
 
-	db.hydrometerCollection.EnsureIndex(mgo.Index{
+	s.hydrometerCollection.EnsureIndex(mgo.Index{
 		Key:    []string{"name"},
 		Unique: true,
 	})
+	s.hydrometerCollection.EnsureIndex(mgo.Index{
+		Key:    []string{"deviceId"},
+		Unique: true,
+		Sparse: true,
+	})
+
+	s.readingCollection.EnsureIndexKey("batch", "date", "_id")
+
+	s.reprocessCollection.EnsureIndexKey("batches")
+	s.reprocessCollection.EnsureIndexKey("hydrometer")
+
+	s.alertCollection.EnsureIndexKey("batch", "state")
+	s.alertCollection.EnsureIndexKey("state", "-openedAt")
+
+	s.outboxCollection.EnsureIndexKey("state", "nextAttempt")
+
+	return s.readingCollection.EnsureIndex(mgo.Index{
+		Key:    []string{"batch", "date", "deviceId"},
+		Unique: true,
+	})
+}
+
+func (s *mongoStore) SaveBatch(b *Batch) error {
+	update, err := batchUpdate(b)
+	if err != nil {
+		return err
+	}
+
+	selector := bson.M{"_id": b.ID, "version": b.Version}
+	if b.Version == 0 {
+		// Batches saved before versioning have no version field
+		selector["version"] = bson.M{"$in": []interface{}{0, nil}}
+	}
+
+	err = s.batchCollection.Update(selector, update)
+
+	if err == mgo.ErrNotFound {
+		if b.Version != 0 {
+			return ErrConflict
+		}
+
+		inserted := *b
+		inserted.Version = 1
+		err = s.batchCollection.Insert(inserted)
+
+		if mgo.IsDup(err) {
+			if n, _ := s.batchCollection.FindId(b.ID).Count(); n > 0 {
+				return ErrConflict
+			}
+		}
+	}
+
+	if err != nil {
+		return translateMongoError(err)
+	}
+
+	b.Version++
+	return nil
+}
+
+func (s *mongoStore) QueryBatches(query BatchQuery) ([]*Batch, error) {
+	order, err := query.order()
+	if err != nil {
+		return nil, err
+	}
+
+	find := s.batchCollection.Find(query.bson())
+	if query.sorted() {
+		find = find.Sort(order.keys()...)
+	}
+	if query.Limit > 0 {
+		find = find.Limit(query.Limit)
+	}
+
+	batches := []*Batch{}
+	err = find.All(&batches)
+	return batches, err
+}
+
+func (s *mongoStore) CountBatches(query BatchQuery) (int, error) {
+	query.After = nil
+	return s.batchCollection.Find(query.bson()).Count()
+}
+
+func (s *mongoStore) QueryBatchSummaries(query BatchQuery) ([]*BatchSummary, error) {
+	order, err := query.order()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort and limit before the lookup, so only the page is joined
+	pipeline := []bson.M{{"$match": query.bson()}}
+	if query.sorted() {
+		pipeline = append(pipeline, bson.M{"$sort": order.document()})
+	}
+	if query.Limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": query.Limit})
+	}
+
+	pipeline = append(pipeline,
+		bson.M{"$project": bson.M{
+			"recipe":        1,
+			"stringId":      1,
+			"hydrometer":    1,
+			"firstReading":  1,
+			"latestReading": 1,
+			"readingCount":  1,
+			"startDate":     1,
+			"lastUpdate":    1,
+			"active":        1,
+			"archived":      1,
+			"stable":        1,
+			"finalGravity":  1,
+			"version":       1,
+
+			"originalGravity": 1,
+			"currentGravity":  1,
+		}},
+		bson.M{"$lookup": bson.M{
+			"from":         s.hydrometerCollection.Name,
+			"localField":   "hydrometer",
+			"foreignField": "_id",
+			"as":           "hydrometerDocs",
+		}},
+		bson.M{"$addFields": bson.M{
+			"hydrometerName": bson.M{"$arrayElemAt": []interface{}{"$hydrometerDocs.name", 0}},
+		}},
+		bson.M{"$project": bson.M{"hydrometerDocs": 0}},
+	)
+
+	summaries := []*BatchSummary{}
+	err = s.batchCollection.Pipe(pipeline).All(&summaries)
+	return summaries, err
+}
+
+// SaveHydrometer replaces the stored hydrometer, so fields omitted when
+// empty, like its owner, are cleared too.
+func (s *mongoStore) SaveHydrometer(h *Hydrometer) error {
+	_, err := s.hydrometerCollection.UpsertId(h.ID, *h)
+	return translateMongoError(err)
+}
+
+func (s *mongoStore) QueryHydrometers(query HydrometerQuery) ([]*Hydrometer, error) {
+	order, err := query.order()
+	if err != nil {
+		return nil, err
+	}
+
+	find := s.hydrometerCollection.Find(query.bson())
+	if query.sorted() {
+		find = find.Sort(order.keys()...)
+	}
+	if query.Limit > 0 {
+		find = find.Limit(query.Limit)
+	}
+
+	hydrometers := []*Hydrometer{}
+	err = find.All(&hydrometers)
+	return hydrometers, err
+}
+
+func (s *mongoStore) CountHydrometers(query HydrometerQuery) (int, error) {
+	query.After = nil
+	return s.hydrometerCollection.Find(query.bson()).Count()
+}
+
+// AddReading inserts r, then folds it into the summary. Those are
+// separate writes, so the fold is idempotent: if it fails, the reading
+// is stored but the summary lags until the reading is sent again, which
+// folds in the stored copy, or repairReadingSummaries runs at startup.
+// The next reading fixes the count and latest reading in any case.
+func (s *mongoStore) AddReading(r *GravityReading, updated time.Time) error {
+	err := s.readingCollection.Insert(*r)
+
+	if mgo.IsDup(err) {
+		key := bson.M{"batch": r.BatchID, "date": r.Date, "deviceId": r.DeviceID}
+		if r.DeviceID == "" {
+			// Matches readings without one
+			key["deviceId"] = nil
+		}
+
+		stored := GravityReading{}
+		if s.readingCollection.Find(bson.M{"$or": []bson.M{{"_id": r.ID}, key}}).One(&stored) == nil {
+			s.foldReading(&stored, updated)
+		}
+		return ErrDuplicateKey
+	} else if err != nil {
+		return err
+	}
+
+	return s.foldReading(r, updated)
+}
+
+// foldReading updates r's batch's summary for r, which is stored. It
+// can be repeated without changing the result. Hidden readings are only
+// counted.
+func (s *mongoStore) foldReading(r *GravityReading, updated time.Time) error {
+	count, err := s.readingCollection.Find(bson.M{"batch": r.BatchID}).Count()
+	if err != nil {
+		return err
+	}
+
+	// With $max, a count taken before a concurrent insert can't undo
+	// one taken after it
+	err = s.batchCollection.UpdateId(r.BatchID, bson.M{
+		"$max": bson.M{"readingCount": count, "lastUpdate": updated},
+	})
+	if err != nil || r.Hidden {
+		return err
+	}
+
+	// Each of these only matches if r belongs at that end of the series,
+	// so concurrent readings settle on the right summary in any order.
+	err = s.batchCollection.Update(bson.M{
+		"_id": r.BatchID,
+		"$or": []bson.M{
+			{"firstReading.date": bson.M{"$exists": false}},
+			{"firstReading.date": bson.M{"$gt": r.Date}},
+		},
+	}, bson.M{"$set": bson.M{"firstReading": *r}})
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	err = s.batchCollection.Update(bson.M{
+		"_id": r.BatchID,
+		"$or": []bson.M{
+			{"latestReading.date": bson.M{"$exists": false}},
+			{"latestReading.date": bson.M{"$lte": r.Date}},
+		},
+	}, bson.M{"$set": bson.M{"latestReading": *r}})
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+func (s *mongoStore) SaveReading(r *GravityReading) error {
+	err := s.readingCollection.UpdateId(r.ID, *r)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.batchCollection.UpdateAll(bson.M{"firstReading._id": r.ID}, bson.M{"$set": bson.M{"firstReading": *r}})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.batchCollection.UpdateAll(bson.M{"latestReading._id": r.ID}, bson.M{"$set": bson.M{"latestReading": *r}})
+	return err
+}
+
+func (s *mongoStore) QueryReadings(query ReadingQuery) ([]GravityReading, error) {
+	order := []string{"date", "_id"}
+	if query.Reverse {
+		order = []string{"-date", "-_id"}
+	}
+
+	readings := []GravityReading{}
+	err := s.readingCollection.Find(query.bson()).Sort(order...).Limit(query.Limit).All(&readings)
+	return readings, err
+}
+
+func (s *mongoStore) SaveReadingEnds(batchID bson.ObjectId, first GravityReading, latest GravityReading) error {
+	set := bson.M{}
+	unset := bson.M{}
+
+	for key, r := range map[string]GravityReading{"firstReading": first, "latestReading": latest} {
+		if r.ID == "" {
+			// AddReading's conditions expect a missing end, not an empty one
+			unset[key] = ""
+		} else {
+			set[key] = r
+		}
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	return s.batchCollection.UpdateId(batchID, update)
+}
+
+func (s *mongoStore) SaveGravityEstimates(batchID bson.ObjectId, originalGravity float64, currentGravity float64) error {
+	return s.batchCollection.UpdateId(batchID, bson.M{"$set": bson.M{
+		"originalGravity": originalGravity,
+		"currentGravity":  currentGravity,
+	}})
+}
+
+func (s *mongoStore) AddReprocessing(p *Reprocessing) error {
+	return s.reprocessCollection.Insert(*p)
+}
+
+func (s *mongoStore) QueryReprocessings(query ReprocessingQuery) ([]*Reprocessing, error) {
+	reprocessings := []*Reprocessing{}
+	err := s.reprocessCollection.Find(query.bson()).Sort("appliedAt").All(&reprocessings)
+	return reprocessings, err
+}
+
+func (s *mongoStore) SaveAlert(a *Alert) error {
+	_, err := s.alertCollection.UpsertId(a.ID, a)
+	return err
+}
+
+func (s *mongoStore) SaveNotification(n *Notification) error {
+	_, err := s.outboxCollection.UpsertId(n.ID, n)
+	return err
+}
+
+func (s *mongoStore) QueryNotifications(query NotificationQuery) ([]*Notification, error) {
+	find := s.outboxCollection.Find(query.bson()).Sort("nextAttempt", "_id")
+	if query.Limit > 0 {
+		find = find.Limit(query.Limit)
+	}
+
+	notifications := []*Notification{}
+	err := find.All(&notifications)
+	return notifications, err
+}
+
+func (s *mongoStore) QueryAlerts(query AlertQuery) ([]*Alert, error) {
+	alerts := []*Alert{}
+	err := s.alertCollection.Find(query.bson()).Sort("-openedAt", "-_id").All(&alerts)
+	return alerts, err
+}
+
+func (s *mongoStore) Drop() error {
+	return s.dbRef.DropDatabase()
+}
+
+// Batch fields marshaled with omitempty, which SaveBatch unsets when
+// they're empty so that clearing them sticks
+var omittedBatchFields = []string{"finalGravity", "stableAt", "owner"}
+
+// batchUpdate returns SaveBatch's update for b: its fields set, cleared
+// ones unset, and its version incremented.
+func batchUpdate(b *Batch) (bson.M, error) {
+	fields, err := batchFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	update := bson.M{
+		"$set": fields,
+		"$inc": bson.M{"version": 1},
+	}
+
+	unset := bson.M{}
+	for _, key := range omittedBatchFields {
+		if _, ok := fields[key]; !ok {
+			unset[key] = ""
+		}
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	return update, nil
+}
+
+// batchFields returns the fields of b that SaveBatch writes: everything
+// except the ID, the version, and the reading summary and estimates.
+func batchFields(b *Batch) (bson.M, error) {
+	raw, err := bson.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := bson.M{}
+	err = bson.Unmarshal(raw, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{"_id", "version", "firstReading", "latestReading", "readingCount", "originalGravity", "currentGravity"} {
+		delete(fields, key)
+	}
+
+	return fields, nil
+}
+
+func translateMongoError(err error) error {
+	if mgo.IsDup(err) {
+		return ErrDuplicateKey
+	}
+	return err
 }
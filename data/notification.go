@@ -0,0 +1,123 @@
+package data
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/config"
+	"go.uber.org/zap"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Event types. Alerts are sent as "alert." and the alert kind, like
+// "alert.silent". Readings are only published to live subscribers,
+// never queued for notification channels.
+const (
+	EventBatchStarted       = "batch.started"
+	EventBatchFinished      = "batch.finished"
+	EventBatchArchived      = "batch.archived"
+	EventBatchStable        = "batch.stable"
+	EventHydrometerAssigned = "hydrometer.assigned"
+	EventHydrometerArchived = "hydrometer.archived"
+	EventReadingAdded       = "reading.added"
+	eventAlertPrefix        = "alert."
+)
+
+// Event is something that happened that users may want to hear about.
+type Event struct {
+	Type         string          `json:"type" bson:"type"`
+	Time         time.Time       `json:"time" bson:"time"`
+	BatchID      bson.ObjectId   `json:"batch,omitempty" bson:"batch,omitempty"`
+	HydrometerID bson.ObjectId   `json:"hydrometer,omitempty" bson:"hydrometer,omitempty"`
+	Message      string          `json:"message" bson:"message"`
+	Alert        *Alert          `json:"alert,omitempty" bson:"alert,omitempty"`
+	Reading      *GravityReading `json:"reading,omitempty" bson:"reading,omitempty"`
+}
+
+type NotificationState string
+
+const (
+	NotificationPending   NotificationState = "pending"
+	NotificationDelivered NotificationState = "delivered"
+	NotificationFailed    NotificationState = "failed" // out of retries
+)
+
+// Notification is an event queued for delivery to one channel. The
+// queue is kept in the store, so nothing is lost across restarts.
+type Notification struct {
+	ID          bson.ObjectId     `bson:"_id"`
+	Channel     string            `bson:"channel"` // config name
+	Event       Event             `bson:"event"`
+	State       NotificationState `bson:"state"`
+	Attempts    int               `bson:"attempts"`
+	NextAttempt time.Time         `bson:"nextAttempt"`
+	LastError   string            `bson:"lastError,omitempty"`
+	CreatedAt   time.Time         `bson:"created"`
+	DeliveredAt time.Time         `bson:"deliveredAt,omitempty"`
+}
+
+// Notify publishes event to live subscribers and queues it for every
+// channel subscribed to it. Failures are logged; events are never worth
+// failing the caller over.
+func Notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	Publish(event)
+
+	for _, channel := range config.GetConfig().NotificationChannels {
+		if !subscribed(channel, event.Type) {
+			continue
+		}
+
+		n := &Notification{
+			ID:          bson.NewObjectId(),
+			Channel:     channel.Name,
+			Event:       event,
+			State:       NotificationPending,
+			NextAttempt: event.Time,
+			CreatedAt:   time.Now(),
+		}
+
+		err := store.SaveNotification(n)
+		if err != nil {
+			graviton.Logger.Error("Failed to queue notification",
+				zap.String("Channel", channel.Name),
+				zap.String("Event", event.Type),
+				zap.Error(err))
+		}
+	}
+}
+
+func subscribed(channel config.NotificationChannel, eventType string) bool {
+	if len(channel.Events) == 0 {
+		return true
+	}
+
+	for _, subscription := range channel.Events {
+		if subscription == eventType || strings.HasPrefix(eventType, subscription+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notification) Save() error {
+	return store.SaveNotification(n)
+}
+
+func QueryNotifications(query NotificationQuery) ([]*Notification, error) {
+	return store.QueryNotifications(query)
+}
+
+func (b *Batch) alertEvent(a *Alert) Event {
+	return Event{
+		Type:         eventAlertPrefix + string(a.Kind),
+		Time:         a.OpenedAt,
+		BatchID:      a.BatchID,
+		HydrometerID: a.HydrometerID,
+		Message:      b.RecipeName + ": " + a.Message,
+		Alert:        a,
+	}
+}
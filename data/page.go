@@ -0,0 +1,158 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrBadSort is returned by queries sorting on a field they can't sort by.
+var ErrBadSort = errors.New("bad sort field")
+
+// Sort fields, by their bson names
+var (
+	batchSortFields      = []string{"startDate", "lastUpdate", "recipe", "stringId"}
+	hydrometerSortFields = []string{"name"}
+)
+
+// Cursor marks the last result of a page of sorted query results: its
+// value for the sort field, and its ID to break ties.
+type Cursor struct {
+	Value interface{} // time.Time or string, by sort field; unused when sorting by ID
+	ID    bson.ObjectId
+}
+
+// sortOrder is a parsed query Sort. Without a sort field, results are
+// ordered by ID.
+type sortOrder struct {
+	field      string
+	descending bool
+}
+
+func parseSort(sort string, fields []string) (sortOrder, error) {
+	order := sortOrder{field: "_id"}
+	if sort == "" {
+		return order, nil
+	}
+
+	if strings.HasPrefix(sort, "-") {
+		order.descending = true
+		sort = sort[1:]
+	}
+
+	for _, field := range fields {
+		if field == sort {
+			order.field = field
+			return order, nil
+		}
+	}
+
+	return order, ErrBadSort
+}
+
+// keys returns the order as mgo sort keys.
+func (o sortOrder) keys() []string {
+	prefix := ""
+	if o.descending {
+		prefix = "-"
+	}
+
+	if o.field == "_id" {
+		return []string{prefix + "_id"}
+	}
+	return []string{prefix + o.field, prefix + "_id"}
+}
+
+// document returns the order as an aggregation $sort document.
+func (o sortOrder) document() bson.D {
+	direction := 1
+	if o.descending {
+		direction = -1
+	}
+
+	if o.field == "_id" {
+		return bson.D{{Name: "_id", Value: direction}}
+	}
+	return bson.D{{Name: o.field, Value: direction}, {Name: "_id", Value: direction}}
+}
+
+// after returns a query condition selecting results after cursor.
+func (o sortOrder) after(cursor *Cursor) bson.M {
+	operator := "$gt"
+	if o.descending {
+		operator = "$lt"
+	}
+
+	if o.field == "_id" {
+		return bson.M{"_id": bson.M{operator: cursor.ID}}
+	}
+	return bson.M{"$or": []bson.M{
+		{o.field: bson.M{operator: cursor.Value}},
+		{o.field: cursor.Value, "_id": bson.M{operator: cursor.ID}},
+	}}
+}
+
+// before reports whether a sorts before b.
+func (o sortOrder) before(a *Cursor, b *Cursor) bool {
+	comparison := 0
+	if o.field != "_id" {
+		comparison = compareSortValues(a.Value, b.Value)
+	}
+	if comparison == 0 {
+		comparison = strings.Compare(string(a.ID), string(b.ID))
+	}
+
+	if o.descending {
+		return comparison > 0
+	}
+	return comparison < 0
+}
+
+func compareSortValues(a interface{}, b interface{}) int {
+	switch a := a.(type) {
+	case time.Time:
+		b, _ := b.(time.Time)
+		if a.Before(b) {
+			return -1
+		} else if a.After(b) {
+			return 1
+		}
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	}
+	return 0
+}
+
+// Cursor returns a cursor for paging after this batch in results
+// sorted by sort.
+func (s *BatchSummary) Cursor(sort string) *Cursor {
+	order, _ := parseSort(sort, batchSortFields)
+
+	cursor := &Cursor{ID: s.ID}
+	switch order.field {
+	case "startDate":
+		cursor.Value = s.StartDate
+	case "lastUpdate":
+		cursor.Value = s.LastUpdate
+	case "recipe":
+		cursor.Value = s.RecipeName
+	case "stringId":
+		cursor.Value = s.UniqueID
+	}
+	return cursor
+}
+
+// Cursor returns a cursor for paging after this hydrometer in results
+// sorted by sort.
+func (h *Hydrometer) Cursor(sort string) *Cursor {
+	order, _ := parseSort(sort, hydrometerSortFields)
+
+	cursor := &Cursor{ID: h.ID}
+	if order.field == "name" {
+		cursor.Value = h.Name
+	}
+	return cursor
+}
@@ -0,0 +1,255 @@
+package data
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/jslater89/graviton/units"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RawReading is what a device reported, before calibration or unit
+// conversion. It is kept so readings can be reprocessed later.
+type RawReading struct {
+	Gravity          float64 `json:"gravity" bson:"gravity"`
+	GravityUnits     string  `json:"gravityUnits,omitempty" bson:"gravityUnits,omitempty"` // SG if empty
+	Temperature      float64 `json:"temperature" bson:"temperature"`
+	TemperatureUnits string  `json:"temperatureUnits" bson:"temperatureUnits"`
+	Angle            float64 `json:"angle,omitempty" bson:"angle,omitempty"`
+}
+
+// sg and fahrenheit convert raw values to the stored units. Units
+// were checked when the reading arrived, so unparseable ones can only
+// come from hand-edited data; those are taken as SG and °F.
+func (raw *RawReading) sg() float64 {
+	if raw.Gravity == 0 {
+		return 0
+	}
+	unit, _ := units.ParseGravity(raw.GravityUnits)
+	return units.ToSG(raw.Gravity, unit)
+}
+
+func (raw *RawReading) fahrenheit() float64 {
+	unit, _ := units.ParseTemperature(raw.TemperatureUnits)
+	return units.ToFahrenheit(raw.Temperature, unit)
+}
+
+// ReprocessOptions selects readings to reprocess and says how. Either
+// BatchID or HydrometerID must be set; a hydrometer covers every batch
+// it has been assigned to.
+type ReprocessOptions struct {
+	BatchID      bson.ObjectId `json:"batch,omitempty" bson:"batch,omitempty"`
+	HydrometerID bson.ObjectId `json:"hydrometer,omitempty" bson:"hydrometer,omitempty"`
+	From         time.Time     `json:"from" bson:"from"` // inclusive
+	To           time.Time     `json:"to" bson:"to"`     // exclusive
+
+	// CalibrationVersion is the hydrometer calibration to convert raw
+	// angles with. Zero keeps the calibration each reading was converted
+	// with, or the gravity the device reported for readings that weren't.
+	CalibrationVersion int `json:"calibrationVersion" bson:"calibrationVersion"`
+	// Added to every recomputed gravity and temperature (°F)
+	GravityOffset     float64 `json:"gravityOffset" bson:"gravityOffset"`
+	TemperatureOffset float64 `json:"temperatureOffset" bson:"temperatureOffset"`
+}
+
+type ReadingChange struct {
+	ReadingID             bson.ObjectId `json:"reading" bson:"reading"`
+	BatchID               bson.ObjectId `json:"batch" bson:"batch"`
+	Date                  time.Time     `json:"date" bson:"date"`
+	OldGravity            float64       `json:"oldGravity" bson:"oldGravity"`
+	NewGravity            float64       `json:"newGravity" bson:"newGravity"`
+	OldTemperature        float64       `json:"oldTemperature" bson:"oldTemperature"`
+	NewTemperature        float64       `json:"newTemperature" bson:"newTemperature"`
+	OldCorrectedGravity   float64       `json:"oldCorrectedGravity" bson:"oldCorrectedGravity"`
+	NewCorrectedGravity   float64       `json:"newCorrectedGravity" bson:"newCorrectedGravity"`
+	OldCalibrationVersion int           `json:"oldCalibrationVersion" bson:"oldCalibrationVersion"`
+	NewCalibrationVersion int           `json:"newCalibrationVersion" bson:"newCalibrationVersion"`
+}
+
+// Reprocessing is a planned set of reading changes. Once applied, it
+// is stored as the audit record of the change.
+type Reprocessing struct {
+	ID           bson.ObjectId    `json:"id" bson:"_id"`
+	Options      ReprocessOptions `json:"options" bson:"options"`
+	HydrometerID bson.ObjectId    `json:"hydrometer" bson:"hydrometer"`
+	BatchIDs     []bson.ObjectId  `json:"batches" bson:"batches"`
+	Changes      []ReadingChange  `json:"changes" bson:"changes"`
+	Unchanged    int              `json:"unchanged" bson:"unchanged"`
+
+	Applied   bool      `json:"applied" bson:"applied"`
+	AppliedBy string    `json:"appliedBy,omitempty" bson:"appliedBy,omitempty"`
+	AppliedAt time.Time `json:"appliedAt,omitempty" bson:"appliedAt,omitempty"`
+}
+
+// PlanReprocessing works out what reprocessing would change, without
+// changing anything.
+func PlanReprocessing(opts ReprocessOptions) (*Reprocessing, error) {
+	var batches []*Batch
+	var err error
+
+	if opts.BatchID != "" {
+		batches, err = QueryBatches(BatchQuery{ID: opts.BatchID})
+		if err == nil && len(batches) == 0 {
+			err = ErrNotFound
+		}
+	} else if opts.HydrometerID != "" {
+		batches, err = QueryBatches(BatchQuery{HydrometerID: opts.HydrometerID})
+	} else {
+		err = errors.New("reprocessing needs a batch or a hydrometer")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Reprocessing{
+		ID:           bson.NewObjectId(),
+		Options:      opts,
+		HydrometerID: opts.HydrometerID,
+		BatchIDs:     []bson.ObjectId{},
+		Changes:      []ReadingChange{},
+	}
+	if plan.HydrometerID == "" {
+		plan.HydrometerID = batches[0].HydrometerID
+	}
+
+	hydrometer, err := SingleHydrometer(HydrometerQuery{ID: plan.HydrometerID})
+	if err == ErrNotFound && opts.CalibrationVersion == 0 {
+		// Batch without a hydrometer; corrections use the default
+		hydrometer, err = &Hydrometer{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var calibration *Calibration
+	if opts.CalibrationVersion != 0 {
+		calibration = hydrometer.CalibrationVersion(opts.CalibrationVersion)
+		if calibration == nil {
+			return nil, errors.New("hydrometer has no such calibration version")
+		}
+	}
+
+	for _, b := range batches {
+		plan.BatchIDs = append(plan.BatchIDs, b.ID)
+
+		readings, err := store.QueryReadings(ReadingQuery{BatchID: b.ID, From: opts.From, To: opts.To})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range readings {
+			change := reprocessReading(r, hydrometer, calibration, opts)
+			if change == nil {
+				plan.Unchanged++
+			} else {
+				plan.Changes = append(plan.Changes, *change)
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// Apply saves the planned changes and stores the plan as an audit
+// record, attributed to user.
+func (p *Reprocessing) Apply(user string) error {
+	if p.Applied {
+		return errors.New("reprocessing already applied")
+	}
+
+	for _, change := range p.Changes {
+		readings, err := store.QueryReadings(ReadingQuery{ID: change.ReadingID})
+		if err != nil {
+			return err
+		}
+		if len(readings) == 0 {
+			return errors.New("reading not found")
+		}
+
+		reading := readings[0]
+		reading.Gravity = change.NewGravity
+		reading.Temperature = change.NewTemperature
+		reading.CorrectedGravity = change.NewCorrectedGravity
+		reading.CalibrationVersion = change.NewCalibrationVersion
+
+		err = store.SaveReading(&reading)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range p.BatchIDs {
+		b := &Batch{ID: id}
+		err := b.updateEstimates()
+		if err != nil {
+			return err
+		}
+	}
+
+	p.Applied = true
+	p.AppliedBy = user
+	p.AppliedAt = time.Now()
+
+	return store.AddReprocessing(p)
+}
+
+// QueryReprocessings returns applied reprocessings, oldest first.
+func QueryReprocessings(query ReprocessingQuery) ([]*Reprocessing, error) {
+	return store.QueryReprocessings(query)
+}
+
+// reprocessReading recomputes r from its raw values, returning nil if
+// nothing changes. Angles are converted with calibration, or if it's
+// nil, the hydrometer calibration r was converted with.
+func reprocessReading(r GravityReading, hydrometer *Hydrometer, calibration *Calibration, opts ReprocessOptions) *ReadingChange {
+	raw := r.Raw
+	if raw == nil {
+		// Stored before raw values were kept; the best we have
+		raw = &RawReading{
+			Gravity:          r.Gravity,
+			Temperature:      r.Temperature,
+			TemperatureUnits: string(units.Fahrenheit),
+			Angle:            r.Angle,
+		}
+	}
+
+	change := &ReadingChange{
+		ReadingID:             r.ID,
+		BatchID:               r.BatchID,
+		Date:                  r.Date,
+		OldGravity:            r.Gravity,
+		NewGravity:            raw.sg() + opts.GravityOffset,
+		OldTemperature:        r.Temperature,
+		OldCorrectedGravity:   r.CorrectedGravity,
+		NewTemperature:        raw.fahrenheit() + opts.TemperatureOffset,
+		OldCalibrationVersion: r.CalibrationVersion,
+		NewCalibrationVersion: r.CalibrationVersion,
+	}
+
+	if calibration == nil && r.CalibrationVersion != 0 && raw.Angle != 0 {
+		calibration = hydrometer.CalibrationVersion(r.CalibrationVersion)
+		if calibration == nil {
+			// Its calibration is gone, so there's nothing to convert the
+			// angle with; the gravity stays as it was
+			change.NewGravity = r.Gravity
+		}
+	}
+
+	if calibration != nil && raw.Angle != 0 {
+		change.NewGravity = calibration.Gravity(raw.Angle) + opts.GravityOffset
+		change.NewCalibrationVersion = calibration.Version
+	}
+
+	change.NewCorrectedGravity = correctGravity(change.NewGravity, change.NewTemperature, hydrometer.ReferenceTemperature())
+
+	if math.Abs(change.NewGravity-change.OldGravity) < 1e-9 &&
+		math.Abs(change.NewTemperature-change.OldTemperature) < 1e-9 &&
+		math.Abs(change.NewCorrectedGravity-change.OldCorrectedGravity) < 1e-9 &&
+		change.NewCalibrationVersion == change.OldCalibrationVersion {
+		return nil
+	}
+
+	return change
+}
@@ -0,0 +1,525 @@
+package data
+
+import (
+	"errors"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotFound is returned when a single-object query matches nothing.
+var ErrNotFound = mgo.ErrNotFound
+
+// ErrDuplicateKey is returned by stores when a save would violate
+// a uniqueness constraint (batch string IDs, hydrometer names and
+// device IDs).
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// ErrConflict is returned when saving a batch that has been changed
+// by someone else since it was loaded.
+var ErrConflict = errors.New("batch was modified concurrently")
+
+// Store is the persistence layer behind the data package. Batches,
+// hydrometers, and gravity readings all go through the current store,
+// which is set by InitMongo or InitMemory.
+type Store interface {
+	// SaveBatch inserts or updates b if b.Version matches the stored
+	// version, returning ErrConflict otherwise, and increments b.Version.
+	// The reading summary fields are left alone; AddReading, SaveReading
+	// and SaveGravityEstimates maintain them.
+	SaveBatch(b *Batch) error
+	QueryBatches(query BatchQuery) ([]*Batch, error)
+	// QueryBatchSummaries is QueryBatches for listing, joining each
+	// batch's hydrometer name.
+	QueryBatchSummaries(query BatchQuery) ([]*BatchSummary, error)
+	// CountBatches counts the batches a query matches, ignoring its
+	// cursor and limit.
+	CountBatches(query BatchQuery) (int, error)
+
+	SaveHydrometer(h *Hydrometer) error
+	QueryHydrometers(query HydrometerQuery) ([]*Hydrometer, error)
+	// CountHydrometers counts the hydrometers a query matches, ignoring
+	// its cursor and limit.
+	CountHydrometers(query HydrometerQuery) (int, error)
+
+	// AddReading inserts a new reading and atomically folds it into
+	// its batch's reading summary, setting the batch's last update time
+	// to at least updated. A reading with the ID of one already stored,
+	// or the batch, date and device ID, is ErrDuplicateKey; the stored
+	// one is folded into the summary again, in case that failed before.
+	AddReading(r *GravityReading, updated time.Time) error
+	// SaveReading replaces an existing reading by ID, including any
+	// copies of it in batch reading summaries.
+	SaveReading(r *GravityReading) error
+	// SaveReadingEnds sets a batch's first and latest readings. An
+	// empty reading, without an ID, clears one.
+	SaveReadingEnds(batchID bson.ObjectId, first GravityReading, latest GravityReading) error
+	// QueryReadings returns matching readings, oldest first, with ties
+	// broken by ID so paging is stable.
+	QueryReadings(query ReadingQuery) ([]GravityReading, error)
+	// SaveGravityEstimates sets a batch's original and current gravity
+	// estimates.
+	SaveGravityEstimates(batchID bson.ObjectId, originalGravity float64, currentGravity float64) error
+
+	// AddReprocessing stores the audit record of an applied reprocessing.
+	AddReprocessing(p *Reprocessing) error
+	// QueryReprocessings returns matching audit records, oldest first.
+	QueryReprocessings(query ReprocessingQuery) ([]*Reprocessing, error)
+
+	// SaveAlert inserts or replaces an alert.
+	SaveAlert(a *Alert) error
+	// QueryAlerts returns matching alerts, newest first.
+	QueryAlerts(query AlertQuery) ([]*Alert, error)
+
+	// SaveNotification inserts or replaces a queued notification.
+	SaveNotification(n *Notification) error
+	// QueryNotifications returns matching notifications, soonest next
+	// attempt first.
+	QueryNotifications(query NotificationQuery) ([]*Notification, error)
+
+	// Drop deletes everything in the store.
+	Drop() error
+}
+
+var store Store
+
+// UseStore replaces the store used by the data package.
+func UseStore(s Store) {
+	store = s
+}
+
+// InitMemory switches the data package to a new, empty in-memory store.
+func InitMemory() {
+	UseStore(newMemoryStore())
+}
+
+// BatchQuery selects batches. Zero-valued fields match everything.
+type BatchQuery struct {
+	ID           bson.ObjectId
+	RecipeName   string
+	UniqueID     string
+	HydrometerID bson.ObjectId
+	Active       *bool
+	Archived     *bool
+
+	// Start date and last update bounds, all exclusive
+	StartedAfter  time.Time
+	StartedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+
+	// Sort is a field to sort by: startDate, lastUpdate, recipe or
+	// stringId, with a leading '-' for descending order. Ties are broken
+	// by ID. Without Sort or After, batches come in no particular order.
+	Sort string
+	// After, if set, selects only batches after this cursor in the
+	// query's order, for paging.
+	After *Cursor
+	// Limit caps the number of batches returned, if positive.
+	Limit int
+}
+
+// HydrometerQuery selects hydrometers. Zero-valued fields match everything.
+type HydrometerQuery struct {
+	ID             bson.ObjectId
+	Name           string
+	DeviceID       string
+	CurrentBatchID bson.ObjectId
+	Archived       *bool
+
+	// Sort, After and Limit page results as they do for BatchQuery.
+	// Hydrometers can be sorted by name.
+	Sort  string
+	After *Cursor
+	Limit int
+}
+
+// ReadingQuery selects gravity readings. Zero-valued fields match everything.
+type ReadingQuery struct {
+	ID      bson.ObjectId
+	BatchID bson.ObjectId
+	From    time.Time // inclusive
+	To      time.Time // exclusive
+	Hidden  *bool
+
+	// After, if set, selects only readings after this one in the
+	// query's order, for paging.
+	After *GravityReading
+	// Limit caps the number of readings returned, if positive.
+	Limit int
+	// Reverse returns readings newest first.
+	Reverse bool
+}
+
+// ReprocessingQuery selects reprocessing audit records. Zero-valued
+// fields match everything.
+type ReprocessingQuery struct {
+	BatchID      bson.ObjectId
+	HydrometerID bson.ObjectId
+}
+
+// AlertQuery selects alerts. Zero-valued fields match everything.
+type AlertQuery struct {
+	ID           bson.ObjectId
+	BatchID      bson.ObjectId
+	HydrometerID bson.ObjectId
+	Kind         AlertKind
+	States       []AlertState // any of these
+}
+
+// NotificationQuery selects queued notifications. Zero-valued fields
+// match everything.
+type NotificationQuery struct {
+	State NotificationState
+	// DueBy selects notifications to attempt no later than this.
+	DueBy time.Time
+	Limit int
+}
+
+// Bool returns a pointer to v, for the optional flags on queries.
+func Bool(v bool) *bool {
+	return &v
+}
+
+func (q BatchQuery) bson() bson.M {
+	query := bson.M{}
+
+	if q.ID != "" {
+		query["_id"] = q.ID
+	}
+	if q.RecipeName != "" {
+		query["recipe"] = q.RecipeName
+	}
+	if q.UniqueID != "" {
+		query["stringId"] = q.UniqueID
+	}
+	if q.HydrometerID != "" {
+		query["hydrometer"] = q.HydrometerID
+	}
+	if q.Active != nil {
+		query["active"] = *q.Active
+	}
+	if q.Archived != nil {
+		query["archived"] = *q.Archived
+	}
+	if dateRange := rangeBson(q.StartedAfter, q.StartedBefore); dateRange != nil {
+		query["startDate"] = dateRange
+	}
+	if dateRange := rangeBson(q.UpdatedAfter, q.UpdatedBefore); dateRange != nil {
+		query["lastUpdate"] = dateRange
+	}
+	if q.After != nil {
+		order, _ := q.order()
+		for k, v := range order.after(q.After) {
+			query[k] = v
+		}
+	}
+
+	return query
+}
+
+// order parses the query's Sort.
+func (q BatchQuery) order() (sortOrder, error) {
+	return parseSort(q.Sort, batchSortFields)
+}
+
+// sorted reports whether results need sorting.
+func (q BatchQuery) sorted() bool {
+	return q.Sort != "" || q.After != nil
+}
+
+func (q BatchQuery) matches(b *Batch) bool {
+	if q.ID != "" && q.ID != b.ID {
+		return false
+	}
+	if q.RecipeName != "" && q.RecipeName != b.RecipeName {
+		return false
+	}
+	if q.UniqueID != "" && q.UniqueID != b.UniqueID {
+		return false
+	}
+	if q.HydrometerID != "" && q.HydrometerID != b.HydrometerID {
+		return false
+	}
+	if q.Active != nil && *q.Active != b.Active {
+		return false
+	}
+	if q.Archived != nil && *q.Archived != b.Archived {
+		return false
+	}
+	if !inRange(b.StartDate, q.StartedAfter, q.StartedBefore) {
+		return false
+	}
+	if !inRange(b.LastUpdate, q.UpdatedAfter, q.UpdatedBefore) {
+		return false
+	}
+	if q.After != nil {
+		order, _ := q.order()
+		if !order.before(q.After, b.summary().Cursor(q.Sort)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (q HydrometerQuery) bson() bson.M {
+	query := bson.M{}
+
+	if q.ID != "" {
+		query["_id"] = q.ID
+	}
+	if q.Name != "" {
+		query["name"] = q.Name
+	}
+	if q.DeviceID != "" {
+		query["deviceId"] = q.DeviceID
+	}
+	if q.CurrentBatchID != "" {
+		query["batch"] = q.CurrentBatchID
+	}
+	if q.Archived != nil {
+		query["archived"] = *q.Archived
+	}
+	if q.After != nil {
+		order, _ := q.order()
+		for k, v := range order.after(q.After) {
+			query[k] = v
+		}
+	}
+
+	return query
+}
+
+func (q HydrometerQuery) order() (sortOrder, error) {
+	return parseSort(q.Sort, hydrometerSortFields)
+}
+
+func (q HydrometerQuery) sorted() bool {
+	return q.Sort != "" || q.After != nil
+}
+
+func (q HydrometerQuery) matches(h *Hydrometer) bool {
+	if q.ID != "" && q.ID != h.ID {
+		return false
+	}
+	if q.Name != "" && q.Name != h.Name {
+		return false
+	}
+	if q.DeviceID != "" && q.DeviceID != h.DeviceID {
+		return false
+	}
+	if q.CurrentBatchID != "" && q.CurrentBatchID != h.CurrentBatchID {
+		return false
+	}
+	if q.Archived != nil && *q.Archived != h.Archived {
+		return false
+	}
+	if q.After != nil {
+		order, _ := q.order()
+		if !order.before(q.After, h.Cursor(q.Sort)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (q ReadingQuery) bson() bson.M {
+	query := bson.M{}
+
+	if q.ID != "" {
+		query["_id"] = q.ID
+	}
+	if q.BatchID != "" {
+		query["batch"] = q.BatchID
+	}
+
+	if !q.From.IsZero() || !q.To.IsZero() {
+		dateRange := bson.M{}
+		if !q.From.IsZero() {
+			dateRange["$gte"] = q.From
+		}
+		if !q.To.IsZero() {
+			dateRange["$lt"] = q.To
+		}
+		query["date"] = dateRange
+	}
+	if q.Hidden != nil {
+		query["hidden"] = *q.Hidden
+	}
+	if q.After != nil {
+		after := "$gt"
+		if q.Reverse {
+			after = "$lt"
+		}
+		query["$or"] = []bson.M{
+			{"date": bson.M{after: q.After.Date}},
+			{"date": q.After.Date, "_id": bson.M{after: q.After.ID}},
+		}
+	}
+
+	return query
+}
+
+func (q ReadingQuery) matches(r *GravityReading) bool {
+	if q.ID != "" && q.ID != r.ID {
+		return false
+	}
+	if q.BatchID != "" && q.BatchID != r.BatchID {
+		return false
+	}
+	if !q.From.IsZero() && r.Date.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !r.Date.Before(q.To) {
+		return false
+	}
+	if q.Hidden != nil && *q.Hidden != r.Hidden {
+		return false
+	}
+	if q.After != nil && !q.Reverse && !readingBefore(q.After, r) {
+		return false
+	}
+	if q.After != nil && q.Reverse && !readingBefore(r, q.After) {
+		return false
+	}
+
+	return true
+}
+
+// rangeBson returns a condition for times strictly between after and
+// before, or nil if both are zero.
+func rangeBson(after time.Time, before time.Time) bson.M {
+	if after.IsZero() && before.IsZero() {
+		return nil
+	}
+
+	dateRange := bson.M{}
+	if !after.IsZero() {
+		dateRange["$gt"] = after
+	}
+	if !before.IsZero() {
+		dateRange["$lt"] = before
+	}
+	return dateRange
+}
+
+func inRange(t time.Time, after time.Time, before time.Time) bool {
+	if !after.IsZero() && !t.After(after) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
+
+// readingBefore orders readings by date, then by ID.
+func readingBefore(a *GravityReading, b *GravityReading) bool {
+	if a.Date.Equal(b.Date) {
+		return a.ID < b.ID
+	}
+	return a.Date.Before(b.Date)
+}
+
+func (q ReprocessingQuery) bson() bson.M {
+	query := bson.M{}
+
+	if q.BatchID != "" {
+		query["batches"] = q.BatchID
+	}
+	if q.HydrometerID != "" {
+		query["hydrometer"] = q.HydrometerID
+	}
+
+	return query
+}
+
+func (q ReprocessingQuery) matches(p *Reprocessing) bool {
+	if q.HydrometerID != "" && q.HydrometerID != p.HydrometerID {
+		return false
+	}
+	if q.BatchID != "" {
+		for _, id := range p.BatchIDs {
+			if id == q.BatchID {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (q AlertQuery) bson() bson.M {
+	query := bson.M{}
+
+	if q.ID != "" {
+		query["_id"] = q.ID
+	}
+	if q.BatchID != "" {
+		query["batch"] = q.BatchID
+	}
+	if q.HydrometerID != "" {
+		query["hydrometer"] = q.HydrometerID
+	}
+	if q.Kind != "" {
+		query["kind"] = q.Kind
+	}
+	if len(q.States) > 0 {
+		query["state"] = bson.M{"$in": q.States}
+	}
+
+	return query
+}
+
+func (q AlertQuery) matches(a *Alert) bool {
+	if q.ID != "" && q.ID != a.ID {
+		return false
+	}
+	if q.BatchID != "" && q.BatchID != a.BatchID {
+		return false
+	}
+	if q.HydrometerID != "" && q.HydrometerID != a.HydrometerID {
+		return false
+	}
+	if q.Kind != "" && q.Kind != a.Kind {
+		return false
+	}
+	if len(q.States) > 0 {
+		for _, state := range q.States {
+			if state == a.State {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (q NotificationQuery) bson() bson.M {
+	query := bson.M{}
+
+	if q.State != "" {
+		query["state"] = q.State
+	}
+	if !q.DueBy.IsZero() {
+		query["nextAttempt"] = bson.M{"$lte": q.DueBy}
+	}
+
+	return query
+}
+
+func (q NotificationQuery) matches(n *Notification) bool {
+	if q.State != "" && q.State != n.State {
+		return false
+	}
+	if !q.DueBy.IsZero() && n.NextAttempt.After(q.DueBy) {
+		return false
+	}
+
+	return true
+}
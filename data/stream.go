@@ -0,0 +1,79 @@
+package data
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"go.uber.org/zap"
+)
+
+// Events buffered per subscriber. A subscriber that falls this far
+// behind misses events rather than holding up the publisher.
+const subscriptionBuffer = 64
+
+// Subscription receives published events matching its filter, until
+// closed.
+type Subscription struct {
+	Events <-chan Event
+
+	events chan Event
+	match  func(Event) bool
+	once   sync.Once
+}
+
+var subscriptions = struct {
+	sync.Mutex
+	all map[*Subscription]bool
+}{all: map[*Subscription]bool{}}
+
+// Subscribe starts receiving events for which match returns true. Call
+// Close when done with the subscription.
+func Subscribe(match func(Event) bool) *Subscription {
+	events := make(chan Event, subscriptionBuffer)
+	s := &Subscription{
+		Events: events,
+		events: events,
+		match:  match,
+	}
+
+	subscriptions.Lock()
+	subscriptions.all[s] = true
+	subscriptions.Unlock()
+
+	return s
+}
+
+// Close stops the subscription and closes its Events channel.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		subscriptions.Lock()
+		delete(subscriptions.all, s)
+		subscriptions.Unlock()
+
+		close(s.events)
+	})
+}
+
+// Publish sends event to live subscribers in this process. Unlike
+// Notify, nothing is queued for notification channels.
+func Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	subscriptions.Lock()
+	defer subscriptions.Unlock()
+
+	for s := range subscriptions.all {
+		if !s.match(event) {
+			continue
+		}
+
+		select {
+		case s.events <- event:
+		default:
+			graviton.Logger.Warn("Dropped event for slow subscriber", zap.String("Event", event.Type))
+		}
+	}
+}
@@ -7,14 +7,19 @@ import (
 	"math/rand"
 
 	"github.com/jslater89/graviton"
-	"github.com/jslater89/graviton/config"
 	"go.uber.org/zap"
 	"gopkg.in/mgo.v2/bson"
 )
 
-// GenerateDemoData populates the database with some
+// GenerateDemoData populates the current store with some
 // example information.
 func GenerateDemoData() {
+	generateDemoData()
+}
+
+// GenerateTestData replaces the current store with a fresh
+// in-memory store holding the demo data.
+func GenerateTestData() {
 	generateTestData()
 }
 
@@ -42,8 +47,11 @@ func GenerateDemoReadings(b *Batch) {
 }
 
 func generateTestData() {
-	InitMongo("localhost", config.GetConfig().GetDBName())
+	InitMemory()
+	generateDemoData()
+}
 
+func generateDemoData() {
 	blueHydrometer := &Hydrometer{
 		ID:          bson.NewObjectId(),
 		Name:        "Blue Hydrometer",
@@ -134,15 +142,15 @@ func GetTestObjects() (*Hydrometer, *Hydrometer, *Batch, *Batch) {
 	hydrometers := []*Hydrometer{}
 	batches := []*Batch{}
 
-	hydrometers, _ = QueryHydrometers(bson.M{"name": "Blue Hydrometer"})
+	hydrometers, _ = QueryHydrometers(HydrometerQuery{Name: "Blue Hydrometer"})
 	blueHydrometer = hydrometers[0]
 
-	greenHydrometer, _ = SingleHydrometer(bson.M{"name": "Green Hydrometer"})
+	greenHydrometer, _ = SingleHydrometer(HydrometerQuery{Name: "Green Hydrometer"})
 
-	batches, _ = QueryBatches(bson.M{"stringId": "20171101-flueseason"})
+	batches, _ = QueryBatches(BatchQuery{UniqueID: "20171101-flueseason"})
 	flueSeason = batches[0]
 
-	hopForward, _ = SingleBatch(bson.M{"stringId": "20171101-hopforward"})
+	hopForward, _ = SingleBatch(BatchQuery{UniqueID: "20171101-hopforward"})
 
 	fmt.Println(blueHydrometer)
 	fmt.Println(greenHydrometer)
@@ -153,5 +161,5 @@ func GetTestObjects() (*Hydrometer, *Hydrometer, *Batch, *Batch) {
 }
 
 func CleanupTestData() {
-	db.dbRef.DropDatabase()
+	store.Drop()
 }
@@ -0,0 +1,116 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/jslater89/graviton/config"
+	"github.com/jslater89/graviton/data"
+)
+
+// Webhook request headers
+const (
+	EventHeader     = "X-Graviton-Event"
+	DeliveryHeader  = "X-Graviton-Delivery"  // notification ID, the same across retries
+	SignatureHeader = "X-Graviton-Signature" // "sha256=" and Signature of the body
+)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Signature is the hex HMAC-SHA256 of body with secret, for receivers
+// to check webhooks against.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts the event as JSON, signed if the channel has a
+// secret.
+func sendWebhook(channel config.NotificationChannel, n *data.Notification) error {
+	body, err := json.Marshal(n.Event)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{
+		EventHeader:    n.Event.Type,
+		DeliveryHeader: n.ID.Hex(),
+	}
+	if channel.Secret != "" {
+		headers[SignatureHeader] = "sha256=" + Signature(channel.Secret, body)
+	}
+
+	return post(channel.URL, body, headers)
+}
+
+// sendSlack posts the event's message in Slack's incoming webhook
+// format, which Discord also takes at its webhook URLs ending /slack.
+func sendSlack(channel config.NotificationChannel, n *data.Notification) error {
+	body, err := json.Marshal(map[string]string{"text": n.Event.Message})
+	if err != nil {
+		return err
+	}
+
+	return post(channel.URL, body, nil)
+}
+
+func post(url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return nil
+}
+
+// sendEmail mails the event to the channel's recipients through the
+// configured SMTP server.
+func sendEmail(channel config.NotificationChannel, n *data.Notification) error {
+	c := config.GetConfig()
+	if c.SMTPAddress == "" {
+		return fmt.Errorf("no SMTP server configured for email channel %s", channel.Name)
+	}
+
+	var auth smtp.Auth
+	if c.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(c.SMTPAddress)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", c.SMTPUsername, c.SMTPPassword, host)
+	}
+
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", c.SMTPFrom)
+	fmt.Fprintf(message, "To: %s\r\n", strings.Join(channel.To, ", "))
+	fmt.Fprintf(message, "Subject: Graviton: %s\r\n", n.Event.Message)
+	fmt.Fprintf(message, "Date: %s\r\n", n.Event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(message, "%s\r\n\r\nEvent: %s\r\nTime: %s\r\n", n.Event.Message, n.Event.Type, n.Event.Time.Format(time.RFC3339))
+
+	return smtp.SendMail(c.SMTPAddress, auth, c.SMTPFrom, channel.To, message.Bytes())
+}
@@ -0,0 +1,153 @@
+// Package notify delivers queued notifications to the channels in the
+// config, retrying failures with exponential backoff. Events are queued
+// by data.Notify.
+package notify
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/config"
+	"github.com/jslater89/graviton/data"
+	"go.uber.org/zap"
+)
+
+const (
+	maxAttempts = 10
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+
+	// Notifications delivered per DeliverDue call
+	deliveryBatch = 100
+)
+
+// A sender delivers one notification to a channel.
+type sender func(channel config.NotificationChannel, n *data.Notification) error
+
+var senders = map[string]sender{
+	"webhook": sendWebhook,
+	"slack":   sendSlack,
+	"email":   sendEmail,
+}
+
+// ValidateChannels checks that channels have unique names, known types,
+// and the settings their types need.
+func ValidateChannels(channels []config.NotificationChannel) error {
+	names := map[string]bool{}
+
+	for _, channel := range channels {
+		if channel.Name == "" {
+			return errors.New("notification channel has no name")
+		}
+		if names[channel.Name] {
+			return errors.New("duplicate notification channel " + channel.Name)
+		}
+		names[channel.Name] = true
+
+		if senders[channel.Type] == nil {
+			return errors.New("notification channel " + channel.Name + " has unknown type " + channel.Type)
+		}
+		if channel.Type == "email" && len(channel.To) == 0 {
+			return errors.New("email channel " + channel.Name + " has no recipients")
+		}
+		if channel.Type != "email" && channel.URL == "" {
+			return errors.New("notification channel " + channel.Name + " has no url")
+		}
+	}
+
+	return nil
+}
+
+// DeliverDue attempts pending notifications due by now, returning how
+// many were delivered. Failures are rescheduled, until they run out of
+// attempts.
+func DeliverDue(now time.Time) (int, error) {
+	pending, err := data.QueryNotifications(data.NotificationQuery{
+		State: data.NotificationPending,
+		DueBy: now,
+		Limit: deliveryBatch,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	channels := map[string]config.NotificationChannel{}
+	for _, channel := range config.GetConfig().NotificationChannels {
+		channels[channel.Name] = channel
+	}
+
+	delivered := 0
+	for _, n := range pending {
+		err := deliver(channels, n)
+		n.Attempts++
+
+		if err == nil {
+			n.State = data.NotificationDelivered
+			n.DeliveredAt = now
+			n.LastError = ""
+			delivered++
+		} else {
+			n.LastError = err.Error()
+			n.NextAttempt = now.Add(backoff(n.Attempts))
+			if n.Attempts >= maxAttempts {
+				n.State = data.NotificationFailed
+			}
+
+			graviton.Logger.Warn("Notification delivery failed",
+				zap.String("Channel", n.Channel),
+				zap.String("Event", n.Event.Type),
+				zap.Int("Attempts", n.Attempts),
+				zap.Error(err))
+		}
+
+		err = n.Save()
+		if err != nil {
+			return delivered, err
+		}
+	}
+
+	return delivered, nil
+}
+
+func deliver(channels map[string]config.NotificationChannel, n *data.Notification) error {
+	channel, ok := channels[n.Channel]
+	if !ok {
+		return errors.New("notification channel " + n.Channel + " no longer configured")
+	}
+
+	send := senders[channel.Type]
+	if send == nil {
+		return errors.New("unknown notification channel type " + channel.Type)
+	}
+
+	return send(channel, n)
+}
+
+// backoff is how long to wait before the next attempt, after attempts
+// failures: doubling from baseBackoff, up to maxBackoff.
+func backoff(attempts int) time.Duration {
+	wait := baseBackoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
+
+// Run delivers due notifications every interval, starting with any
+// left over from before a restart. It never returns, so run it in its
+// own goroutine.
+func Run(interval time.Duration) {
+	for {
+		_, err := DeliverDue(time.Now())
+		if err != nil {
+			graviton.Logger.Error("Notification delivery stopped", zap.Error(err))
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,172 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jslater89/graviton"
+	"github.com/jslater89/graviton/config"
+	"github.com/jslater89/graviton/data"
+)
+
+func initTest(channels ...config.NotificationChannel) {
+	graviton.InitTest()
+	data.InitMemory()
+	config.OverrideNotificationChannels(channels)
+}
+
+func TestWebhook(t *testing.T) {
+	var received data.Event
+	var headers http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		headers = r.Header
+
+		if r.Header.Get(SignatureHeader) != "sha256="+Signature("hunter2", body) {
+			w.WriteHeader(401)
+			return
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	initTest(
+		config.NotificationChannel{Name: "hook", Type: "webhook", URL: server.URL, Secret: "hunter2"},
+		config.NotificationChannel{Name: "batches", Type: "webhook", URL: server.URL, Events: []string{"batch"}},
+	)
+
+	data.Notify(data.Event{Type: "alert.silent", Message: "Flue Season: No reading for 61 minutes"})
+
+	delivered, err := DeliverDue(time.Now())
+	if err != nil || delivered != 1 {
+		t.Fatalf("Expected 1 delivery, got %d (%v)", delivered, err)
+	}
+
+	if received.Type != "alert.silent" || headers.Get(EventHeader) != "alert.silent" || headers.Get(DeliveryHeader) == "" {
+		t.Errorf("Webhook received wrong event: %v %v", received, headers)
+	}
+
+	pending, _ := data.QueryNotifications(data.NotificationQuery{State: data.NotificationPending})
+	if len(pending) != 0 {
+		t.Errorf("Delivered notifications still pending")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	initTest(config.NotificationChannel{Name: "slack", Type: "slack", URL: server.URL})
+
+	now := time.Now()
+	data.Notify(data.Event{Type: data.EventBatchFinished, Time: now, Message: "Flue Season finished"})
+
+	delivered, _ := DeliverDue(now)
+	if delivered != 0 {
+		t.Errorf("Delivered despite a failure")
+	}
+
+	// Not due again until the backoff passes
+	delivered, _ = DeliverDue(now.Add(baseBackoff - time.Second))
+	if delivered != 0 || failures != 1 {
+		t.Errorf("Retried before the backoff")
+	}
+
+	DeliverDue(now.Add(baseBackoff))
+	delivered, _ = DeliverDue(now.Add(baseBackoff * 3))
+
+	notifications, _ := data.QueryNotifications(data.NotificationQuery{})
+	if delivered != 1 || len(notifications) != 1 || notifications[0].Attempts != 3 || notifications[0].State != data.NotificationDelivered {
+		t.Errorf("Expected delivery on the third attempt, got %v", notifications)
+	}
+
+	if backoff(1) != baseBackoff || backoff(3) != 4*baseBackoff || backoff(maxAttempts*2) != maxBackoff {
+		t.Errorf("Wrong backoff")
+	}
+}
+
+func TestEmail(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer listener.Close()
+
+	messages := make(chan string, 1)
+	go fakeSMTP(listener, messages)
+
+	initTest(config.NotificationChannel{Name: "email", Type: "email", To: []string{"brewer@example.com"}})
+	config.OverrideSMTP(listener.Addr().String(), "graviton@example.com")
+
+	data.Notify(data.Event{Type: "alert.temperature", Message: "Flue Season: Temperature 80.2°F is above 70.0°F"})
+
+	delivered, err := DeliverDue(time.Now())
+	if err != nil || delivered != 1 {
+		t.Fatalf("Expected 1 delivery, got %d (%v)", delivered, err)
+	}
+
+	select {
+	case message := <-messages:
+		if !strings.Contains(message, "To: brewer@example.com") || !strings.Contains(message, "Subject: Graviton: Flue Season: Temperature") {
+			t.Errorf("Wrong message: %s", message)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("No message received")
+	}
+}
+
+// fakeSMTP accepts one message, just well enough for net/smtp.
+func fakeSMTP(listener net.Listener, messages chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch command := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 go ahead")
+			message := ""
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				message += line
+			}
+			messages <- message
+			reply("250 queued")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
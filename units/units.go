@@ -0,0 +1,160 @@
+// Package units converts gravity and temperature between the units
+// brewers use. Internally, Graviton stores specific gravity and °F;
+// everything else is converted at the edges.
+package units
+
+import (
+	"errors"
+	"math"
+	"strings"
+
+	"github.com/jslater89/graviton/analytics"
+)
+
+type Gravity string
+
+const (
+	SG    Gravity = "sg"
+	Plato Gravity = "plato"
+	Brix  Gravity = "brix"
+)
+
+type Temperature string
+
+const (
+	Fahrenheit Temperature = "f"
+	Celsius    Temperature = "c"
+	Kelvin     Temperature = "k"
+)
+
+// System is a choice of gravity and temperature units.
+type System struct {
+	Gravity     Gravity     `json:"gravity" bson:"gravity"`
+	Temperature Temperature `json:"temperature" bson:"temperature"`
+}
+
+// Canonical is the system readings are stored in.
+var Canonical = System{Gravity: SG, Temperature: Fahrenheit}
+
+var presets = map[string]System{
+	"us":       Canonical,
+	"imperial": Canonical,
+	"metric":   {Gravity: Plato, Temperature: Celsius},
+}
+
+// ParseGravity parses a gravity unit name. An empty name means SG.
+func ParseGravity(name string) (Gravity, error) {
+	switch g := Gravity(strings.ToLower(name)); g {
+	case "":
+		return SG, nil
+	case SG, Plato, Brix:
+		return g, nil
+	}
+	return SG, errors.New("unknown gravity units " + name)
+}
+
+// ParseTemperature parses a temperature unit name, with or without a
+// degree sign. An empty name means °F.
+func ParseTemperature(name string) (Temperature, error) {
+	switch t := Temperature(strings.ToLower(strings.TrimPrefix(name, "°"))); t {
+	case "":
+		return Fahrenheit, nil
+	case Fahrenheit, Celsius, Kelvin:
+		return t, nil
+	}
+	return Fahrenheit, errors.New("unknown temperature units " + name)
+}
+
+// ParseSystem parses a preset name (us, imperial or metric) or a
+// comma-separated list of units, like "plato,c". Units not mentioned
+// are canonical.
+func ParseSystem(spec string) (System, error) {
+	if preset, ok := presets[strings.ToLower(spec)]; ok {
+		return preset, nil
+	}
+
+	system := Canonical
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if g, err := ParseGravity(name); err == nil {
+			system.Gravity = g
+		} else if t, err := ParseTemperature(name); err == nil {
+			system.Temperature = t
+		} else {
+			return Canonical, errors.New("unknown units " + name)
+		}
+	}
+
+	return system, nil
+}
+
+// ToSG converts a gravity in the given units to specific gravity.
+func ToSG(value float64, unit Gravity) float64 {
+	switch unit {
+	case Plato:
+		return invert(analytics.SGToPlato, value)
+	case Brix:
+		return invert(sgToBrix, value)
+	}
+	return value
+}
+
+// FromSG converts a specific gravity to the given units.
+func FromSG(sg float64, unit Gravity) float64 {
+	switch unit {
+	case Plato:
+		return analytics.SGToPlato(sg)
+	case Brix:
+		return sgToBrix(sg)
+	}
+	return sg
+}
+
+// ToFahrenheit converts a temperature in the given units to °F.
+func ToFahrenheit(value float64, unit Temperature) float64 {
+	switch unit {
+	case Celsius:
+		return value*9/5 + 32
+	case Kelvin:
+		return (value-273.15)*9/5 + 32
+	}
+	return value
+}
+
+// FromFahrenheit converts a temperature in °F to the given units.
+func FromFahrenheit(f float64, unit Temperature) float64 {
+	switch unit {
+	case Celsius:
+		return (f - 32) * 5 / 9
+	case Kelvin:
+		return (f-32)*5/9 + 273.15
+	}
+	return f
+}
+
+func sgToBrix(sg float64) float64 {
+	return ((182.4601*sg-775.6821)*sg+1262.7794)*sg - 669.5622
+}
+
+// invert finds the SG at which toUnits gives value, by Newton's method,
+// so conversions round-trip exactly.
+func invert(toUnits func(float64) float64, value float64) float64 {
+	// The usual approximation makes a good starting point
+	sg := 1 + value/(258.6-(value/258.2)*227.1)
+
+	for i := 0; i < 20; i++ {
+		const h = 1e-6
+		slope := (toUnits(sg+h) - toUnits(sg-h)) / (2 * h)
+		step := (toUnits(sg) - value) / slope
+		sg -= step
+		if math.Abs(step) < 1e-12 {
+			break
+		}
+	}
+
+	return sg
+}
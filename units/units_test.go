@@ -0,0 +1,59 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGravityConversions(t *testing.T) {
+	plato := FromSG(1.048, Plato)
+	if math.Abs(plato-11.9) > 0.1 {
+		t.Errorf("Wrong Plato for 1.048: %v", plato)
+	}
+
+	brix := FromSG(1.048, Brix)
+	if math.Abs(brix-11.9) > 0.1 {
+		t.Errorf("Wrong Brix for 1.048: %v", brix)
+	}
+
+	for _, unit := range []Gravity{SG, Plato, Brix} {
+		for _, sg := range []float64{1.000, 1.012, 1.060, 1.110} {
+			roundTrip := ToSG(FromSG(sg, unit), unit)
+			if math.Abs(roundTrip-sg) > 0.0000001 {
+				t.Errorf("%s round trip of %v gave %v", unit, sg, roundTrip)
+			}
+		}
+	}
+}
+
+func TestTemperatureConversions(t *testing.T) {
+	if ToFahrenheit(20, Celsius) != 68 || FromFahrenheit(212, Celsius) != 100 {
+		t.Errorf("Wrong Celsius conversions")
+	}
+
+	if math.Abs(ToFahrenheit(293.15, Kelvin)-68) > 0.000001 {
+		t.Errorf("Wrong Kelvin conversion: %v", ToFahrenheit(293.15, Kelvin))
+	}
+}
+
+func TestParseSystem(t *testing.T) {
+	system, err := ParseSystem("metric")
+	if err != nil || system != (System{Gravity: Plato, Temperature: Celsius}) {
+		t.Errorf("Wrong metric system: %v %v", system, err)
+	}
+
+	system, err = ParseSystem("brix, °C")
+	if err != nil || system != (System{Gravity: Brix, Temperature: Celsius}) {
+		t.Errorf("Wrong explicit system: %v %v", system, err)
+	}
+
+	system, err = ParseSystem("")
+	if err != nil || system != Canonical {
+		t.Errorf("Wrong default system: %v %v", system, err)
+	}
+
+	_, err = ParseSystem("furlongs")
+	if err == nil {
+		t.Errorf("Parsed unknown units")
+	}
+}